@@ -22,6 +22,8 @@ var server_id = flag.Int("server_id", 0, "MySQL server id, as a pseudo slave")
 var flavor = flag.String("flavor", "", "flavor: mysql or mariadb")
 var execution = flag.String("exec", "", "mysqldump execution path")
 var logLevel = flag.String("log_level", "info", "log level")
+var dryRun = flag.String("dry_run", "", "write the bulk requests to this file, or - for stdout, instead of Elasticsearch")
+var dryRunPos = flag.String("dry_run_pos", "", "binlog position file:pos to start the dry run at")
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -76,12 +78,29 @@ func main() {
 		cfg.DumpExec = *execution
 	}
 
+	if len(*dryRun) > 0 {
+		cfg.DryRun = *dryRun
+	}
+
+	if len(*dryRunPos) > 0 {
+		cfg.DryRunPos = *dryRunPos
+	}
+
+	if flag.Arg(0) == "verify" {
+		// verify runs besides the river, it never saves the position
+		cfg.DataDir = ""
+	}
+
 	r, err := river.NewRiver(cfg)
 	if err != nil {
 		println(errors.ErrorStack(err))
 		return
 	}
 
+	if flag.Arg(0) == "verify" {
+		os.Exit(verify(r, flag.Args()[1:]))
+	}
+
 	r.Start()
 
 	select {
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/jrots/go-mysql-elasticsearch/river"
+	"github.com/juju/errors"
+)
+
+// verify compares every rule table with Elasticsearch and returns the exit code,
+// 1 if a document drifted from MySQL and wasn't repaired.
+//
+//	go-mysql-elasticsearch -config=./etc/river.toml verify [-repair]
+func verify(r *river.River, args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "write missing and different documents again, delete extra documents")
+	flags.Parse(args)
+
+	defer r.Close()
+
+	results, err := r.Verify(*repair)
+	for _, res := range results {
+		fmt.Println(res)
+	}
+	if err != nil {
+		println(errors.ErrorStack(err))
+		return 2
+	}
+
+	for _, res := range results {
+		if res.Drifted() && !*repair {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,230 @@
+package elasticwrapper
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	elastic "github.com/olivere/elastic"
+)
+
+// BulkConfig sets up the bulk processor. With Adaptive, the number of actions per bulk request
+// starts at Actions and follows the cluster: a rejected (429) bulk request halves it, a slower commit
+// than TargetLatency shrinks it and a commit within half of it grows it, up to MaxActions.
+// The bulk processor has a single worker, the requests of a document must be committed in order.
+type BulkConfig struct {
+	Actions       int
+	SizeBytes     int
+	FlushInterval time.Duration
+
+	Adaptive      bool
+	MinActions    int
+	MaxActions    int
+	TargetLatency time.Duration
+	// the bulk processor is rebuilt at most once per AdjustInterval
+	AdjustInterval time.Duration
+}
+
+func (b *BulkConfig) setDefaults() {
+	if b.Actions <= 0 {
+		b.Actions = 75
+	}
+	if b.SizeBytes <= 0 {
+		b.SizeBytes = 40 << 20
+	}
+	if b.FlushInterval <= 0 {
+		b.FlushInterval = 30 * time.Second
+	}
+	if b.MinActions <= 0 {
+		b.MinActions = 1
+	}
+	if b.MaxActions < b.Actions {
+		b.MaxActions = b.Actions
+	}
+	if b.MinActions > b.Actions {
+		b.MinActions = b.Actions
+	}
+	if b.TargetLatency <= 0 {
+		b.TargetLatency = time.Second
+	}
+	if b.AdjustInterval <= 0 {
+		b.AdjustInterval = 10 * time.Second
+	}
+}
+
+// bulkController picks the actions of the bulk processor from the observed commits.
+type bulkController struct {
+	sync.Mutex
+
+	cfg     BulkConfig
+	actions int
+
+	// the slowest commit since the last change and whether one was rejected
+	latency  time.Duration
+	rejected bool
+	changed  time.Time
+}
+
+func newBulkController(cfg BulkConfig, now time.Time) *bulkController {
+	return &bulkController{cfg: cfg, actions: cfg.Actions, changed: now}
+}
+
+// observe records a commit and adjusts the parameters once per AdjustInterval.
+func (b *bulkController) observe(latency time.Duration, rejected bool, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	if latency > b.latency {
+		b.latency = latency
+	}
+	b.rejected = b.rejected || rejected
+
+	// a rejection shrinks at once
+	if !b.rejected && now.Sub(b.changed) < b.cfg.AdjustInterval {
+		return
+	}
+
+	switch {
+	case b.rejected:
+		b.actions = maxInt(b.actions/2, b.cfg.MinActions)
+	case b.latency > b.cfg.TargetLatency:
+		b.actions = maxInt(b.actions*3/4, b.cfg.MinActions)
+	case b.latency < b.cfg.TargetLatency/2:
+		b.actions = minInt(b.actions+maxInt(b.actions/4, 1), b.cfg.MaxActions)
+	}
+
+	b.latency = 0
+	b.rejected = false
+	b.changed = now
+}
+
+func (b *bulkController) params() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.actions
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// startBulkProcessor starts a bulk processor with the actions of the controller. It has one worker,
+// with more the bulk requests commit in any order and a later write of a document may land first.
+func (c *Client) startBulkProcessor() error {
+	actions := c.bulk.Actions
+	if c.controller != nil {
+		actions = c.controller.params()
+	}
+
+	bulk, err := c.c.BulkProcessor().Name("MyBackgroundWorker-1").
+		Workers(1).
+		BulkActions(actions).
+		BulkSize(c.bulk.SizeBytes).
+		FlushInterval(c.bulk.FlushInterval).
+		// rejected actions go to the item handler, the response items must match the requests
+		RetryItemStatusCodes().
+		Before(c.before).
+		After(c.after).
+		Do(context.Background())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	c.BulkProcessor = bulk
+	c.bulkActions = actions
+	return nil
+}
+
+// adjustBulkProcessor replaces the bulk processor if the controller changed its parameters.
+// The old one commits its requests before the new one takes any.
+func (c *Client) adjustBulkProcessor() error {
+	if c.controller == nil {
+		return nil
+	}
+
+	actions := c.controller.params()
+
+	c.bulkLock.Lock()
+	defer c.bulkLock.Unlock()
+
+	if c.BulkProcessor == nil || actions == c.bulkActions {
+		return nil
+	}
+
+	if err := c.BulkProcessor.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(c.startBulkProcessor())
+}
+
+// BulkActions returns the actions per bulk request of the bulk processor.
+func (c *Client) BulkActions() int {
+	c.bulkLock.RLock()
+	defer c.bulkLock.RUnlock()
+
+	return c.bulkActions
+}
+
+// before is invoked by the bulk processor before every commit.
+func (c *Client) before(id int64, requests []elastic.BulkableRequest) {
+	c.startsLock.Lock()
+	c.starts[id] = time.Now()
+	c.startsLock.Unlock()
+}
+
+// observe passes the latency and rejections of a commit to the controller.
+func (c *Client) observe(id int64, response *elastic.BulkResponse, err error) {
+	c.startsLock.Lock()
+	start, ok := c.starts[id]
+	delete(c.starts, id)
+	c.startsLock.Unlock()
+
+	if c.controller == nil || !ok {
+		return
+	}
+
+	rejected := elastic.IsStatusCode(err, http.StatusTooManyRequests)
+	if response != nil {
+		for _, item := range response.Items {
+			for _, res := range item {
+				rejected = rejected || res.Status == http.StatusTooManyRequests
+			}
+		}
+	}
+	c.controller.observe(time.Since(start), rejected, time.Now())
+}
+
+// commitSeqs marks the bulk actions as committed, Committed only counts those up to the first one
+// not committed yet.
+func (c *Client) commitSeqs(seqs []int64) {
+	c.doneLock.Lock()
+	defer c.doneLock.Unlock()
+
+	for _, seq := range seqs {
+		c.done[seq] = struct{}{}
+	}
+
+	committed := atomic.LoadInt64(&c.committed)
+	for {
+		if _, ok := c.done[committed+1]; !ok {
+			break
+		}
+		delete(c.done, committed+1)
+		committed++
+	}
+	atomic.StoreInt64(&c.committed, committed)
+}
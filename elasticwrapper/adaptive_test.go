@@ -0,0 +1,90 @@
+package elasticwrapper
+
+import (
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+type adaptiveTestSuite struct{}
+
+var _ = Suite(&adaptiveTestSuite{})
+
+func (s *adaptiveTestSuite) TestController(c *C) {
+	cfg := BulkConfig{Actions: 100, Adaptive: true, MinActions: 10, MaxActions: 200}
+	cfg.setDefaults()
+	c.Assert(cfg.TargetLatency, Equals, time.Second)
+
+	now := time.Now()
+	b := newBulkController(cfg, now)
+
+	// fast commits grow the actions once per interval
+	b.observe(100*time.Millisecond, false, now.Add(time.Second))
+	c.Assert(b.params(), Equals, 100)
+	b.observe(100*time.Millisecond, false, now.Add(11*time.Second))
+	c.Assert(b.params(), Equals, 125)
+
+	now = now.Add(11 * time.Second)
+	for i := 1; i <= 4; i++ {
+		b.observe(100*time.Millisecond, false, now.Add(time.Duration(i)*11*time.Second))
+	}
+	// up to the maximum
+	c.Assert(b.params(), Equals, 200)
+
+	// a slow commit in the interval shrinks them
+	now = now.Add(44 * time.Second)
+	b.observe(2*time.Second, false, now.Add(time.Second))
+	b.observe(100*time.Millisecond, false, now.Add(11*time.Second))
+	c.Assert(b.params(), Equals, 150)
+
+	// a rejection at once
+	b.observe(100*time.Millisecond, true, now.Add(12*time.Second))
+	c.Assert(b.params(), Equals, 75)
+
+	for i := 0; i < 10; i++ {
+		b.observe(time.Second, true, now.Add(13*time.Second))
+	}
+	c.Assert(b.params(), Equals, 10)
+}
+
+func (s *adaptiveTestSuite) TestCommitSeqs(c *C) {
+	client := &Client{done: make(map[int64]struct{})}
+
+	client.commitSeqs([]int64{2, 4})
+	c.Assert(client.Committed(), Equals, int64(0))
+
+	client.commitSeqs([]int64{1})
+	c.Assert(client.Committed(), Equals, int64(2))
+
+	client.commitSeqs([]int64{3, 5})
+	c.Assert(client.Committed(), Equals, int64(5))
+	c.Assert(client.done, HasLen, 0)
+}
+
+func (s *adaptiveTestSuite) TestRejection(c *C) {
+	f := newFakeCluster(false)
+	defer f.Close()
+
+	client := NewClient(&ClientConfig{Addr: f.URL, Bulk: BulkConfig{
+		Actions:  4,
+		Adaptive: true,
+	}})
+	defer client.Close()
+
+	c.Assert(client.BulkActions(), Equals, 4)
+
+	reqs := []*BulkRequest{
+		{Action: ActionIndex, Index: "test", Type: "doc", ID: "1", Data: map[string]interface{}{"a": 1}, HardCrud: true},
+		{Action: ActionIndex, Index: "test", Type: "doc", ID: "rejected", Data: map[string]interface{}{"a": 1}, HardCrud: true},
+	}
+	c.Assert(client.Write(reqs), IsNil)
+	c.Assert(client.Flush(), IsNil)
+	c.Assert(client.Committed(), Equals, int64(2))
+
+	// the next write runs on a smaller bulk processor
+	c.Assert(client.Write(reqs[:1]), IsNil)
+	c.Assert(client.BulkActions(), Equals, 2)
+
+	c.Assert(client.Flush(), IsNil)
+	c.Assert(client.Committed(), Equals, int64(3))
+}
@@ -0,0 +1,78 @@
+package elasticwrapper
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// authTransport sets the Authorization header of every request to Elasticsearch,
+// the bulk processor and the helper calls share it.
+type authTransport struct {
+	authorization string
+	next          http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.authorization) == 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", t.authorization)
+	return t.next.RoundTrip(r)
+}
+
+// authorization returns the Authorization header of the config, empty without credentials.
+// An API key, given as id:key or already encoded, comes before a bearer token, which comes before basic auth.
+func (conf *ClientConfig) authorization() string {
+	switch {
+	case len(conf.APIKey) > 0:
+		key := conf.APIKey
+		if strings.Contains(key, ":") {
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+		return "ApiKey " + key
+	case len(conf.BearerToken) > 0:
+		return "Bearer " + conf.BearerToken
+	case len(conf.User) > 0:
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(conf.User+":"+conf.Password))
+	}
+	return ""
+}
+
+// newHTTPClient returns the HTTP client sending the credentials of the config, over TLS if it has a TLS config.
+func newHTTPClient(conf *ClientConfig) *http.Client {
+	var next http.RoundTripper = http.DefaultTransport
+	if conf.TLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = conf.TLS
+		next = transport
+	}
+
+	return &http.Client{
+		Transport: &authTransport{
+			authorization: conf.authorization(),
+			next:          next,
+		},
+	}
+}
+
+// url returns the URL of the path on the cluster, Addr may have a scheme or not.
+func (c *Client) url(path string) string {
+	addr := strings.TrimSuffix(c.Addr, "/")
+	if !strings.Contains(addr, "://") {
+		scheme := c.scheme
+		if len(scheme) == 0 {
+			scheme = "http"
+		}
+		addr = scheme + "://" + addr
+	}
+	return addr + path
+}
@@ -0,0 +1,212 @@
+package elasticwrapper
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jrots/go-mysql-elasticsearch/utils"
+	. "github.com/pingcap/check"
+)
+
+type authTestSuite struct{}
+
+var _ = Suite(&authTestSuite{})
+
+// fakeCluster answers like an Elasticsearch 6 node and records the Authorization headers,
+// the stored scripts and the last delete by query.
+type fakeCluster struct {
+	*httptest.Server
+
+	sync.Mutex
+	auth        map[string]string
+	scripts     map[string]string
+	puts        int
+	deleteQuery string
+}
+
+func newFakeCluster(https bool) *fakeCluster {
+	f := &fakeCluster{auth: make(map[string]string), scripts: make(map[string]string)}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.Lock()
+		f.auth[req.Method+" "+req.URL.Path] = req.Header.Get("Authorization")
+		f.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(req.URL.Path, "/_scripts/") {
+			f.storedScript(w, req)
+			return
+		}
+		if strings.HasSuffix(req.URL.Path, "/_delete_by_query") {
+			body, _ := ioutil.ReadAll(req.Body)
+			f.Lock()
+			f.deleteQuery = req.URL.Path + "?" + req.URL.RawQuery + " " + string(body)
+			f.Unlock()
+			fmt.Fprint(w, `{"took":1,"deleted":2,"total":2}`)
+			return
+		}
+		switch req.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"version":{"number":"6.8.0"}}`)
+		case "/_nodes/http":
+			fmt.Fprintf(w, `{"nodes":{"n1":{"http":{"publish_address":"%s"}}}}`, f.Listener.Addr())
+		case "/test/doc/1":
+			if req.Method == "HEAD" {
+				return
+			}
+			fmt.Fprint(w, `{"_index":"test","_type":"doc","_id":"1","_version":2,"found":true,"_source":{"a":1}}`)
+		case "/_bulk":
+			bulkResponse(w, req)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+
+	if https {
+		f.StartTLS()
+	} else {
+		f.Start()
+	}
+	return f
+}
+
+// storedScript gets or puts a stored script, a source containing "broken" doesn't compile.
+func (f *fakeCluster) storedScript(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	id := strings.TrimPrefix(req.URL.Path, "/_scripts/")
+	if req.Method == "PUT" {
+		body, _ := ioutil.ReadAll(req.Body)
+		if strings.Contains(string(body), "broken") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"script_exception","reason":"compile error"},"status":400}`)
+			return
+		}
+		f.scripts[id] = string(body)
+		f.puts++
+		fmt.Fprint(w, `{"acknowledged":true}`)
+		return
+	}
+
+	body, ok := f.scripts[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"_id":"%s","found":false}`, id)
+		return
+	}
+	// the stored body is {"script":{...}}
+	fmt.Fprintf(w, `{"_id":"%s","found":true,%s`, id, strings.TrimPrefix(body, "{"))
+}
+
+func (f *fakeCluster) authorization(request string) string {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.auth[request]
+}
+
+func (s *authTestSuite) TestAuthorization(c *C) {
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("elastic:secret"))
+	apiKey := "ApiKey " + base64.StdEncoding.EncodeToString([]byte("id:key"))
+
+	for _, t := range []struct {
+		cfg  ClientConfig
+		want string
+	}{
+		{ClientConfig{}, ""},
+		{ClientConfig{User: "elastic", Password: "secret"}, basic},
+		{ClientConfig{APIKey: "id:key"}, apiKey},
+		{ClientConfig{APIKey: "aWQ6a2V5"}, "ApiKey aWQ6a2V5"},
+		{ClientConfig{BearerToken: "token"}, "Bearer token"},
+		{ClientConfig{User: "elastic", APIKey: "id:key"}, apiKey},
+	} {
+		c.Assert(t.cfg.authorization(), Equals, t.want)
+	}
+}
+
+func (s *authTestSuite) TestRequests(c *C) {
+	f := newFakeCluster(false)
+	defer f.Close()
+
+	client := NewClient(&ClientConfig{Addr: f.URL, BearerToken: "token"})
+	defer client.Close()
+
+	// the version was detected through the elastic client
+	c.Assert(client.Version().Major, Equals, 6)
+	c.Assert(f.authorization("GET /"), Equals, "Bearer token")
+
+	r, err := client.Get("test", "doc", "1")
+	c.Assert(err, IsNil)
+	c.Assert(r.Code, Equals, http.StatusOK)
+	c.Assert(r.Found, IsTrue)
+	c.Assert(r.Version, Equals, 2)
+	c.Assert(r.Source, DeepEquals, map[string]interface{}{"a": float64(1)})
+	c.Assert(f.authorization("GET /test/doc/1"), Equals, "Bearer token")
+
+	exists, err := client.Exists("test", "doc", "1")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsTrue)
+
+	exists, err = client.Exists("test", "doc", "2")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsFalse)
+
+	c.Assert(client.Delete("test", "doc", "2"), IsNil)
+	c.Assert(f.authorization("DELETE /test/doc/2"), Equals, "Bearer token")
+}
+
+func (s *authTestSuite) TestTLS(c *C) {
+	f := newFakeCluster(true)
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "es_tls")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	ca := path.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw}), 0644)
+	c.Assert(err, IsNil)
+
+	tlsConfig, err := utils.NewTLSConfig(ca, "", "", false)
+	c.Assert(err, IsNil)
+
+	// without scheme, the TLS config makes it https
+	client := NewClient(&ClientConfig{Addr: strings.TrimPrefix(f.URL, "https://"), User: "elastic", TLS: tlsConfig})
+	defer client.Close()
+
+	c.Assert(client.Version().Major, Equals, 6)
+	exists, err := client.Exists("test", "doc", "1")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsTrue)
+
+	_, err = utils.NewTLSConfig(path.Join(dir, "missing.pem"), "", "", false)
+	c.Assert(err, NotNil)
+	_, err = utils.NewTLSConfig("", ca, "", false)
+	c.Assert(err, NotNil)
+}
+
+func (s *authTestSuite) TestURL(c *C) {
+	client := &Client{Addr: "127.0.0.1:9200"}
+	c.Assert(client.url("/_bulk"), Equals, "http://127.0.0.1:9200/_bulk")
+
+	client.Addr = "https://es.example.com/"
+	c.Assert(client.url("/_bulk"), Equals, "https://es.example.com/_bulk")
+
+	client.version = mustVersion(c, "7.10.0")
+	c.Assert(client.docURL("test", "doc", "a b"), Equals, "https://es.example.com/test/_doc/a+b")
+}
+
+func mustVersion(c *C, number string) Version {
+	v, err := NewVersion(number, "")
+	c.Assert(err, IsNil)
+	return v
+}
@@ -0,0 +1,133 @@
+package elasticwrapper
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	. "github.com/pingcap/check"
+)
+
+type bulkResponseTestSuite struct{}
+
+var _ = Suite(&bulkResponseTestSuite{})
+
+// bulkResponse answers every action of a bulk request by its document ID:
+// conflict, missing, rejected and bad fail like Elasticsearch does, other IDs succeed.
+func bulkResponse(w http.ResponseWriter, req *http.Request) {
+	var items []map[string]interface{}
+	scanner := bufio.NewScanner(req.Body)
+	for scanner.Scan() {
+		var line map[string]map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		for action, meta := range line {
+			switch action {
+			case ActionIndex, ActionCreate, ActionUpdate, ActionDelete:
+			default:
+				continue
+			}
+
+			item := map[string]interface{}{"_index": meta["_index"], "_id": meta["_id"], "status": 200}
+			switch meta["_id"] {
+			case "conflict":
+				item["status"] = 409
+				item["error"] = map[string]string{"type": "version_conflict_engine_exception", "reason": "version conflict"}
+			case "missing":
+				item["status"] = 404
+				item["error"] = map[string]string{"type": "document_missing_exception", "reason": "document missing"}
+			case "rejected":
+				item["status"] = 429
+				item["error"] = map[string]string{"type": "es_rejected_execution_exception", "reason": "rejected execution"}
+			case "bad":
+				item["status"] = 400
+				item["error"] = map[string]string{"type": "mapper_parsing_exception", "reason": "failed to parse field [a]"}
+			}
+			items = append(items, map[string]interface{}{action: item})
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": true, "items": items})
+}
+
+func (s *bulkResponseTestSuite) TestItemResults(c *C) {
+	f := newFakeCluster(false)
+	defer f.Close()
+
+	client := NewClient(&ClientConfig{Addr: f.URL})
+	defer client.Close()
+
+	var lock sync.Mutex
+	outcomes := make(map[string]string)
+	var acked []*BulkRequest
+	client.SetItemHandler(func(results []*ItemResult) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, res := range results {
+			outcomes[fmt.Sprintf("%s %s", res.Request.ID, res.Action)] = res.Outcome
+		}
+	})
+	client.SetAckHandler(func(items []*BulkRequest, err error) {
+		c.Assert(err, IsNil)
+		acked = append(acked, items...)
+	})
+
+	reqs := []*BulkRequest{
+		{Action: ActionIndex, Index: "test", Type: "doc", ID: "1", Data: map[string]interface{}{"a": 1}},
+		{Action: ActionUpdate, Index: "test", Type: "doc", ID: "conflict", Data: map[string]interface{}{"a": 1}},
+		{Action: ActionUpdate, Index: "test", Type: "doc", ID: "missing", Data: map[string]interface{}{"a": 1}, UpdateOnly: true},
+		{Action: ActionIndex, Index: "test", Type: "doc", ID: "bad", Data: map[string]interface{}{"a": "x"}, HardCrud: true},
+		{Action: ActionDelete, Index: "test", Type: "doc", ID: "2", HardCrud: true},
+	}
+	c.Assert(client.Write(reqs), IsNil)
+	c.Assert(client.Flush(), IsNil)
+
+	c.Assert(outcomes, DeepEquals, map[string]string{
+		"1 index":         OutcomeSuccess,
+		"conflict update": OutcomeConflict,
+		"missing update":  OutcomeNotFound,
+		"bad index":       OutcomeMappingError,
+		"2 delete":        OutcomeSuccess,
+	})
+
+	ids := make([]string, 0, len(acked))
+	for _, item := range acked {
+		ids = append(ids, item.ID)
+	}
+	sort.Strings(ids)
+	c.Assert(ids, DeepEquals, []string{"1", "2", "bad", "conflict", "missing"})
+	c.Assert(client.Committed(), Equals, int64(5))
+}
+
+func (s *bulkResponseTestSuite) TestSkipped(c *C) {
+	f := newFakeCluster(false)
+	defer f.Close()
+
+	client := NewClient(&ClientConfig{Addr: f.URL})
+	defer client.Close()
+
+	var acked []*BulkRequest
+	client.SetAckHandler(func(items []*BulkRequest, err error) {
+		c.Assert(err, IsNil)
+		acked = append(acked, items...)
+	})
+
+	// an update of filtered columns only and an index without document have no bulk action
+	reqs := []*BulkRequest{
+		{Action: ActionUpdate, Index: "test", Type: "doc", ID: "1"},
+		{Action: ActionIndex, Index: "test", Type: "doc", ID: "2", HardCrud: true},
+		{Action: ActionIndex, Index: "test", Type: "doc", ID: "3", HardCrud: true, Data: map[string]interface{}{"a": 1}},
+	}
+	c.Assert(client.Write(reqs), IsNil)
+
+	// they are done without waiting for a commit
+	c.Assert(acked, DeepEquals, reqs[:2])
+	c.Assert(client.Queued(), Equals, int64(1))
+
+	c.Assert(client.Flush(), IsNil)
+	c.Assert(acked, DeepEquals, reqs)
+}
@@ -3,11 +3,17 @@ package elasticwrapper
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
@@ -22,27 +28,111 @@ type Client struct {
 	Addr          string
 	User          string
 	Password      string
+	APIKey        string
+	BearerToken   string
 //	File		*os.File
 	BulkProcessor *elastic.BulkProcessor
 	BulkProcessorDelete *elastic.BulkProcessor
 
 	totalRequests int
 	c    *elastic.Client
+	// sends the helper requests, with the same credentials as c
+	http *http.Client
+	// scheme of Addr without one, https with a TLS config
+	scheme string
+
+	// bulk lines are written here instead of sent to Elasticsearch in dry run mode
+	dryRun     io.Writer
+	dryRunLock sync.Mutex
+
+	ack func(items []*BulkRequest, err error)
+	// gets the outcome of every bulk action of a commit
+	itemHandler func(results []*ItemResult)
+
+	version Version
+
+	// bulk actions queued and committed (successful or not), accessed atomically
+	queued    int64
+	committed int64
+	// committed actions after one still running
+	done     map[int64]struct{}
+	doneLock sync.Mutex
+
+	bulk       BulkConfig
+	controller *bulkController
+	// guards BulkProcessor while it is replaced
+	bulkLock    sync.RWMutex
+	bulkActions int
+	// start of the running commits by execution ID
+	starts     map[int64]time.Time
+	startsLock sync.Mutex
 }
 
 type ClientConfig struct {
 	Addr     string
 	User     string
 	Password string
+	// APIKey is id:key or its base64 encoding, it is used instead of User and Password
+	APIKey string
+	// BearerToken is a token of the token service or an OAuth2 access token
+	BearerToken string
+
+	// TLS is used for HTTPS connections, it makes an Addr without scheme use https
+	TLS *tls.Config
+
+	// DryRun gets the bulk action and source lines, no connection to Elasticsearch is made
+	DryRun io.Writer
+
+	// Version of the cluster, detected if not set
+	Version *Version
+
+	// Bulk sets up the bulk processor, the defaults are 75 actions, 40MB, 30s and one worker
+	Bulk BulkConfig
 }
 
+// ErrDryRun is returned by the calls which need Elasticsearch in dry run mode.
+var ErrDryRun = errors.New("not available in dry run mode")
+
+// ErrClosed is returned for requests written after Close.
+var ErrClosed = errors.New("client closed")
+
 // after is invoked by bulk processor after every commit.
 // The err variable indicates success or failure.
 func (c *Client) after(id int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if err != nil {
-			fmt.Println(err);
+	// counted after the ack handler saw a failure
+	seqs := make([]int64, 0, len(requests))
+	for _, req := range requests {
+		if tracked, ok := req.(trackedRequest); ok {
+			seqs = append(seqs, tracked.seq)
+		}
+	}
+	defer c.commitSeqs(seqs)
+
+	// the error of a failed bulk goes to the ack handler
+	c.observe(id, response, err)
+
+	if c.itemHandler != nil && response != nil {
+		c.itemHandler(itemResults(requests, response))
 	}
-	//fmt.Println(response.Took, response.Errors, len(response.Items))
+
+	if c.ack == nil {
+		return
+	}
+
+	items := make([]*BulkRequest, 0, len(requests))
+	seen := make(map[*BulkRequest]struct{}, len(requests))
+	for _, req := range requests {
+		tracked, ok := req.(trackedRequest)
+		if !ok {
+			continue
+		}
+		// a request with deleted fields has several bulk actions
+		if _, ok = seen[tracked.item]; !ok {
+			seen[tracked.item] = struct{}{}
+			items = append(items, tracked.item)
+		}
+	}
+	c.ack(items, err)
 }
 
 
@@ -59,23 +149,45 @@ func NewClient(conf *ClientConfig) *Client {
 	c.Addr = conf.Addr
 	c.User = conf.User
 	c.Password = conf.Password
+	c.APIKey = conf.APIKey
+	c.BearerToken = conf.BearerToken
+	c.bulk = conf.Bulk
+	c.bulk.setDefaults()
+	c.done = make(map[int64]struct{})
+	c.starts = make(map[int64]time.Time)
+	if conf.TLS != nil {
+		c.scheme = "https"
+	}
+	if conf.Version != nil {
+		c.version = *conf.Version
+	}
+	if conf.DryRun != nil {
+		c.dryRun = conf.DryRun
+		return c
+	}
+	c.http = newHTTPClient(conf)
+	addr := c.url("")
 	client, err := elastic.NewClient(
-		elastic.SetURL(	c.Addr ))
+		elastic.SetURL(addr),
+		// the sniffed nodes are reached with the same scheme
+		elastic.SetScheme(addr[:strings.Index(addr, "://")]),
+		elastic.SetHttpClient(c.http))
 
 	if err != nil {
 		panic(err)
 	}
 	c.c = client
+	if conf.Version == nil {
+		if c.version, err = c.detectVersion(); err != nil {
+			panic(err)
+		}
+	}
 	c.totalRequests = 0
-	bulk, err := c.c.BulkProcessor().Name("MyBackgroundWorker-1").
-		Workers(1).
-		BulkActions(75).               // commit if # requests >= 1000
-		BulkSize(40 << 20).               // commit if size of requests >= 2 MB
-		FlushInterval(30 * time.Second). // commit every 30s
-		After(c.after).
-		Do(context.Background())
-	if err == nil {
-		c.BulkProcessor = bulk
+	if conf.Bulk.Adaptive {
+		c.controller = newBulkController(c.bulk, time.Now())
+	}
+	if err = c.startBulkProcessor(); err != nil {
+		panic(err)
 	}
 	/*
 	bulkDel, err := c.c.BulkProcessor().Name("DeleteWorker-1").
@@ -114,6 +226,71 @@ const (
 	ActionIndex  = "index"
 )
 
+// Outcomes of a bulk action
+const (
+	OutcomeSuccess = "success"
+	// the document was changed concurrently, e.g. by another writer
+	OutcomeConflict = "conflict"
+	// the document to update doesn't exist, e.g. a field removal or an update_only request for a missing document
+	OutcomeNotFound = "not_found"
+	// the document doesn't match the mapping of the index, retrying doesn't help
+	OutcomeMappingError = "mapping_error"
+	// the cluster is overloaded (429), the action may succeed later
+	OutcomeRejected = "rejected"
+	OutcomeFailed       = "failed"
+)
+
+// ItemResult is the outcome of one bulk action, with the request it was built from.
+type ItemResult struct {
+	Request *BulkRequest
+	Action  string
+	Status  int
+	Outcome string
+	// Error is the type and reason of a failed action
+	Error string
+}
+
+// itemResults maps the items of the response to their requests, they are in the same order.
+func itemResults(requests []elastic.BulkableRequest, response *elastic.BulkResponse) []*ItemResult {
+	results := make([]*ItemResult, 0, len(response.Items))
+	for i, item := range response.Items {
+		if i >= len(requests) {
+			break
+		}
+		tracked, ok := requests[i].(trackedRequest)
+		if !ok {
+			continue
+		}
+		for action, res := range item {
+			result := &ItemResult{Request: tracked.item, Action: action, Status: res.Status, Outcome: outcome(res)}
+			if res.Error != nil {
+				result.Error = fmt.Sprintf("%s: %s", res.Error.Type, res.Error.Reason)
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+func outcome(res *elastic.BulkResponseItem) string {
+	switch {
+	case res.Status >= 200 && res.Status <= 299:
+		return OutcomeSuccess
+	case res.Status == http.StatusConflict:
+		return OutcomeConflict
+	case res.Status == http.StatusNotFound:
+		return OutcomeNotFound
+	case res.Status == http.StatusTooManyRequests:
+		return OutcomeRejected
+	case res.Status == http.StatusBadRequest && res.Error != nil:
+		switch res.Error.Type {
+		case "mapper_parsing_exception", "strict_dynamic_mapping_exception", "document_parsing_exception", "illegal_argument_exception":
+			return OutcomeMappingError
+		}
+	}
+	return OutcomeFailed
+}
+
 type BulkRequest struct {
 	Action        string
 	Index         string
@@ -126,12 +303,123 @@ type BulkRequest struct {
 	HardCrud bool
 	Initial bool
 	ListRequest bool
+	// ListKey is the list field of a list request, its value in Data is added or removed
+	ListKey string
+	// UpdateOnly requests never create a missing document, they are dropped by Elasticsearch instead
+	UpdateOnly bool
+	// Aggregate requests run the aggregate script with Data as its params
+	Aggregate bool
+
+	// Sink is the name of the sink the request is written to, empty for Elasticsearch
+	Sink string
+	// Retries counts how often the request was written again after a failed action
+	Retries int
 
 	Data         map[string]interface{}
 	DeleteFields map[string]interface{}
+
+	// Cascade deletes the children of a deleted parent once a cluster committed the delete
+	Cascade []*DeleteQuery
+}
+
+// DeleteQuery deletes the documents of an index matching Query, on the shard of Routing if set.
+type DeleteQuery struct {
+	Index   string
+	Type    string
+	Routing string
+	Query   elastic.Query
 }
 
-func (r *BulkRequest) prepareBulkUpdateRequest() (*elastic.BulkUpdateRequest, error) {
+// prepareBulkRequest builds the bulk action matching r.Action.
+// Index, create and hard deletes are sent as is, everything else goes through an update.
+// Typeless requests, for Elasticsearch 7+ and OpenSearch, have no type and route by parent.
+func (r *BulkRequest) prepareBulkRequest(typeless bool) (elastic.BulkableRequest, error) {
+	switch r.Action {
+	case ActionIndex, ActionCreate:
+		if r.ListRequest {
+			break
+		}
+		bulkRequest := elastic.NewBulkIndexRequest()
+		if r.Action == ActionCreate {
+			bulkRequest.OpType(ActionCreate)
+		}
+		if len(r.Index) > 0 {
+			bulkRequest.Index(r.Index)
+		}
+		if len(r.Type) > 0 && !typeless {
+			bulkRequest.Type(r.Type)
+		}
+		if len(r.ID) > 0 {
+			bulkRequest.Id(r.ID)
+		}
+		data, routing := r.joinData()
+		if len(routing) > 0 {
+			bulkRequest.Routing(routing)
+		} else if len(r.JoinField) == 0 && len(r.Parent) > 0 && typeless {
+			bulkRequest.Routing(r.Parent)
+		} else if len(r.JoinField) == 0 && len(r.Parent) > 0 {
+			bulkRequest.Parent(r.Parent)
+		}
+		if len(data) == 0 {
+			return bulkRequest, errors.New("empty document")
+		}
+		return bulkRequest.Doc(data), nil
+	case ActionDelete:
+		if !r.HardCrud {
+			break
+		}
+		bulkRequest := elastic.NewBulkDeleteRequest()
+		if len(r.Index) > 0 {
+			bulkRequest.Index(r.Index)
+		}
+		if len(r.Type) > 0 && !typeless {
+			bulkRequest.Type(r.Type)
+		}
+		if len(r.ID) > 0 {
+			bulkRequest.Id(r.ID)
+		}
+		if (len(r.JoinField) > 0 || typeless) && len(r.Parent) > 0 {
+			bulkRequest.Routing(r.Parent)
+		} else if len(r.Parent) > 0 {
+			bulkRequest.Parent(r.Parent)
+		}
+		return bulkRequest, nil
+	}
+
+	return r.prepareBulkUpdateRequest(typeless)
+}
+
+// joinData returns the document data with the join field and the routing to use, if any. The data
+// of the request is left alone, the request is prepared for every target, retry and sink while the
+// ones before are still sent.
+func (r *BulkRequest) joinData() (map[string]interface{}, string) {
+	if len(r.JoinField) == 0 {
+		return r.Data, ""
+	}
+
+	var join map[string]interface{}
+	if len(r.Parent) > 0 {
+		join = map[string]interface{}{
+			"name":   r.JoinFieldName,
+			"parent": r.Parent,
+		}
+	} else if r.Initial {
+		join = map[string]interface{}{
+			"name": r.JoinFieldName,
+		}
+	} else {
+		return r.Data, ""
+	}
+
+	data := make(map[string]interface{}, len(r.Data)+1)
+	for k, v := range r.Data {
+		data[k] = v
+	}
+	data[r.JoinField] = join
+	return data, r.Parent
+}
+
+func (r *BulkRequest) prepareBulkUpdateRequest(typeless bool) (*elastic.BulkUpdateRequest, error) {
 
 	bulkRequest := elastic.NewBulkUpdateRequest()
 	/*update2Req := elastic.NewBulkUpdateRequest().Index("twoo_prod_1").Type("doc").Id("3").
@@ -141,88 +429,138 @@ func (r *BulkRequest) prepareBulkUpdateRequest() (*elastic.BulkUpdateRequest, er
 	if len(r.Index) > 0 {
 		bulkRequest.Index(r.Index)
 	}
-	if len(r.Type) > 0 {
+	if len(r.Type) > 0 && !typeless {
 		bulkRequest.Type(r.Type)
 	}
 
 	if len(r.ID) > 0 {
 		bulkRequest.Id(r.ID)
 	}
+	data := r.Data
 	if len(r.JoinField) > 0 {
-		if len(r.Parent) > 0 {
-			r.Data[r.JoinField] = map[string]interface{}{
-				"name":   r.JoinFieldName,
-				"parent": r.Parent,
-			}
-			bulkRequest.Routing(r.Parent)
-		} else if r.Initial {
-			r.Data[r.JoinField] = map[string]interface{}{
-				"name": r.JoinFieldName,
-			}
+		var routing string
+		if data, routing = r.joinData(); len(routing) > 0 {
+			bulkRequest.Routing(routing)
 		}
+	} else if len(r.Parent) > 0 && typeless {
+		bulkRequest.Routing(r.Parent)
 	} else if len(r.Parent) > 0 {
 		bulkRequest.Parent(r.Parent)
 	}
 	if r.Action == ActionUpdate || !r.HardCrud {
 		bulkRequest.RetryOnConflict(2)
 	}
-	/* @TODO fix hardcrud separate actions!
-	if r.HardCrud {
-		meta[r.Action] = metaData
-	} else {
-		meta["update"] = metaData // all requests are update in this case
-	}
-	*/
 
-	doc := map[string]interface{}{}
-	if r.ListRequest {
-		for listKey, _ := range r.Data {
-			r.Data["key"] = listKey
-			break
+	if r.Aggregate {
+		bulkRequest.Script(elastic.NewScriptStored(ScriptID(ScriptAggregate)).Params(r.Data))
+		if !r.UpdateOnly {
+			bulkRequest.Upsert(map[string]interface{}{}).
+				ScriptedUpsert(true)
 		}
+		return bulkRequest, nil
 	}
 
+	doc := map[string]interface{}{}
+
 	switch r.Action {
 	case ActionDelete:
 		if !r.HardCrud {
 			if r.ListRequest {
-				bulkRequest.Script(elastic.NewScriptStored("remove_from_list").Params(r.Data)).
-					Upsert(map[string]interface{}{}).
-					ScriptedUpsert(true)
-
-				return bulkRequest, nil
+				bulkRequest.Script(elastic.NewScriptStored(ScriptID(ScriptRemoveFromList)).Params(r.listParams()))
 			} else {
-				bulkRequest.Script(elastic.NewScriptStored("remove_from_source").Params(r.Data)).
-					Upsert(map[string]interface{}{}).
+				bulkRequest.Script(elastic.NewScriptStored(ScriptID(ScriptRemoveFromSource)).Params(r.removeParams()))
+			}
+			if !r.UpdateOnly {
+				bulkRequest.Upsert(map[string]interface{}{}).
 					ScriptedUpsert(true)
-				return bulkRequest, nil
 			}
+			return bulkRequest, nil
 		}
 	case ActionUpdate:
 		// When more then 1 item to update
 		// When no parent and not initial data
-		if len(r.Data) > 1 || (len(r.Parent) == 0 && len(r.Data) == 1 && !r.Initial)  {
-			doc = r.Data
+		if len(data) > 1 || (len(r.Parent) == 0 && len(data) == 1 && !r.Initial)  {
+			doc = data
+		}
+		if len(r.DeleteFields) > 0 && !r.ListRequest {
+			return r.prepareScriptedUpdate(bulkRequest, doc), nil
 		}
 	default:
-		doc = r.Data
+		doc = data
 	}
 
 	if r.ListRequest {
-		bulkRequest.Script(elastic.NewScriptStored("add_to_list").Params(r.Data)).
-		Upsert(map[string]interface{}{}).
-		ScriptedUpsert(true)
+		bulkRequest.Script(elastic.NewScriptStored(ScriptID(ScriptAddToList)).Params(r.listParams()))
+		if !r.UpdateOnly {
+			bulkRequest.Upsert(map[string]interface{}{}).
+				ScriptedUpsert(true)
+		}
 		return bulkRequest, nil
 	}
 
 	if len(doc) > 0 {
-		bulkRequest.DocAsUpsert(true)
+		if !r.UpdateOnly {
+			bulkRequest.DocAsUpsert(true)
+		}
 		return bulkRequest.Doc(doc), nil
 	} else {
 		return bulkRequest, errors.New("empty update")
 	}
 }
 
+// prepareScriptedUpdate sets doc and removes the deleted fields with a single script,
+// a missing document is created from doc unless the request is update only.
+func (r *BulkRequest) prepareScriptedUpdate(bulkRequest *elastic.BulkUpdateRequest, doc map[string]interface{}) *elastic.BulkUpdateRequest {
+	params := map[string]interface{}{
+		"doc":    doc,
+		"remove": r.deleteFieldNames(),
+	}
+	bulkRequest.Script(elastic.NewScriptStored(ScriptID(ScriptUpdateSource)).Params(params))
+	if !r.UpdateOnly {
+		bulkRequest.Upsert(doc)
+	}
+	return bulkRequest
+}
+
+// listParams returns the params of the list scripts, the list field as key and its value.
+// Data is left alone, a request is prepared again for every target, retry and dual write copy.
+func (r *BulkRequest) listParams() map[string]interface{} {
+	key := r.ListKey
+	if len(key) == 0 {
+		// the only field of the request
+		for k := range r.Data {
+			key = k
+			break
+		}
+	}
+	return map[string]interface{}{"key": key, key: r.Data[key]}
+}
+
+// removeParams returns the fields remove_from_source removes for a soft delete, the data and deleted fields.
+func (r *BulkRequest) removeParams() map[string]interface{} {
+	if len(r.DeleteFields) == 0 {
+		return r.Data
+	}
+	params := make(map[string]interface{}, len(r.Data)+len(r.DeleteFields))
+	for k, v := range r.Data {
+		params[k] = v
+	}
+	for k := range r.DeleteFields {
+		params[k] = true
+	}
+	return params
+}
+
+// deleteFieldNames returns the sorted names of the deleted fields.
+func (r *BulkRequest) deleteFieldNames() []string {
+	names := make([]string, 0, len(r.DeleteFields))
+	for k := range r.DeleteFields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type BulkResponse struct {
 	Code   int
 	Took   int  `json:"took"`
@@ -241,29 +579,36 @@ type BulkResponseItem struct {
 	Found   bool            `json:"found"`
 }
 
+// DoRequest sends the request with the credentials of the client, body may be nil.
 func (c *Client) DoRequest(method string, url string, body *bytes.Buffer) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, body)
+	if c.http == nil {
+		return nil, ErrDryRun
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = body
+	}
+	req, err := http.NewRequest(method, url, reader)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	if len(c.User) > 0 && len(c.Password) > 0 {
-		req.SetBasicAuth(c.User, c.Password)
-	}
 
 	req.Header.Set("Content-Type", "application/json")
-//	resp, err := c.c.Do(req)
-	//@TODO fix
-	return &http.Response{}, err
+	resp, err := c.http.Do(req)
+	return resp, errors.Trace(err)
 }
 
 func (c *Client) Do(method string, url string, body map[string]interface{}) (*Response, error) {
-	bodyData, err := json.Marshal(body)
-	if err != nil {
-		return nil, errors.Trace(err)
+	var buf *bytes.Buffer
+	if body != nil {
+		bodyData, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		buf = bytes.NewBuffer(bodyData)
 	}
 
-	buf := bytes.NewBuffer(bodyData)
-
 	resp, err := c.DoRequest(method, url, buf)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -299,40 +644,160 @@ func (c *Client) OutputStats() {
 	fmt.Printf("Number of requests reported as failed : %d\n", stats.Failed)
 }
 
+// DoBulk queues the requests in the bulk processor, the returned response is always empty,
+// the outcome of the requests goes to the item and ack handlers once they are committed.
 func (c *Client) DoBulk(url string, items []*BulkRequest) (*BulkResponse, error) {
-	var bulkRequest *elastic.BulkUpdateRequest
-	var err error
+	// requests without bulk action, like an update of filtered columns only, are done at once
+	var skipped []*BulkRequest
 	for _, item := range items {
-
-		if bulkRequest, err = item.prepareBulkUpdateRequest(); err == nil {
+		bulkRequests := item.bulkableRequests(c.version.Typeless())
+		if len(bulkRequests) == 0 {
+			skipped = append(skipped, item)
+		}
+		for _, bulkRequest := range bulkRequests {
 			c.totalRequests = c.totalRequests+1
-			c.BulkProcessor.Add(bulkRequest)
-		}
-
-		if len(item.DeleteFields) > 0 {
-			for k := range item.DeleteFields {
-				delReq := new(BulkRequest)
-				delReq.Action = ActionDelete
-				delReq.Type = item.Type
-				delReq.ID = item.ID
-				delReq.Index = item.Index
-				delReq.Data = make(map[string]interface{})
-				delReq.Data[k] = true
-
-				if bulkRequest, err = delReq.prepareBulkUpdateRequest(); err == nil {
-					c.BulkProcessor.Add(bulkRequest)
-					c.totalRequests = c.totalRequests+1
-				}
+			if err := c.add(bulkRequest); err != nil {
+				return nil, errors.Trace(err)
 			}
 		}
 	}
 
+	if c.dryRun != nil && c.ack != nil {
+		c.ack(items, nil)
+	} else if len(skipped) > 0 && c.ack != nil {
+		c.ack(skipped, nil)
+	}
+
 	return &BulkResponse{}, nil
 }
 
+// Write queues the requests in the bulk processor, the ack handler gets them once they are committed.
+func (c *Client) Write(items []*BulkRequest) error {
+	_, err := c.Bulk(items)
+	return errors.Trace(err)
+}
+
+// SetAckHandler sets the function called after every bulk commit with the requests it contained.
+func (c *Client) SetAckHandler(fn func(items []*BulkRequest, err error)) {
+	c.ack = fn
+}
+
+// SetItemHandler sets the function called after every bulk commit Elasticsearch answered,
+// with the outcome of every bulk action, before the ack handler.
+func (c *Client) SetItemHandler(fn func(results []*ItemResult)) {
+	c.itemHandler = fn
+}
+
+// Queued returns the number of bulk actions queued so far.
+func (c *Client) Queued() int64 {
+	return atomic.LoadInt64(&c.queued)
+}
+
+// Committed returns the number of bulk actions committed so far, including failed ones.
+// All actions queued before the last committed one are committed too.
+func (c *Client) Committed() int64 {
+	return atomic.LoadInt64(&c.committed)
+}
+
+// trackedRequest keeps the request a bulkable request was built from.
+type trackedRequest struct {
+	elastic.BulkableRequest
+	item *BulkRequest
+	// position in the queue, set by add
+	seq int64
+}
+
+// bulkableRequests returns the bulk action of the request. Updates and soft deletes remove the deleted
+// fields in the same action, index, create and hard deletes drop them with the whole document.
+// Only a list update is followed by a single action removing them.
+// A request which can't be built, e.g. an index without document, is skipped.
+func (r *BulkRequest) bulkableRequests(typeless bool) []elastic.BulkableRequest {
+	var reqs []elastic.BulkableRequest
+
+	if bulkRequest, err := r.prepareBulkRequest(typeless); err == nil {
+		reqs = append(reqs, trackedRequest{BulkableRequest: bulkRequest, item: r})
+	}
+
+	if len(r.DeleteFields) == 0 || !r.ListRequest || (r.Action == ActionDelete && r.HardCrud) {
+		return reqs
+	}
+
+	delReq := new(BulkRequest)
+	delReq.Action = ActionDelete
+	delReq.Type = r.Type
+	delReq.ID = r.ID
+	delReq.Index = r.Index
+	delReq.Parent = r.Parent
+	delReq.UpdateOnly = r.UpdateOnly
+	delReq.Data = make(map[string]interface{}, len(r.DeleteFields))
+	for k := range r.DeleteFields {
+		delReq.Data[k] = true
+	}
+
+	if bulkRequest, err := delReq.prepareBulkRequest(typeless); err == nil {
+		reqs = append(reqs, trackedRequest{BulkableRequest: bulkRequest, item: r})
+	}
+
+	return reqs
+}
+
+// Lines returns the bulk action and source lines of the request, like they are sent to Elasticsearch.
+// A request without type is typeless.
+func (r *BulkRequest) Lines() ([]string, error) {
+	var lines []string
+	for _, bulkRequest := range r.bulkableRequests(len(r.Type) == 0) {
+		source, err := bulkRequest.Source()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		lines = append(lines, source...)
+	}
+	return lines, nil
+}
+
+// add queues the request in the bulk processor, or writes its lines in dry run mode.
+func (c *Client) add(req elastic.BulkableRequest) error {
+	seq := atomic.AddInt64(&c.queued, 1)
+	if tracked, ok := req.(trackedRequest); ok {
+		tracked.seq = seq
+		req = tracked
+	}
+
+	if c.dryRun == nil {
+		if err := c.adjustBulkProcessor(); err != nil {
+			return errors.Trace(err)
+		}
+
+		c.bulkLock.RLock()
+		defer c.bulkLock.RUnlock()
+
+		if c.BulkProcessor == nil {
+			return ErrClosed
+		}
+		c.BulkProcessor.Add(req)
+		return nil
+	}
+	defer c.commitSeqs([]int64{seq})
+
+	lines, err := req.Source()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	c.dryRunLock.Lock()
+	defer c.dryRunLock.Unlock()
+
+	for _, line := range lines {
+		if _, err = io.WriteString(c.dryRun, line+"\n"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
 func (c *Client) CreateMapping(index string, docType string, mapping map[string]interface{}) error {
-	reqUrl := fmt.Sprintf("http://%s/%s", c.Addr,
-		url.QueryEscape(index))
+	reqUrl := c.url(fmt.Sprintf("/%s",
+		url.QueryEscape(index)))
 
 	r, err := c.Do("HEAD", reqUrl, nil)
 	if err != nil {
@@ -350,17 +815,28 @@ func (c *Client) CreateMapping(index string, docType string, mapping map[string]
 		return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
 	}
 
-	reqUrl = fmt.Sprintf("http://%s/%s/%s/_mapping", c.Addr,
+	reqUrl = c.url(fmt.Sprintf("/%s/%s/_mapping",
 		url.QueryEscape(index),
-		url.QueryEscape(docType))
+		url.QueryEscape(docType)))
+	if c.version.Typeless() {
+		reqUrl = c.url(fmt.Sprintf("/%s/_mapping",
+			url.QueryEscape(index)))
+	}
 
-	_, err = c.Do("POST", reqUrl, mapping)
-	return errors.Trace(err)
+	r, err = c.Do("PUT", reqUrl, mapping)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code != http.StatusOK {
+		return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+	}
+	return nil
 }
 
 func (c *Client) DeleteIndex(index string) error {
-	reqUrl := fmt.Sprintf("http://%s/%s", c.Addr,
-		url.QueryEscape(index))
+	reqUrl := c.url(fmt.Sprintf("/%s",
+		url.QueryEscape(index)))
 
 	r, err := c.Do("DELETE", reqUrl, nil)
 	if err != nil {
@@ -374,21 +850,211 @@ func (c *Client) DeleteIndex(index string) error {
 	}
 }
 
-func (c *Client) Get(index string, docType string, id string) (*Response, error) {
-	reqUrl := fmt.Sprintf("http://%s/%s/%s/%s", c.Addr,
+// EnsureIndex creates the index with the default settings if it doesn't exist yet.
+func (c *Client) EnsureIndex(index string) error {
+	if c.c == nil {
+		return ErrDryRun
+	}
+
+	exists, err := c.c.IndexExists(index).Do(context.Background())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = c.c.CreateIndex(index).Do(context.Background())
+	return errors.Trace(err)
+}
+
+// AliasIndices returns the indices the alias points to, nothing if there is no such alias.
+func (c *Client) AliasIndices(alias string) ([]string, error) {
+	if c.c == nil {
+		return nil, ErrDryRun
+	}
+
+	res, err := c.c.Aliases().Alias(alias).Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return res.IndicesByAlias(alias), nil
+}
+
+// SwapAlias moves the alias from the old index to the new one in one atomic step.
+func (c *Client) SwapAlias(alias string, oldIndex string, newIndex string) error {
+	if c.c == nil {
+		return ErrDryRun
+	}
+
+	_, err := c.c.Alias().Remove(oldIndex, alias).Add(newIndex, alias).Do(context.Background())
+	return errors.Trace(err)
+}
+
+// Refresh makes the documents written to the indices visible to searches.
+func (c *Client) Refresh(indices ...string) error {
+	if c.c == nil {
+		return ErrDryRun
+	}
+
+	_, err := c.c.Refresh(indices...).Do(context.Background())
+	return errors.Trace(err)
+}
+
+// DeleteByQuery deletes the documents matching the query and returns how many, documents changed
+// meanwhile are left alone. The type is dropped for a typeless cluster.
+func (c *Client) DeleteByQuery(q *DeleteQuery) (int64, error) {
+	if c.c == nil {
+		return 0, ErrDryRun
+	}
+
+	s := c.c.DeleteByQuery(q.Index).Query(q.Query).ProceedOnVersionConflict()
+	if len(q.Type) > 0 && !c.version.Typeless() {
+		s.Type(q.Type)
+	}
+	if len(q.Routing) > 0 {
+		s.Routing(q.Routing)
+	}
+
+	res, err := s.Do(context.Background())
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.Deleted, nil
+}
+
+// Flush commits all requests queued in the bulk processor and waits for them.
+func (c *Client) Flush() error {
+	c.bulkLock.RLock()
+	defer c.bulkLock.RUnlock()
+
+	if c.BulkProcessor == nil {
+		return nil
+	}
+	return errors.Trace(c.BulkProcessor.Flush())
+}
+
+// Close flushes and stops the bulk processor.
+func (c *Client) Close() error {
+	c.bulkLock.Lock()
+	defer c.bulkLock.Unlock()
+
+	if c.BulkProcessor == nil {
+		return nil
+	}
+	err := c.BulkProcessor.Close()
+	c.BulkProcessor = nil
+	return errors.Trace(err)
+}
+
+// DocRef is a document to get with MultiGet, Routing is the parent ID of a child document.
+type DocRef struct {
+	Index   string
+	Type    string
+	ID      string
+	Routing string
+}
+
+// MultiGet gets all documents in one request, in the order of refs.
+// The Code of a missing document is http.StatusNotFound.
+func (c *Client) MultiGet(refs []DocRef) ([]*Response, error) {
+	if c.c == nil {
+		return nil, ErrDryRun
+	}
+
+	svc := c.c.Mget()
+	for _, ref := range refs {
+		item := elastic.NewMultiGetItem().Index(ref.Index).Id(ref.ID)
+		if len(ref.Type) > 0 {
+			item.Type(ref.Type)
+		}
+		if len(ref.Routing) > 0 {
+			item.Routing(ref.Routing)
+		}
+		svc.Add(item)
+	}
+
+	res, err := svc.Do(context.Background())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resps := make([]*Response, 0, len(res.Docs))
+	for _, doc := range res.Docs {
+		if doc.Error != nil {
+			return nil, errors.Errorf("get %s/%s err %s: %s", doc.Index, doc.Id, doc.Error.Type, doc.Error.Reason)
+		}
+
+		resp := &Response{Code: http.StatusOK}
+		resp.ID = doc.Id
+		resp.Index = doc.Index
+		resp.Type = doc.Type
+		resp.Found = doc.Found
+		if !doc.Found {
+			resp.Code = http.StatusNotFound
+		}
+		if doc.Version != nil {
+			resp.Version = int(*doc.Version)
+		}
+		if doc.Source != nil {
+			if err = json.Unmarshal(*doc.Source, &resp.Source); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		resps = append(resps, resp)
+	}
+
+	return resps, nil
+}
+
+// ScrollIDs calls fn with the ID of every document in the index.
+func (c *Client) ScrollIDs(index string, fn func(id string) error) error {
+	if c.c == nil {
+		return ErrDryRun
+	}
+
+	scroll := c.c.Scroll(index).FetchSource(false).Size(1000)
+	defer scroll.Clear(context.Background())
+
+	for {
+		res, err := scroll.Do(context.Background())
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, hit := range res.Hits.Hits {
+			if err = fn(hit.Id); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+}
+
+// docURL returns the URL of a document, typeless clusters have _doc instead of the type.
+func (c *Client) docURL(index string, docType string, id string) string {
+	if c.version.Typeless() || len(docType) == 0 {
+		docType = "_doc"
+	}
+	return c.url(fmt.Sprintf("/%s/%s/%s",
 		url.QueryEscape(index),
 		url.QueryEscape(docType),
-		url.QueryEscape(id))
+		url.QueryEscape(id)))
+}
+
+func (c *Client) Get(index string, docType string, id string) (*Response, error) {
+	reqUrl := c.docURL(index, docType, id)
 
 	return c.Do("GET", reqUrl, nil)
 }
 
 // Can use Update to create or update the data
 func (c *Client) Update(index string, docType string, id string, data map[string]interface{}) error {
-	reqUrl := fmt.Sprintf("http://%s/%s/%s/%s", c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqUrl := c.docURL(index, docType, id)
 
 	r, err := c.Do("PUT", reqUrl, data)
 	if err != nil {
@@ -403,10 +1069,7 @@ func (c *Client) Update(index string, docType string, id string, data map[string
 }
 
 func (c *Client) Exists(index string, docType string, id string) (bool, error) {
-	reqUrl := fmt.Sprintf("http://%s/%s/%s/%s", c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqUrl := c.docURL(index, docType, id)
 
 	r, err := c.Do("HEAD", reqUrl, nil)
 	if err != nil {
@@ -417,10 +1080,7 @@ func (c *Client) Exists(index string, docType string, id string) (bool, error) {
 }
 
 func (c *Client) Delete(index string, docType string, id string) error {
-	reqUrl := fmt.Sprintf("http://%s/%s/%s/%s", c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqUrl := c.docURL(index, docType, id)
 
 	r, err := c.Do("DELETE", reqUrl, nil)
 	if err != nil {
@@ -436,22 +1096,22 @@ func (c *Client) Delete(index string, docType string, id string) error {
 
 // only support parent in 'Bulk' related apis
 func (c *Client) Bulk(items []*BulkRequest) (*BulkResponse, error) {
-	reqUrl := fmt.Sprintf("http://%s/_bulk", c.Addr)
+	reqUrl := c.url("/_bulk")
 
 	return c.DoBulk(reqUrl, items)
 }
 
 func (c *Client) IndexBulk(index string, items []*BulkRequest) (*BulkResponse, error) {
-	reqUrl := fmt.Sprintf("http://%s/%s/_bulk", c.Addr,
-		url.QueryEscape(index))
+	reqUrl := c.url(fmt.Sprintf("/%s/_bulk",
+		url.QueryEscape(index)))
 
 	return c.DoBulk(reqUrl, items)
 }
 
 func (c *Client) IndexTypeBulk(index string, docType string, items []*BulkRequest) (*BulkResponse, error) {
-	reqUrl := fmt.Sprintf("http://%s/%s/%s/_bulk", c.Addr,
+	reqUrl := c.url(fmt.Sprintf("/%s/%s/_bulk",
 		url.QueryEscape(index),
-		url.QueryEscape(docType))
+		url.QueryEscape(docType)))
 
 	return c.DoBulk(reqUrl, items)
 }
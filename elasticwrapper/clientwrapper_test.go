@@ -1,10 +1,14 @@
 package elasticwrapper
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"strings"
 	"testing"
 
+	elastic "github.com/olivere/elastic"
 	. "github.com/pingcap/check"
 )
 
@@ -143,3 +147,231 @@ func (s *elasticTestSuite) TestParent(c *C) {
 	c.Assert(resp.Code, Equals, 200)
 	c.Assert(resp.Errors, Equals, false)
 }
+
+type bulkRequestTestSuite struct{}
+
+var _ = Suite(&bulkRequestTestSuite{})
+
+func testBulkSource(c *C, req *BulkRequest) []map[string]interface{} {
+	return testBulkSourceVersion(c, req, false)
+}
+
+func testBulkSourceVersion(c *C, req *BulkRequest, typeless bool) []map[string]interface{} {
+	bulkRequest, err := req.prepareBulkRequest(typeless)
+	c.Assert(err, IsNil)
+	lines, err := bulkRequest.Source()
+	c.Assert(err, IsNil)
+
+	source := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		c.Assert(json.Unmarshal([]byte(line), &source[i]), IsNil)
+	}
+	return source
+}
+
+func (s *bulkRequestTestSuite) TestPrepareBulkRequestActions(c *C) {
+	meta := map[string]interface{}{"_index": "river", "_type": "river", "_id": "1"}
+
+	req := &BulkRequest{Action: ActionIndex, Index: "river", Type: "river", ID: "1", HardCrud: true,
+		Data: makeTestData("abc", "hello world")}
+	source := testBulkSource(c, req)
+	c.Assert(source[0]["index"], DeepEquals, meta)
+	c.Assert(source[1]["name"], Equals, "abc")
+
+	req.Action = ActionCreate
+	source = testBulkSource(c, req)
+	c.Assert(source[0]["create"], DeepEquals, meta)
+
+	req.Action = ActionDelete
+	source = testBulkSource(c, req)
+	c.Assert(source, HasLen, 1)
+	c.Assert(source[0]["delete"], DeepEquals, meta)
+
+	req = &BulkRequest{Action: ActionUpdate, Index: "river", Type: "river", ID: "1", UpdateOnly: true,
+		Data: makeTestData("abc", "hello world")}
+	source = testBulkSource(c, req)
+	c.Assert(source[0]["update"], NotNil)
+	c.Assert(source[1]["doc"], NotNil)
+	c.Assert(source[1]["doc_as_upsert"], IsNil)
+
+	req.UpdateOnly = false
+	source = testBulkSource(c, req)
+	c.Assert(source[1]["doc_as_upsert"], Equals, true)
+
+	req = &BulkRequest{Action: ActionDelete, Index: "river", Type: "river", ID: "1", UpdateOnly: true,
+		Data: makeTestData("abc", "hello world")}
+	source = testBulkSource(c, req)
+	c.Assert(source[1]["script"], NotNil)
+	c.Assert(source[1]["upsert"], IsNil)
+}
+
+func (s *bulkRequestTestSuite) TestDryRun(c *C) {
+	var buf bytes.Buffer
+	client := NewClient(&ClientConfig{DryRun: &buf})
+
+	items := []*BulkRequest{
+		{Action: ActionIndex, Index: "river", Type: "river", ID: "1", HardCrud: true, Data: makeTestData("abc", "hello world")},
+		{Action: ActionUpdate, Index: "river", Type: "river", ID: "2", Data: makeTestData("def", "hello"),
+			DeleteFields: map[string]interface{}{"title": true}},
+	}
+	_, err := client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(client.Flush(), IsNil)
+
+	// index and the scripted update removing the deleted field
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 4)
+	c.Assert(strings.HasPrefix(lines[0], `{"index":`), IsTrue)
+	c.Assert(strings.HasPrefix(lines[2], `{"update":`), IsTrue)
+	c.Assert(strings.Contains(lines[3], "script"), IsTrue)
+
+	_, err = client.AliasIndices("river")
+	c.Assert(err, Equals, ErrDryRun)
+	c.Assert(client.Close(), IsNil)
+}
+
+func (s *bulkRequestTestSuite) TestDeleteFields(c *C) {
+	deleteFields := map[string]interface{}{"title": true, "content": true, "tags": true}
+
+	req := &BulkRequest{Action: ActionUpdate, Index: "river", Type: "river", ID: "1",
+		Data: map[string]interface{}{"name": "abc", "age": 3}, DeleteFields: deleteFields}
+	c.Assert(req.bulkableRequests(false), HasLen, 1)
+	source := testBulkSource(c, req)
+	c.Assert(source, HasLen, 2)
+	script := source[1]["script"].(map[string]interface{})
+	c.Assert(script["id"], Equals, ScriptID(ScriptUpdateSource))
+	c.Assert(script["params"], DeepEquals, map[string]interface{}{
+		"doc":    map[string]interface{}{"name": "abc", "age": float64(3)},
+		"remove": []interface{}{"content", "tags", "title"},
+	})
+	c.Assert(source[1]["upsert"], DeepEquals, map[string]interface{}{"name": "abc", "age": float64(3)})
+	c.Assert(source[1]["doc"], IsNil)
+
+	// only removals
+	req = &BulkRequest{Action: ActionUpdate, Index: "river", Type: "river", ID: "1", UpdateOnly: true,
+		Data: map[string]interface{}{}, DeleteFields: deleteFields}
+	source = testBulkSource(c, req)
+	c.Assert(source[1]["script"], NotNil)
+	c.Assert(source[1]["upsert"], IsNil)
+
+	// a soft delete removes the deleted fields with the others
+	req = &BulkRequest{Action: ActionDelete, Index: "river", Type: "river", ID: "1",
+		Data: map[string]interface{}{"name": true}, DeleteFields: deleteFields}
+	c.Assert(req.bulkableRequests(false), HasLen, 1)
+	source = testBulkSource(c, req)
+	script = source[1]["script"].(map[string]interface{})
+	c.Assert(script["params"], HasLen, 4)
+	c.Assert(req.Data, HasLen, 1)
+
+	// the whole document is replaced
+	req = &BulkRequest{Action: ActionIndex, Index: "river", Type: "river", ID: "1", HardCrud: true,
+		Data: map[string]interface{}{"name": "abc"}, DeleteFields: deleteFields}
+	c.Assert(req.bulkableRequests(false), HasLen, 1)
+
+	// a list update is followed by one removal
+	req = &BulkRequest{Action: ActionUpdate, Index: "river", Type: "river", ID: "1", ListRequest: true,
+		Data: map[string]interface{}{"tags": "a_b"}, DeleteFields: deleteFields}
+	c.Assert(req.bulkableRequests(false), HasLen, 2)
+}
+
+func (s *bulkRequestTestSuite) TestListPreparedTwice(c *C) {
+	data := map[string]interface{}{"tags": 7}
+	for _, action := range []string{ActionUpdate, ActionDelete} {
+		req := &BulkRequest{Action: action, Index: "users", Type: "user", ID: "1", ListRequest: true, ListKey: "tags",
+			Data: data}
+
+		// every target, retry and dual write copy prepares the request again
+		for i := 0; i < 3; i++ {
+			source := testBulkSource(c, req)
+			script := source[1]["script"].(map[string]interface{})
+			c.Assert(script["params"], DeepEquals, map[string]interface{}{"key": "tags", "tags": float64(7)})
+		}
+		c.Assert(data, DeepEquals, map[string]interface{}{"tags": 7})
+	}
+}
+
+func (s *bulkRequestTestSuite) TestJoinFieldPreparedTwice(c *C) {
+	data := map[string]interface{}{"title": "a"}
+	join := map[string]interface{}{"name": "reply", "parent": "7"}
+	for _, action := range []string{ActionIndex, ActionUpdate} {
+		req := &BulkRequest{Action: action, Index: "posts", ID: "1", Parent: "7", HardCrud: true,
+			JoinField: "join", JoinFieldName: "reply", Data: data}
+
+		// the targets prepare the request while the bulk workers still read its data
+		for i := 0; i < 2; i++ {
+			source := testBulkSourceVersion(c, req, true)
+			c.Assert(source[0][action].(map[string]interface{})["routing"], Equals, "7")
+			doc := source[1]
+			if action == ActionUpdate {
+				doc = doc["doc"].(map[string]interface{})
+			}
+			c.Assert(doc, DeepEquals, map[string]interface{}{"title": "a", "join": join})
+		}
+		c.Assert(data, DeepEquals, map[string]interface{}{"title": "a"})
+	}
+}
+
+func (s *bulkRequestTestSuite) TestDeleteByQuery(c *C) {
+	f := newFakeCluster(false)
+	defer f.Close()
+
+	client := NewClient(&ClientConfig{Addr: f.URL})
+	defer client.Close()
+
+	deleted, err := client.DeleteByQuery(&DeleteQuery{Index: "comments", Type: "comment", Routing: "7",
+		Query: elastic.NewParentIdQuery("comment", "7")})
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, int64(2))
+	c.Assert(f.deleteQuery, Matches, `/comments/comment/_delete_by_query\?.*routing=7.* \{"query":\{"parent_id":\{"id":"7","type":"comment"\}\}\}`)
+	c.Assert(f.deleteQuery, Matches, `.*conflicts=proceed.*`)
+
+	_, err = NewClient(&ClientConfig{DryRun: &bytes.Buffer{}}).DeleteByQuery(&DeleteQuery{Index: "comments"})
+	c.Assert(err, Equals, ErrDryRun)
+}
+
+func (s *bulkRequestTestSuite) TestTypeless(c *C) {
+	req := &BulkRequest{Action: ActionIndex, Index: "river", Type: "river", ID: "1", Parent: "2", HardCrud: true,
+		Data: makeTestData("abc", "hello world")}
+	source := testBulkSource(c, req)
+	c.Assert(source[0]["index"], DeepEquals, map[string]interface{}{"_index": "river", "_type": "river", "_id": "1", "parent": "2"})
+
+	source = testBulkSourceVersion(c, req, true)
+	c.Assert(source[0]["index"], DeepEquals, map[string]interface{}{"_index": "river", "_id": "1", "routing": "2"})
+
+	req.Action = ActionUpdate
+	req.HardCrud = false
+	source = testBulkSourceVersion(c, req, true)
+	c.Assert(source[0]["update"], DeepEquals, map[string]interface{}{"_index": "river", "_id": "1", "routing": "2", "retry_on_conflict": float64(2)})
+
+	req.Action = ActionDelete
+	req.HardCrud = true
+	source = testBulkSourceVersion(c, req, true)
+	c.Assert(source[0]["delete"], DeepEquals, map[string]interface{}{"_index": "river", "_id": "1", "routing": "2"})
+}
+
+func (s *bulkRequestTestSuite) TestVersion(c *C) {
+	v, err := NewVersion("6.8.23", "")
+	c.Assert(err, IsNil)
+	c.Assert(v.Typeless(), IsFalse)
+
+	v, err = NewVersion("7.17.0", "")
+	c.Assert(err, IsNil)
+	c.Assert(v.Typeless(), IsTrue)
+	c.Assert(v.RejectsTypes(), IsFalse)
+
+	v, err = NewVersion("8.11.1", "")
+	c.Assert(err, IsNil)
+	c.Assert(v.RejectsTypes(), IsTrue)
+
+	v, err = NewVersion("1.3.0", DistributionOpenSearch)
+	c.Assert(err, IsNil)
+	c.Assert(v.Typeless(), IsTrue)
+	c.Assert(v.RejectsTypes(), IsFalse)
+
+	v, err = NewVersion("2.11.0", DistributionOpenSearch)
+	c.Assert(err, IsNil)
+	c.Assert(v.RejectsTypes(), IsTrue)
+
+	_, err = NewVersion("x", "")
+	c.Assert(err, NotNil)
+}
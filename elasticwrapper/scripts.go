@@ -0,0 +1,99 @@
+package elasticwrapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/juju/errors"
+	elastic "github.com/olivere/elastic"
+)
+
+// ScriptsVersion is the suffix of the stored script ids, it goes up whenever a script source changes,
+// so rivers still running the old sources keep their own scripts.
+const ScriptsVersion = 2
+
+// Names of the stored scripts
+const (
+	// adds params[params.key] to the list field params.key, once
+	ScriptAddToList = "add_to_list"
+	// removes params[params.key] from the list field params.key
+	ScriptRemoveFromList = "remove_from_list"
+	// removes every field named in params
+	ScriptRemoveFromSource = "remove_from_source"
+	// sets the fields of params.doc and removes those of params.remove
+	ScriptUpdateSource = "update_source"
+	// lowers the fields to params.min, raises them to params.max,
+	// then sets params.set and removes params.remove
+	ScriptAggregate = "aggregate"
+)
+
+var storedScripts = map[string]string{
+	ScriptAddToList: "def v = params[params.key]; def list = ctx._source[params.key]; " +
+		"if (list == null) { ctx._source[params.key] = [v] } " +
+		"else if (list instanceof List) { if (!list.contains(v)) { list.add(v) } } " +
+		"else if (list != v) { ctx._source[params.key] = [list, v] }",
+	ScriptRemoveFromList: "def v = params[params.key]; def list = ctx._source[params.key]; " +
+		"if (list instanceof List) { list.removeIf(e -> e == v) } " +
+		"else if (list == v) { ctx._source.remove(params.key) }",
+	ScriptRemoveFromSource: "for (field in params.keySet()) { ctx._source.remove(field) }",
+	ScriptUpdateSource: "for (entry in params.doc.entrySet()) { ctx._source[entry.getKey()] = entry.getValue() } " +
+		"for (field in params.remove) { ctx._source.remove(field) }",
+	ScriptAggregate: "boolean less(def a, def b) { " +
+		"if (a instanceof Number && b instanceof Number) { return a.doubleValue() < b.doubleValue() } return a.compareTo(b) < 0 } " +
+		"for (entry in params.min.entrySet()) { def v = ctx._source[entry.getKey()]; " +
+		"if (v == null || less(entry.getValue(), v)) { ctx._source[entry.getKey()] = entry.getValue() } } " +
+		"for (entry in params.max.entrySet()) { def v = ctx._source[entry.getKey()]; " +
+		"if (v == null || less(v, entry.getValue())) { ctx._source[entry.getKey()] = entry.getValue() } } " +
+		"for (entry in params.set.entrySet()) { ctx._source[entry.getKey()] = entry.getValue() } " +
+		"for (field in params.remove) { ctx._source.remove(field) }",
+}
+
+// ScriptID returns the id of the stored script of the current ScriptsVersion.
+func ScriptID(name string) string {
+	return fmt.Sprintf("%s_v%d", name, ScriptsVersion)
+}
+
+// storedScript is a stored script like Elasticsearch returns it.
+type storedScript struct {
+	Lang   string `json:"lang"`
+	Source string `json:"source"`
+}
+
+// PutScripts installs the stored scripts the bulk requests use, or replaces them if their source differs.
+// Elasticsearch compiles a script when it is stored, a script which doesn't compile fails here instead of every update.
+func (c *Client) PutScripts() error {
+	return c.putScripts(storedScripts)
+}
+
+func (c *Client) putScripts(scripts map[string]string) error {
+	if c.c == nil {
+		return ErrDryRun
+	}
+
+	for name, source := range scripts {
+		id := ScriptID(name)
+
+		res, err := c.c.GetScript().Id(id).Do(context.Background())
+		if err != nil && !elastic.IsNotFound(err) {
+			return errors.Annotatef(err, "get script %s", id)
+		}
+		if err == nil && res.Found {
+			var script storedScript
+			if err = json.Unmarshal(res.Script, &script); err != nil {
+				return errors.Annotatef(err, "script %s", id)
+			}
+			if script.Lang == "painless" && script.Source == source {
+				continue
+			}
+		}
+
+		body := map[string]interface{}{
+			"script": storedScript{Lang: "painless", Source: source},
+		}
+		if _, err = c.c.PutScript().Id(id).BodyJson(body).Do(context.Background()); err != nil {
+			return errors.Annotatef(err, "put script %s", id)
+		}
+	}
+	return nil
+}
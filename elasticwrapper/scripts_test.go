@@ -0,0 +1,39 @@
+package elasticwrapper
+
+import (
+	"strings"
+
+	. "github.com/pingcap/check"
+)
+
+type scriptsTestSuite struct{}
+
+var _ = Suite(&scriptsTestSuite{})
+
+func (s *scriptsTestSuite) TestPutScripts(c *C) {
+	f := newFakeCluster(false)
+	defer f.Close()
+
+	client := NewClient(&ClientConfig{Addr: f.URL})
+	defer client.Close()
+
+	c.Assert(client.PutScripts(), IsNil)
+	c.Assert(f.scripts, HasLen, len(storedScripts))
+	c.Assert(f.scripts["update_source_v2"], Matches, `.*"lang":"painless".*`)
+	c.Assert(f.puts, Equals, len(storedScripts))
+
+	// the scripts are only replaced when their source changed
+	c.Assert(client.PutScripts(), IsNil)
+	c.Assert(f.puts, Equals, len(storedScripts))
+
+	f.scripts[ScriptID(ScriptAddToList)] = `{"script":{"lang":"painless","source":"ctx._source.old = true"}}`
+	c.Assert(client.PutScripts(), IsNil)
+	c.Assert(f.puts, Equals, len(storedScripts)+1)
+
+	err := client.putScripts(map[string]string{"bad": "broken("})
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "put script bad_v2"), IsTrue)
+
+	dryRun := NewClient(&ClientConfig{DryRun: &strings.Builder{}})
+	c.Assert(dryRun.PutScripts(), Equals, ErrDryRun)
+}
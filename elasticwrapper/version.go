@@ -0,0 +1,87 @@
+package elasticwrapper
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	elastic "github.com/olivere/elastic"
+)
+
+// Distributions
+const (
+	DistributionElasticsearch = "elasticsearch"
+	DistributionOpenSearch    = "opensearch"
+)
+
+// Version is the version of the cluster the client talks to.
+type Version struct {
+	Number       string
+	Major        int
+	Distribution string
+}
+
+// NewVersion parses a version number like 7.17.0, an empty distribution is Elasticsearch.
+func NewVersion(number string, distribution string) (Version, error) {
+	v := Version{Number: number, Distribution: distribution}
+	if len(v.Distribution) == 0 {
+		v.Distribution = DistributionElasticsearch
+	}
+	if v.Distribution != DistributionElasticsearch && v.Distribution != DistributionOpenSearch {
+		return v, errors.Errorf("invalid distribution %s", distribution)
+	}
+
+	var err error
+	if v.Major, err = strconv.Atoi(strings.SplitN(number, ".", 2)[0]); err != nil {
+		return v, errors.Errorf("invalid version %s", number)
+	}
+	return v, nil
+}
+
+// Typeless reports whether the cluster has no document types anymore,
+// requests have no type and the parent of a document is only its routing.
+func (v Version) Typeless() bool {
+	return v.Distribution == DistributionOpenSearch || v.Major >= 7
+}
+
+// RejectsTypes reports whether typed requests fail, instead of being deprecated.
+func (v Version) RejectsTypes() bool {
+	if v.Distribution == DistributionOpenSearch {
+		return v.Major >= 2
+	}
+	return v.Major >= 8
+}
+
+func (v Version) String() string {
+	return v.Distribution + " " + v.Number
+}
+
+// detectVersion reads the version of the cluster from its root endpoint.
+func (c *Client) detectVersion() (Version, error) {
+	res, err := c.c.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/",
+	})
+	if err != nil {
+		return Version{}, errors.Trace(err)
+	}
+
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err = json.Unmarshal(res.Body, &info); err != nil {
+		return Version{}, errors.Trace(err)
+	}
+
+	return NewVersion(info.Version.Number, info.Version.Distribution)
+}
+
+// Version returns the version of the cluster, detected when the client was created.
+func (c *Client) Version() Version {
+	return c.version
+}
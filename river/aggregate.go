@@ -0,0 +1,439 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/canal"
+	"github.com/jrots/go-mysql/schema"
+)
+
+// Functions of an aggregate
+const (
+	AggregateCount = "count"
+	AggregateSum   = "sum"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+)
+
+// Aggregate is a field of the document computed from the rows pointing to it.
+// count needs no column, sum, min and max the column they are computed from.
+type Aggregate struct {
+	Field  string `toml:"field"`
+	Func   string `toml:"func"`
+	Column string `toml:"column"`
+}
+
+// IsAggregate reports whether the rule keeps aggregates of its rows on another document.
+func (r *Rule) IsAggregate() bool {
+	return len(r.Aggregates) > 0
+}
+
+func (r *Rule) prepareAggregates() error {
+	if !r.IsAggregate() {
+		return nil
+	}
+
+	switch {
+	case len(r.ID) == 0:
+		return errors.Errorf("aggregate rule %s.%s needs the id columns of the aggregated document", r.Schema, r.Table)
+	case len(r.ConcatField) > 0 || r.IsLink():
+		return errors.Errorf("aggregate rule %s.%s can not have a concatField or link_field", r.Schema, r.Table)
+	case r.WritePolicy != WritePolicyUpsert && r.WritePolicy != WritePolicyUpdateOnly:
+		return errors.Errorf("aggregate rule %s.%s can not have write_policy %s", r.Schema, r.Table, r.WritePolicy)
+	}
+
+	fields := make(map[string]struct{}, len(r.Aggregates))
+	for _, agg := range r.Aggregates {
+		if len(agg.Field) == 0 {
+			return errors.Errorf("aggregate of %s.%s without field", r.Schema, r.Table)
+		}
+		if _, ok := fields[agg.Field]; ok {
+			return errors.Errorf("duplicate aggregate field %s of %s.%s", agg.Field, r.Schema, r.Table)
+		}
+		fields[agg.Field] = struct{}{}
+
+		switch agg.Func {
+		case AggregateCount:
+		case AggregateSum, AggregateMin, AggregateMax:
+			if len(agg.Column) == 0 {
+				return errors.Errorf("aggregate %s of %s.%s needs a column", agg.Field, r.Schema, r.Table)
+			}
+		default:
+			return errors.Errorf("invalid aggregate func %s of %s.%s", agg.Func, r.Schema, r.Table)
+		}
+	}
+	return nil
+}
+
+// aggregateChange is the change of the aggregates of one document, the params of the aggregate script.
+type aggregateChange struct {
+	min    map[string]interface{}
+	max    map[string]interface{}
+	set    map[string]interface{}
+	remove []string
+}
+
+func newAggregateChange() *aggregateChange {
+	return &aggregateChange{
+		min: make(map[string]interface{}),
+		max: make(map[string]interface{}),
+		set: make(map[string]interface{}),
+		// the script iterates it, it must not be null
+		remove: []string{},
+	}
+}
+
+func (a *aggregateChange) empty() bool {
+	return len(a.min) == 0 && len(a.max) == 0 && len(a.set) == 0 && len(a.remove) == 0
+}
+
+// docChange is the change of the document the ids of the row point to.
+type docChange struct {
+	row    []interface{}
+	change *aggregateChange
+	// the aggregates read again from MySQL
+	read []*Aggregate
+}
+
+// makeAggregateRequest turns the rows into changes of the aggregates of the documents they point to.
+// An insert adds the row, a delete takes it away and an update moving the row to another document does both.
+// Counts and sums are read again from MySQL and set, min and max are lowered or raised by an added row and read
+// again when a row is taken away or its value changes. Every change sets what MySQL has or only moves towards it,
+// a replayed binlog writes the same aggregates again.
+func (r *River) makeAggregateRequest(rule *Rule, action string, rows [][]interface{}) ([]*elasticwrapper.BulkRequest, error) {
+	step := 1
+	if action == canal.UpdateAction {
+		if len(rows)%2 != 0 {
+			return nil, errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(rows))
+		}
+		step = 2
+	}
+
+	reqs := make([]*elasticwrapper.BulkRequest, 0, len(rows))
+	for i := 0; i < len(rows); i += step {
+		var changes []docChange
+		var err error
+		switch action {
+		case canal.InsertAction:
+			r.st.InsertNum.Add(1)
+			changes, err = r.aggregateRow(rule, nil, rows[i])
+		case canal.DeleteAction:
+			r.st.DeleteNum.Add(1)
+			changes, err = r.aggregateRow(rule, rows[i], nil)
+		case canal.UpdateAction:
+			r.st.UpdateNum.Add(1)
+			changes, err = r.aggregateRow(rule, rows[i], rows[i+1])
+		default:
+			err = errors.Errorf("invalid rows action %s", action)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for _, change := range changes {
+			if err = r.readAggregates(rule, change); err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			req, err := r.newBulkRequest(rule, change.row)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			c := change.change
+			req.Action = elasticwrapper.ActionUpdate
+			req.HardCrud = false
+			req.Aggregate = true
+			req.Data = map[string]interface{}{
+				"min":    c.min,
+				"max":    c.max,
+				"set":    c.set,
+				"remove": c.remove,
+			}
+			reqs = append(reqs, req)
+		}
+	}
+
+	return reqs, nil
+}
+
+// aggregateRow returns the changes of the documents before, the removed row, and after, the added row,
+// point to. An update within the same document is one change, a row with a NULL id points to no document.
+// The aggregates to read again from MySQL are left in the changes.
+func (r *River) aggregateRow(rule *Rule, before []interface{}, after []interface{}) ([]docChange, error) {
+	var beforeID, afterID string
+	var err error
+	if before != nil {
+		if beforeID, err = r.aggregateDocID(rule, before); err != nil {
+			return nil, errors.Trace(err)
+		} else if len(beforeID) == 0 {
+			before = nil
+		}
+	}
+	if after != nil {
+		if afterID, err = r.aggregateDocID(rule, after); err != nil {
+			return nil, errors.Trace(err)
+		} else if len(afterID) == 0 {
+			after = nil
+		}
+	}
+
+	var changes []docChange
+	if before != nil && after != nil && beforeID == afterID {
+		change := docChange{row: after, change: newAggregateChange()}
+		for _, agg := range rule.Aggregates {
+			if agg.Func == AggregateCount {
+				continue
+			}
+			old, err := r.aggregateValue(rule, agg, before)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			v, err := r.aggregateValue(rule, agg, after)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if !reflect.DeepEqual(old, v) {
+				change.read = append(change.read, agg)
+			}
+		}
+		if len(change.read) > 0 {
+			changes = append(changes, change)
+		}
+		return changes, nil
+	}
+
+	if before != nil {
+		// every aggregate may have lost its value
+		changes = append(changes, docChange{row: before, change: newAggregateChange(), read: rule.Aggregates})
+	}
+
+	if after != nil {
+		change := docChange{row: after, change: newAggregateChange()}
+		for _, agg := range rule.Aggregates {
+			if agg.Func == AggregateCount || agg.Func == AggregateSum {
+				change.read = append(change.read, agg)
+				continue
+			}
+			v, err := r.aggregateValue(rule, agg, after)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if v == nil {
+				continue
+			}
+			if agg.Func == AggregateMin {
+				change.change.min[agg.Field] = v
+			} else {
+				change.change.max[agg.Field] = v
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// readAggregates reads the aggregates of the change from MySQL, the counts and sums in one query.
+func (r *River) readAggregates(rule *Rule, change docChange) error {
+	var totals []*Aggregate
+	for _, agg := range change.read {
+		switch agg.Func {
+		case AggregateCount, AggregateSum:
+			totals = append(totals, agg)
+		default:
+			if err := r.readExtreme(rule, agg, change.row, change.change); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	if len(totals) == 0 {
+		return nil
+	}
+
+	res, err := r.canal.Execute(totalsQuery(rule, totals, change.row))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if res.RowNumber() == 0 {
+		return errors.Errorf("no aggregates of %s.%s read", rule.Schema, rule.Table)
+	}
+	return errors.Trace(setTotals(rule, totals, res.Values[0], change.change))
+}
+
+// aggregateDocID returns the id of the document the row points to, with its parent,
+// empty if an id column is NULL.
+func (r *River) aggregateDocID(rule *Rule, row []interface{}) (string, error) {
+	for _, column := range rule.ID {
+		if i := rule.TableInfo.FindColumn(column); i >= 0 && i < len(row) && row[i] == nil {
+			return "", nil
+		}
+	}
+
+	id, err := r.getDocID(rule, row)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(rule.Parent) > 0 {
+		parent, err := r.getParentID(rule, row, rule.Parent)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		id = parent + "/" + id
+	}
+	return id, nil
+}
+
+// aggregateValue returns the value of the column of the aggregate in the row, nil if it is NULL.
+func (r *River) aggregateValue(rule *Rule, agg *Aggregate, row []interface{}) (interface{}, error) {
+	i := rule.TableInfo.FindColumn(agg.Column)
+	if i < 0 || i >= len(row) {
+		return nil, errors.Errorf("aggregate column %s not found in %s.%s", agg.Column, rule.Schema, rule.Table)
+	}
+	return r.makeReqColumnData(&rule.TableInfo.Columns[i], row[i]), nil
+}
+
+// setTotals sets the counts and sums read by totalsQuery in the change. A sum of no values is NULL,
+// its field is removed.
+func setTotals(rule *Rule, totals []*Aggregate, values []interface{}, c *aggregateChange) error {
+	if len(values) != len(totals) {
+		return errors.Errorf("read %d aggregates of %s.%s, expected %d", len(values), rule.Schema, rule.Table, len(totals))
+	}
+
+	for i, agg := range totals {
+		if values[i] == nil {
+			c.remove = append(c.remove, agg.Field)
+			continue
+		}
+
+		n, isInt, err := aggregateNumber(values[i])
+		if err != nil {
+			return errors.Annotatef(err, "aggregate %s", agg.Field)
+		}
+		if agg.Func == AggregateSum {
+			// MySQL sums integers as DECIMAL
+			isInt = rule.TableInfo.Columns[rule.TableInfo.FindColumn(agg.Column)].Type == schema.TYPE_NUMBER
+		}
+		if isInt {
+			c.set[agg.Field] = int64(n)
+		} else {
+			c.set[agg.Field] = n
+		}
+	}
+	return nil
+}
+
+// aggregateNumber returns the number of a column value, and whether it is an integer.
+func aggregateNumber(v interface{}) (float64, bool, error) {
+	if v == nil {
+		return 0, true, nil
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true, nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), false, nil
+	case reflect.String:
+		f, err := strconv.ParseFloat(value.String(), 64)
+		return f, false, errors.Trace(err)
+	case reflect.Slice:
+		if b, ok := v.([]byte); ok {
+			f, err := strconv.ParseFloat(string(b), 64)
+			return f, false, errors.Trace(err)
+		}
+	}
+	return 0, false, errors.Errorf("%v is no number", v)
+}
+
+// readExtreme reads the min or max of the aggregate column of the rows pointing to the same document
+// as row from MySQL and sets it in the change, or removes the field if there is none.
+// MySQL may be ahead of the binlog, the later changes only lower or raise the value further.
+func (r *River) readExtreme(rule *Rule, agg *Aggregate, row []interface{}, c *aggregateChange) error {
+	res, err := r.canal.Execute(extremeQuery(rule, agg, row))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if res.RowNumber() == 0 {
+		c.remove = append(c.remove, agg.Field)
+		return nil
+	}
+
+	values := snapshotRow(rule.TableInfo, res.Values[0])
+	i := rule.TableInfo.FindColumn(agg.Column)
+	c.set[agg.Field] = r.makeReqColumnData(&rule.TableInfo.Columns[i], values[i])
+	return nil
+}
+
+// extremeQuery returns the query of the row with the min or max of the aggregate column
+// of the rows with the same id columns as row.
+func extremeQuery(rule *Rule, agg *Aggregate, row []interface{}) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("SELECT ")
+	for i, c := range rule.TableInfo.Columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(quoteName(c.Name))
+	}
+	buf.WriteString(" FROM ")
+	buf.WriteString(quoteTable(rule))
+	writeAggregateWhere(&buf, rule, row)
+
+	order := "ASC"
+	if agg.Func == AggregateMax {
+		order = "DESC"
+	}
+	buf.WriteString(fmt.Sprintf(" AND %s IS NOT NULL ORDER BY %s %s LIMIT 1",
+		quoteName(agg.Column), quoteName(agg.Column), order))
+	return buf.String()
+}
+
+// totalsQuery returns the query of the counts and sums of the rows with the same id columns as row.
+func totalsQuery(rule *Rule, totals []*Aggregate, row []interface{}) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("SELECT ")
+	for i, agg := range totals {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		if agg.Func == AggregateCount {
+			buf.WriteString("COUNT(*)")
+		} else {
+			buf.WriteString(fmt.Sprintf("SUM(%s)", quoteName(agg.Column)))
+		}
+	}
+	buf.WriteString(" FROM ")
+	buf.WriteString(quoteTable(rule))
+	writeAggregateWhere(&buf, rule, row)
+	return buf.String()
+}
+
+// writeAggregateWhere writes the condition of the rows with the same id columns, and parent, as row.
+func writeAggregateWhere(buf *bytes.Buffer, rule *Rule, row []interface{}) {
+	columns := append([]string{}, rule.ID...)
+	if len(rule.Parent) > 0 {
+		columns = append(columns, rule.Parent)
+	}
+	buf.WriteString(" WHERE ")
+	for n, column := range columns {
+		if n > 0 {
+			buf.WriteString(" AND ")
+		}
+		if i := rule.TableInfo.FindColumn(column); i >= 0 && i < len(row) && row[i] != nil {
+			buf.WriteString(fmt.Sprintf("%s = %s", quoteName(column), quoteValue(row[i])))
+		} else {
+			buf.WriteString(fmt.Sprintf("%s IS NULL", quoteName(column)))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+)
+
+type aggregateTestSuite struct{}
+
+var _ = Suite(&aggregateTestSuite{})
+
+func (s *aggregateTestSuite) testRule(c *C, aggregates ...*Aggregate) *Rule {
+	columns := []string{"id int(11)", "post_id int(11)", "votes int(11)", "created_at datetime"}
+	return newTestRule(c, "comments", columns, func(rule *Rule) {
+		rule.Index = "posts"
+		rule.ID = []string{"post_id"}
+		rule.Aggregates = aggregates
+	})
+}
+
+func (s *aggregateTestSuite) TestPrepare(c *C) {
+	rule := s.testRule(c, &Aggregate{Field: "comment_count", Func: AggregateCount})
+	c.Assert(rule.IsAggregate(), IsTrue)
+
+	rule.Aggregates = append(rule.Aggregates, &Aggregate{Field: "votes", Func: AggregateSum})
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.Aggregates[1].Column = "votes"
+	c.Assert(rule.prepare(), IsNil)
+
+	rule.Aggregates[1].Func = "avg"
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.Aggregates[1].Func = AggregateSum
+	rule.WritePolicy = WritePolicyHard
+	c.Assert(rule.prepare(), NotNil)
+}
+
+func (s *aggregateTestSuite) TestRequests(c *C) {
+	rule := s.testRule(c, &Aggregate{Field: "last_comment_at", Func: AggregateMax, Column: "created_at"})
+	r := &River{st: &stat{}}
+
+	// an added row only raises the max, nothing is read from MySQL
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{
+		{int64(1), int64(10), int64(3), "2020-01-02 10:00:00"},
+		{int64(2), nil, int64(1), "2020-01-02 11:00:00"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].ID, Equals, "10")
+	c.Assert(reqs[0].Index, Equals, "posts")
+	c.Assert(reqs[0].Aggregate, IsTrue)
+	c.Assert(reqs[0].Data["max"], DeepEquals, map[string]interface{}{"last_comment_at": "2020-01-02 10:00:00"})
+	c.Assert(reqs[0].Data["set"], DeepEquals, map[string]interface{}{})
+
+	lines, err := reqs[0].Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines[1], Matches, `.*"id":"aggregate_v2".*"scripted_upsert":true.*`)
+
+	// nothing aggregated changed
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{
+		{int64(1), int64(10), int64(3), "2020-01-02 10:00:00"},
+		{int64(4), int64(10), int64(3), "2020-01-02 10:00:00"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 0)
+}
+
+func (s *aggregateTestSuite) TestRead(c *C) {
+	rule := s.testRule(c,
+		&Aggregate{Field: "comment_count", Func: AggregateCount},
+		&Aggregate{Field: "votes", Func: AggregateSum, Column: "votes"},
+		&Aggregate{Field: "last_comment_at", Func: AggregateMax, Column: "created_at"})
+	r := &River{st: &stat{}}
+	row := []interface{}{int64(1), int64(10), int64(3), "2020-01-02 10:00:00"}
+
+	changes, err := r.aggregateRow(rule, nil, row)
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 1)
+	c.Assert(changes[0].read, DeepEquals, rule.Aggregates[:2])
+	c.Assert(changes[0].change.max, DeepEquals, map[string]interface{}{"last_comment_at": "2020-01-02 10:00:00"})
+
+	// votes changed within the same post
+	changes, err = r.aggregateRow(rule, row, []interface{}{int64(1), int64(10), int64(5), "2020-01-02 10:00:00"})
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 1)
+	c.Assert(changes[0].read, DeepEquals, rule.Aggregates[1:2])
+
+	// moved to another post, both are read again
+	changes, err = r.aggregateRow(rule, row, []interface{}{int64(1), int64(11), int64(3), "2020-01-02 10:00:00"})
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 2)
+	c.Assert(changes[0].row[1], Equals, int64(10))
+	c.Assert(changes[0].read, DeepEquals, rule.Aggregates)
+	c.Assert(changes[1].row[1], Equals, int64(11))
+	c.Assert(changes[1].read, DeepEquals, rule.Aggregates[:2])
+
+	// a NULL id points to no post
+	changes, err = r.aggregateRow(rule, []interface{}{int64(1), nil, int64(3), nil}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 0)
+}
+
+func (s *aggregateTestSuite) TestTotals(c *C) {
+	rule := s.testRule(c,
+		&Aggregate{Field: "comment_count", Func: AggregateCount},
+		&Aggregate{Field: "votes", Func: AggregateSum, Column: "votes"})
+
+	c.Assert(totalsQuery(rule, rule.Aggregates, []interface{}{int64(1), int64(10), int64(3), nil}), Equals,
+		"SELECT COUNT(*), SUM(`votes`) FROM `test`.`comments` WHERE `post_id` = 10")
+
+	// the same values set however often they are read
+	for i := 0; i < 2; i++ {
+		change := newAggregateChange()
+		c.Assert(setTotals(rule, rule.Aggregates, []interface{}{int64(2), []byte("8")}, change), IsNil)
+		c.Assert(change.set, DeepEquals, map[string]interface{}{"comment_count": int64(2), "votes": int64(8)})
+		c.Assert(change.remove, HasLen, 0)
+	}
+
+	// no rows left
+	change := newAggregateChange()
+	c.Assert(setTotals(rule, rule.Aggregates, []interface{}{int64(0), nil}, change), IsNil)
+	c.Assert(change.set, DeepEquals, map[string]interface{}{"comment_count": int64(0)})
+	c.Assert(change.remove, DeepEquals, []string{"votes"})
+
+	c.Assert(setTotals(rule, rule.Aggregates, []interface{}{int64(0)}, change), NotNil)
+}
+
+func (s *aggregateTestSuite) TestExtremeQuery(c *C) {
+	rule := s.testRule(c, &Aggregate{Field: "last_comment_at", Func: AggregateMax, Column: "created_at"})
+
+	c.Assert(extremeQuery(rule, rule.Aggregates[0], []interface{}{int64(1), int64(10), int64(3), nil}), Equals,
+		"SELECT `id`, `post_id`, `votes`, `created_at` FROM `test`.`comments` WHERE `post_id` = 10 AND "+
+			"`created_at` IS NOT NULL ORDER BY `created_at` DESC LIMIT 1")
+}
@@ -0,0 +1,123 @@
+package river
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/canal"
+)
+
+// Fields of an audit document
+const (
+	auditFieldAction     = "action"
+	auditFieldSchema     = "schema"
+	auditFieldTable      = "table"
+	auditFieldIndex      = "index"
+	auditFieldDocID      = "doc_id"
+	auditFieldBefore     = "before"
+	auditFieldAfter      = "after"
+	auditFieldChanged    = "changed"
+	auditFieldBinlogFile = "binlog_file"
+	auditFieldBinlogPos  = "binlog_pos"
+	auditFieldTimestamp  = "timestamp"
+	auditFieldGTID       = "gtid"
+)
+
+// makeAuditRequest makes one audit document for every row change in the binlog rows event.
+// The document id is built from the binlog position of the event and the row offset in it,
+// so replaying the same binlog rewrites the same documents instead of adding new ones.
+func (r *River) makeAuditRequest(rule *Rule, e *canal.RowsEvent) ([]*elasticwrapper.BulkRequest, error) {
+	step := 1
+	if e.Action == canal.UpdateAction {
+		if len(e.Rows)%2 != 0 {
+			return nil, errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(e.Rows))
+		}
+		step = 2
+	} else if e.Action != canal.InsertAction && e.Action != canal.DeleteAction {
+		return nil, errors.Errorf("invalid rows action %s", e.Action)
+	}
+
+	reqs := make([]*elasticwrapper.BulkRequest, 0, len(e.Rows)/step)
+
+	for i := 0; i < len(e.Rows); i += step {
+		id, err := r.getDocID(rule, e.Rows[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(rule.IdPrefix) > 0 {
+			id = rule.IdPrefix + ":" + id
+		}
+
+		var before, after map[string]interface{}
+		switch e.Action {
+		case canal.InsertAction:
+			after = r.makeAuditImage(rule, e.Rows[i])
+		case canal.DeleteAction:
+			before = r.makeAuditImage(rule, e.Rows[i])
+		case canal.UpdateAction:
+			before = r.makeAuditImage(rule, e.Rows[i])
+			after = r.makeAuditImage(rule, e.Rows[i+1])
+		}
+
+		data := map[string]interface{}{
+			auditFieldAction:     e.Action,
+			auditFieldSchema:     rule.Schema,
+			auditFieldTable:      rule.Table,
+			auditFieldIndex:      rule.Index,
+			auditFieldDocID:      id,
+			auditFieldChanged:    changedFields(before, after),
+			auditFieldBinlogFile: e.Position.Name,
+			auditFieldBinlogPos:  e.Position.Pos,
+			auditFieldTimestamp:  time.Unix(int64(e.Header.Timestamp), 0).UTC().Format(time.RFC3339),
+		}
+		if before != nil {
+			data[auditFieldBefore] = before
+		}
+		if after != nil {
+			data[auditFieldAfter] = after
+		}
+		if len(e.GTID) > 0 {
+			data[auditFieldGTID] = e.GTID
+		}
+
+		reqs = append(reqs, &elasticwrapper.BulkRequest{
+			Action:   elasticwrapper.ActionIndex,
+			Index:    rule.AuditIndex,
+			Type:     rule.AuditType,
+			ID:       fmt.Sprintf("%s:%d:%d", e.Position.Name, e.Position.Pos, i/step),
+			HardCrud: true,
+			Sink:     rule.Sink,
+			Data:     data,
+		})
+	}
+
+	return reqs, nil
+}
+
+// makeAuditImage returns the row as it would be synced, after filtering and field mapping.
+func (r *River) makeAuditImage(rule *Rule, values []interface{}) map[string]interface{} {
+	req := new(elasticwrapper.BulkRequest)
+	r.makeInsertReqData(req, rule, values)
+	return req.Data
+}
+
+// changedFields returns the sorted names of the fields which differ between both images.
+func changedFields(before map[string]interface{}, after map[string]interface{}) []string {
+	changed := make([]string, 0, len(after))
+	for k, v := range after {
+		if old, ok := before[k]; !ok || !reflect.DeepEqual(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
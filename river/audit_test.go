@@ -0,0 +1,132 @@
+package river
+
+import (
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/canal"
+	"github.com/jrots/go-mysql/mysql"
+	"github.com/jrots/go-mysql/replication"
+	. "github.com/pingcap/check"
+	"golang.org/x/net/context"
+)
+
+type auditTestSuite struct{}
+
+var _ = Suite(&auditTestSuite{})
+
+func (s *auditTestSuite) testRule(c *C) *Rule {
+	return newTestRule(c, "users", []string{"id int(11)", "name varchar(255)"}, func(rule *Rule) {
+		rule.IdPrefix = "u"
+		rule.AuditIndex = "users_audit"
+	})
+}
+
+func (s *auditTestSuite) testEvent(action string, rows ...[]interface{}) *canal.RowsEvent {
+	return &canal.RowsEvent{
+		Action:   action,
+		Rows:     rows,
+		Header:   &replication.EventHeader{Timestamp: 1500000000},
+		Position: mysql.Position{Name: "mysql-bin.000003", Pos: 1234},
+	}
+}
+
+func (s *auditTestSuite) TestChangedFields(c *C) {
+	before := map[string]interface{}{"id": 1, "title": "first", "tags": []string{"a"}, "gone": "x"}
+	after := map[string]interface{}{"id": 1, "title": "second", "tags": []string{"a"}, "new": "y"}
+
+	c.Assert(changedFields(before, after), DeepEquals, []string{"gone", "new", "title"})
+	c.Assert(changedFields(nil, after), DeepEquals, []string{"id", "new", "tags", "title"})
+	c.Assert(changedFields(before, nil), DeepEquals, []string{"gone", "id", "tags", "title"})
+}
+
+func (s *auditTestSuite) TestUpdate(c *C) {
+	rule := s.testRule(c)
+	r := &River{st: &stat{}}
+
+	e := s.testEvent(canal.UpdateAction,
+		[]interface{}{int64(1), "a"}, []interface{}{int64(1), "b"},
+		[]interface{}{int64(2), "c"}, []interface{}{int64(2), "c"})
+	e.GTID = "3e11fa47-71ca-11e1-9e33-c80aa9429562:23"
+	reqs, err := r.makeAuditRequest(rule, e)
+	c.Assert(err, IsNil)
+
+	// one document for every before and after pair, numbered in the event
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].ID, Equals, "mysql-bin.000003:1234:0")
+	c.Assert(reqs[1].ID, Equals, "mysql-bin.000003:1234:1")
+	c.Assert(reqs[0].Index, Equals, "users_audit")
+	c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionIndex)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{
+		auditFieldAction:     canal.UpdateAction,
+		auditFieldSchema:     "test",
+		auditFieldTable:      "users",
+		auditFieldIndex:      "users",
+		auditFieldDocID:      "u:1",
+		auditFieldBefore:     map[string]interface{}{"id": int64(1), "name": "a"},
+		auditFieldAfter:      map[string]interface{}{"id": int64(1), "name": "b"},
+		auditFieldChanged:    []string{"name"},
+		auditFieldBinlogFile: "mysql-bin.000003",
+		auditFieldBinlogPos:  uint32(1234),
+		auditFieldTimestamp:  "2017-07-14T02:40:00Z",
+		auditFieldGTID:       "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+	})
+	c.Assert(reqs[1].Data[auditFieldDocID], Equals, "u:2")
+	c.Assert(reqs[1].Data[auditFieldChanged], DeepEquals, []string{})
+
+	// the update rows come in pairs
+	_, err = r.makeAuditRequest(rule, s.testEvent(canal.UpdateAction, []interface{}{int64(1), "a"}))
+	c.Assert(err, NotNil)
+}
+
+func (s *auditTestSuite) TestInsertDelete(c *C) {
+	rule := s.testRule(c)
+	r := &River{st: &stat{}}
+
+	reqs, err := r.makeAuditRequest(rule, s.testEvent(canal.InsertAction,
+		[]interface{}{int64(1), "a"}, []interface{}{int64(2), "b"}))
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[1].ID, Equals, "mysql-bin.000003:1234:1")
+	c.Assert(reqs[1].Data[auditFieldAfter], DeepEquals, map[string]interface{}{"id": int64(2), "name": "b"})
+	_, ok := reqs[1].Data[auditFieldBefore]
+	c.Assert(ok, IsFalse)
+	// no GTID without GTID mode
+	_, ok = reqs[1].Data[auditFieldGTID]
+	c.Assert(ok, IsFalse)
+
+	reqs, err = r.makeAuditRequest(rule, s.testEvent(canal.DeleteAction, []interface{}{int64(1), "a"}))
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Data[auditFieldBefore], DeepEquals, map[string]interface{}{"id": int64(1), "name": "a"})
+	c.Assert(reqs[0].Data[auditFieldChanged], DeepEquals, []string{"id", "name"})
+	_, ok = reqs[0].Data[auditFieldAfter]
+	c.Assert(ok, IsFalse)
+}
+
+func (s *auditTestSuite) TestAuditOnly(c *C) {
+	rule := s.testRule(c)
+	r := &River{st: &stat{}, rules: map[string]*Rule{ruleKey("test", "users"): rule},
+		syncCh: make(chan interface{}, 1)}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+	h := &eventHandler{r}
+
+	e := s.testEvent(canal.InsertAction, []interface{}{int64(1), "a"})
+	e.Table = rule.TableInfo
+	c.Assert(h.OnRow(e), IsNil)
+	reqs := (<-r.syncCh).([]*elasticwrapper.BulkRequest)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Index, Equals, "users")
+	c.Assert(reqs[1].Index, Equals, "users_audit")
+
+	// only the audit document
+	rule.AuditOnly = true
+	c.Assert(h.OnRow(e), IsNil)
+	reqs = (<-r.syncCh).([]*elasticwrapper.BulkRequest)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Index, Equals, "users_audit")
+
+	// rows from mysqldump are no changes
+	e.Header = nil
+	c.Assert(h.OnRow(e), IsNil)
+	c.Assert(<-r.syncCh, HasLen, 0)
+}
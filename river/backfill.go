@@ -0,0 +1,479 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/canal"
+	"github.com/jrots/go-mysql/client"
+	"github.com/jrots/go-mysql/mysql"
+	"github.com/jrots/go-mysql/schema"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	watermarkLow  = "low"
+	watermarkHigh = "high"
+)
+
+// backfillTimeout returns how long a backfill waits for a watermark to show up in the binlog.
+func (r *River) backfillTimeout() time.Duration {
+	if r.c.BackfillTimeout.Duration > 0 {
+		return r.c.BackfillTimeout.Duration
+	}
+	return time.Minute
+}
+
+// backfillWindow is the part of the binlog between the low and the high watermark of one chunk.
+type backfillWindow struct {
+	id   string
+	open bool
+
+	// the last after image of the rows changed in the binlog since the low watermark by PK key,
+	// nil for a deleted row
+	changed map[string][]interface{}
+	// chunk rows, read after the low watermark was written
+	rows [][]interface{}
+
+	done chan struct{}
+}
+
+// backfill re-reads one table, or a PK range of it, while the binlog is synced.
+// Every chunk is read between a low and a high watermark written to the watermark table.
+// Rows changed in the binlog between both watermarks are newer than the chunk rows, their
+// last binlog image takes the place of the chunk row, a deleted one is dropped, and the chunk
+// is synced when the high watermark is seen. A chunk row never overwrites a newer binlog change,
+// and a document the binlog only updated some fields of still gets the whole row.
+type backfill struct {
+	sync.Mutex
+
+	r    *River
+	rule *Rule
+
+	// inclusive PK range, only for a single integer PK
+	from *int64
+	to   *int64
+
+	window *backfillWindow
+
+	rows    int64
+	skipped int64
+	state   string
+}
+
+func newBackfill(r *River, rule *Rule, from *int64, to *int64) (*backfill, error) {
+	if len(r.c.WatermarkTable) == 0 {
+		return nil, errors.Errorf("watermark_table must be set for a backfill")
+	}
+	if _, _, err := r.watermarkTable(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if rule.AuditOnly {
+		return nil, errors.Errorf("audit only rule %s.%s has no documents to backfill", rule.Schema, rule.Table)
+	}
+	if rule.IsAggregate() {
+		return nil, errors.Errorf("aggregate rule %s.%s can't be backfilled, every row would be read again", rule.Schema, rule.Table)
+	}
+
+	pks := rule.TableInfo.PKColumns
+	if (from != nil || to != nil) && (len(pks) != 1 || rule.TableInfo.Columns[pks[0]].Type != schema.TYPE_NUMBER) {
+		return nil, errors.Errorf("PK range backfill of %s.%s needs a single integer PK", rule.Schema, rule.Table)
+	}
+
+	return &backfill{r: r, rule: rule, from: from, to: to, state: "running"}, nil
+}
+
+// watermarkTable returns the schema and the name of the watermark table.
+func (r *River) watermarkTable() (string, string, error) {
+	seps := strings.Split(r.c.WatermarkTable, ".")
+	if len(seps) != 2 || len(seps[0]) == 0 || len(seps[1]) == 0 {
+		return "", "", errors.Errorf("invalid watermark_table %s, must be schema.table", r.c.WatermarkTable)
+	}
+	return seps[0], seps[1], nil
+}
+
+// StartBackfill re-reads the table of a rule in the background, from and to limit the PK range.
+// Only one backfill runs at a time.
+func (r *River) StartBackfill(schema string, table string, from *int64, to *int64) error {
+	rule, ok := r.getRule(schema, table)
+	if !ok {
+		return errors.NewNotFound(nil, fmt.Sprintf("no rule for %s.%s", schema, table))
+	}
+
+	b, err := newBackfill(r, rule, from, to)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err = r.setBackfill(b); err != nil {
+		return errors.Trace(err)
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.runBackfill(b)
+	}()
+	return nil
+}
+
+func (r *River) setBackfill(b *backfill) error {
+	r.backfillLock.Lock()
+	defer r.backfillLock.Unlock()
+
+	if r.backfill != nil && !r.backfill.isDone() {
+		return errors.NewAlreadyExists(nil, fmt.Sprintf("backfill of %s.%s is still running", r.backfill.rule.Schema, r.backfill.rule.Table))
+	}
+	r.backfill = b
+	return nil
+}
+
+// runBackfill runs the backfill set before and records how it ended.
+func (r *River) runBackfill(b *backfill) error {
+	log.Infof("backfill %s.%s into %s started", b.rule.Schema, b.rule.Table, b.rule.Index)
+	if err := b.Run(); err != nil {
+		log.Errorf("backfill %s.%s err %v", b.rule.Schema, b.rule.Table, err)
+		b.finish("failed: " + err.Error())
+		return errors.Trace(err)
+	}
+	log.Infof("backfill %s.%s OK, %d rows synced", b.rule.Schema, b.rule.Table, b.rows)
+	b.finish("done")
+	return nil
+}
+
+func (r *River) currentBackfill() *backfill {
+	r.backfillLock.Lock()
+	defer r.backfillLock.Unlock()
+
+	return r.backfill
+}
+
+func (b *backfill) isDone() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.state != "running"
+}
+
+func (b *backfill) finish(state string) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.state = state
+	b.window = nil
+}
+
+func (b *backfill) Run() error {
+	conn, err := b.r.connectMySQL()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	if err = b.createWatermarkTable(conn); err != nil {
+		return errors.Trace(err)
+	}
+
+	var last []interface{}
+	if b.from != nil {
+		last = []interface{}{*b.from - 1}
+	}
+
+	limit := b.r.snapshotChunkSize()
+	for {
+		if err = b.r.ctx.Err(); err != nil {
+			return err
+		}
+
+		var n int
+		if last, n, err = b.readChunk(conn, last, limit); err != nil {
+			return errors.Trace(err)
+		}
+		if n < limit {
+			return nil
+		}
+	}
+}
+
+func (b *backfill) createWatermarkTable(conn *client.Conn) error {
+	db, table, err := b.r.watermarkTable()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = conn.Execute(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.%s (
+		id VARCHAR(64) NOT NULL PRIMARY KEY,
+		value VARCHAR(64) NOT NULL)`, quoteName(db), quoteName(table)))
+	return errors.Trace(err)
+}
+
+// writeWatermark writes the watermark to the row of this river, rivers with another server_id
+// may share the table.
+func (b *backfill) writeWatermark(conn *client.Conn, kind string, id string) error {
+	db, table, err := b.r.watermarkTable()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = conn.Execute(fmt.Sprintf("INSERT INTO %s.%s (id, value) VALUES ('%d', '%s:%s') ON DUPLICATE KEY UPDATE value = VALUES(value)",
+		quoteName(db), quoteName(table), b.r.c.ServerID, kind, mysql.Escape(id)))
+	return errors.Trace(err)
+}
+
+// readChunk reads the rows after last between two watermarks and waits until they are synced.
+// It returns the PK values of the last row read and the number of rows read.
+func (b *backfill) readChunk(conn *client.Conn, last []interface{}, limit int) ([]interface{}, int, error) {
+	w := &backfillWindow{
+		id:      uuid.NewV4().String(),
+		changed: make(map[string][]interface{}),
+		done:    make(chan struct{}),
+	}
+
+	b.Lock()
+	b.window = w
+	b.Unlock()
+
+	defer func() {
+		b.Lock()
+		b.window = nil
+		b.Unlock()
+	}()
+
+	if err := b.writeWatermark(conn, watermarkLow, w.id); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	res, err := conn.Execute(chunkQuery(b.rule, last, b.to, limit))
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	n := res.RowNumber()
+	rows := make([][]interface{}, n)
+	for i, values := range res.Values {
+		rows[i] = snapshotRow(b.rule.TableInfo, values)
+	}
+	if n > 0 {
+		if last, err = pkValues(b.rule.TableInfo, res.Values[n-1]); err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+	}
+
+	b.Lock()
+	w.rows = rows
+	b.Unlock()
+
+	if err = b.writeWatermark(conn, watermarkHigh, w.id); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	select {
+	case <-w.done:
+	case <-b.r.ctx.Done():
+		return nil, 0, b.r.ctx.Err()
+	case <-time.After(b.r.backfillTimeout()):
+		return nil, 0, errors.Errorf("watermark %s not seen in the binlog after %s", w.id, b.r.backfillTimeout())
+	}
+
+	return last, n, nil
+}
+
+// onRow is called with every binlog rows event. It records the rows changed inside the window
+// and returns the requests for the chunk rows once the high watermark is seen.
+func (b *backfill) onRow(e *canal.RowsEvent) ([]*elasticwrapper.BulkRequest, error) {
+	// rows from mysqldump are no binlog events
+	if e.Header == nil {
+		return nil, nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	w := b.window
+	if w == nil {
+		return nil, nil
+	}
+
+	db, table, _ := b.r.watermarkTable()
+	if e.Table.Schema == db && e.Table.Name == table {
+		return b.onWatermark(w, e)
+	}
+
+	if !w.open || e.Table.Schema != b.rule.Schema || e.Table.Name != b.rule.Table {
+		return nil, nil
+	}
+
+	for i, row := range e.Rows {
+		pk, err := pkValues(b.rule.TableInfo, row)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		switch {
+		case e.Action == canal.InsertAction:
+			w.changed[backfillKey(pk)] = row
+		case e.Action == canal.UpdateAction && i%2 == 1:
+			w.changed[backfillKey(pk)] = row
+		default:
+			// a deleted row, or the before image of an update which may have changed the PK,
+			// the after image comes next
+			w.changed[backfillKey(pk)] = nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *backfill) onWatermark(w *backfillWindow, e *canal.RowsEvent) ([]*elasticwrapper.BulkRequest, error) {
+	if e.Action == canal.DeleteAction {
+		return nil, nil
+	}
+
+	step := 1
+	if e.Action == canal.UpdateAction {
+		step = 2
+	}
+
+	column := e.Table.FindColumn("value")
+	if column < 0 {
+		return nil, errors.Errorf("watermark table %s has no value column", b.r.c.WatermarkTable)
+	}
+
+	// the after image of the row holds the watermark
+	for i := step - 1; i < len(e.Rows); i += step {
+		var value string
+		switch v := e.Rows[i][column].(type) {
+		case string:
+			value = v
+		case []byte:
+			value = string(v)
+		}
+
+		seps := strings.SplitN(value, ":", 2)
+		if len(seps) != 2 || seps[1] != w.id {
+			continue
+		}
+
+		switch seps[0] {
+		case watermarkLow:
+			w.open = true
+		case watermarkHigh:
+			if !w.open {
+				continue
+			}
+			return b.closeWindow(w)
+		}
+	}
+	return nil, nil
+}
+
+// closeWindow replaces the chunk rows changed inside the window by their last binlog image, drops
+// the deleted ones and returns the requests for the chunk. Those binlog changes were synced before,
+// an update of them only wrote its changed fields, the whole row completes the document.
+func (b *backfill) closeWindow(w *backfillWindow) ([]*elasticwrapper.BulkRequest, error) {
+	rows := make([][]interface{}, 0, len(w.rows))
+	for _, row := range w.rows {
+		pk, err := pkValues(b.rule.TableInfo, row)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if after, ok := w.changed[backfillKey(pk)]; ok {
+			if after == nil {
+				b.skipped++
+				continue
+			}
+			row = after
+		}
+		rows = append(rows, row)
+	}
+
+	b.window = nil
+	close(w.done)
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	b.rows += int64(len(rows))
+	return b.r.makeRowsRequest(b.rule, &canal.RowsEvent{Table: b.rule.TableInfo, Action: canal.InsertAction, Rows: rows})
+}
+
+// Status writes the progress of the backfill for the stat endpoint.
+func (b *backfill) Status(buf *bytes.Buffer) {
+	b.Lock()
+	defer b.Unlock()
+
+	buf.WriteString(fmt.Sprintf("backfill:%s.%s rows:%d skipped:%d state:%s\n",
+		b.rule.Schema, b.rule.Table, b.rows, b.skipped, b.state))
+}
+
+// backfillKey is the same for the PK values of a binlog row and of a text protocol row.
+func backfillKey(pk []interface{}) string {
+	return strings.Join(formatPKValues(pk), "\x00")
+}
+
+// backfillHandler starts a backfill, e.g. POST /backfill?table=test.t1&from=1&to=1000
+type backfillHandler struct {
+	r *River
+}
+
+func (h *backfillHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	seps := strings.Split(req.FormValue("table"), ".")
+	if len(seps) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("table must be schema.table"))
+		return
+	}
+
+	var from, to *int64
+	for _, p := range []struct {
+		name  string
+		value **int64
+	}{{"from", &from}, {"to", &to}} {
+		s := req.FormValue(p.name)
+		if len(s) == 0 {
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("invalid %s %s", p.name, s)))
+			return
+		}
+		*p.value = &v
+	}
+
+	if err := h.r.StartBackfill(seps[0], seps[1], from, to); err != nil {
+		w.WriteHeader(startStatus(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("backfill of %s.%s started\n", seps[0], seps[1])))
+}
+
+// startStatus returns the status of a backfill or reindex which couldn't be started:
+// an unknown rule, one still running or a request which can't be run.
+func startStatus(err error) int {
+	switch {
+	case errors.IsNotFound(err):
+		return http.StatusNotFound
+	case errors.IsAlreadyExists(err):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
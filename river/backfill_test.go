@@ -0,0 +1,175 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/jrots/go-mysql/canal"
+	"github.com/jrots/go-mysql/replication"
+	"github.com/jrots/go-mysql/schema"
+)
+
+type backfillTestSuite struct{}
+
+var _ = Suite(&backfillTestSuite{})
+
+func (s *backfillTestSuite) TestWindow(c *C) {
+	table := &schema.Table{Schema: "test", Name: "t"}
+	table.AddColumn("id", "int(11)", "")
+	table.AddColumn("name", "varchar(256)", "")
+	table.PKColumns = []int{0}
+
+	rule := newDefaultRule("test", "t")
+	rule.TableInfo = table
+
+	watermark := &schema.Table{Schema: "river", Name: "watermark"}
+	watermark.AddColumn("id", "varchar(64)", "")
+	watermark.AddColumn("value", "varchar(64)", "")
+	watermark.PKColumns = []int{0}
+
+	r := &River{c: &Config{WatermarkTable: "river.watermark"}, st: &stat{}}
+	b, err := newBackfill(r, rule, nil, nil)
+	c.Assert(err, IsNil)
+
+	w := &backfillWindow{id: "w1", changed: make(map[string][]interface{}), done: make(chan struct{})}
+	b.window = w
+
+	event := func(t *schema.Table, action string, rows ...[]interface{}) *canal.RowsEvent {
+		e := &canal.RowsEvent{Table: t, Action: action, Rows: rows}
+		e.Header = &replication.EventHeader{}
+		return e
+	}
+
+	// changed before the low watermark, the chunk row is newer
+	reqs, err := b.onRow(event(table, canal.UpdateAction, []interface{}{int32(1), "a"}, []interface{}{int32(1), "b"}))
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 0)
+
+	reqs, err = b.onRow(event(watermark, canal.InsertAction, []interface{}{"1", "low:w1"}))
+	c.Assert(err, IsNil)
+	c.Assert(w.open, IsTrue)
+
+	reqs, err = b.onRow(event(table, canal.UpdateAction, []interface{}{int32(2), "a"}, []interface{}{int32(2), "b"}))
+	c.Assert(err, IsNil)
+	reqs, err = b.onRow(event(table, canal.DeleteAction, []interface{}{int32(3), "c"}))
+	c.Assert(err, IsNil)
+
+	b.Lock()
+	w.rows = [][]interface{}{{int64(1), "b"}, {int64(2), "a"}, {int64(3), "c"}}
+	b.Unlock()
+
+	// watermark of another window
+	reqs, err = b.onRow(event(watermark, canal.UpdateAction, []interface{}{"1", "low:w1"}, []interface{}{"1", "high:w0"}))
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 0)
+
+	reqs, err = b.onRow(event(watermark, canal.UpdateAction, []interface{}{"1", "low:w1"}, []interface{}{"1", "high:w1"}))
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].ID, Equals, "1")
+	// the binlog only updated the name, the whole newer row is written
+	c.Assert(reqs[1].ID, Equals, "2")
+	c.Assert(reqs[1].Data, DeepEquals, map[string]interface{}{"id": int32(2), "name": "b"})
+	// deleted inside the window
+	c.Assert(b.skipped, Equals, int64(1))
+	c.Assert(b.window, IsNil)
+
+	select {
+	case <-w.done:
+	default:
+		c.Fatal("window not closed")
+	}
+}
+
+func (s *backfillTestSuite) TestPKRange(c *C) {
+	table := &schema.Table{Schema: "test", Name: "t"}
+	table.AddColumn("a", "int(11)", "")
+	table.AddColumn("b", "varchar(256)", "")
+	table.PKColumns = []int{0, 1}
+
+	rule := newDefaultRule("test", "t")
+	rule.TableInfo = table
+
+	from := int64(1)
+	r := &River{c: &Config{WatermarkTable: "river.watermark"}}
+	_, err := newBackfill(r, rule, &from, nil)
+	c.Assert(err, NotNil)
+
+	_, err = newBackfill(r, rule, nil, nil)
+	c.Assert(err, IsNil)
+
+	// an audit only rule has no documents
+	rule.AuditIndex = "t_audit"
+	rule.AuditOnly = true
+	_, err = newBackfill(r, rule, nil, nil)
+	c.Assert(err, NotNil)
+	rule.AuditOnly = false
+
+	r.c.WatermarkTable = "watermark"
+	_, err = newBackfill(r, rule, nil, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *backfillTestSuite) TestHandler(c *C) {
+	table := &schema.Table{Schema: "test", Name: "t"}
+	table.AddColumn("id", "int(11)", "")
+	table.PKColumns = []int{0}
+
+	rule := newDefaultRule("test", "t")
+	rule.TableInfo = table
+
+	r := &River{c: &Config{WatermarkTable: "river.watermark"}, rules: map[string]*Rule{ruleKey("test", "t"): rule}}
+	r.backfill = &backfill{rule: rule, state: "running"}
+	h := &backfillHandler{r: r}
+
+	for query, status := range map[string]int{
+		"table=test.other":    http.StatusNotFound,
+		"table=test":          http.StatusBadRequest,
+		"table=test.t&from=x": http.StatusBadRequest,
+		"table=test.t":        http.StatusConflict,
+		"table=test.t&from=1": http.StatusConflict,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/backfill?"+query, nil))
+		c.Assert(w.Code, Equals, status, Commentf(query))
+	}
+
+	// can't be run without a watermark table
+	r.c.WatermarkTable = ""
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/backfill?table=test.t", nil))
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
+
+func (s *backfillTestSuite) TestAdminToken(c *C) {
+	r := &River{c: &Config{}, rules: map[string]*Rule{}}
+	h := &adminHandler{h: &backfillHandler{r: r}}
+
+	// disabled without a token
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/backfill?table=test.t", nil))
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	h.token = "secret"
+	for auth, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer other":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusNotFound,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/backfill?table=test.t", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, status, Commentf(auth))
+	}
+}
+
+func (s *backfillTestSuite) TestTimeout(c *C) {
+	r := &River{c: &Config{}}
+	c.Assert(r.backfillTimeout(), Equals, time.Minute)
+	r.c.BackfillTimeout.Duration = 5 * time.Second
+	c.Assert(r.backfillTimeout(), Equals, 5*time.Second)
+}
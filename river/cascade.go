@@ -0,0 +1,115 @@
+package river
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	elastic "github.com/olivere/elastic"
+)
+
+// prepareCascades resolves the child rules the deletes of every rule cascade to.
+// Only a hard delete removes the parent document, the children must be joined to it.
+func (r *River) prepareCascades() error {
+	for _, rule := range r.rules {
+		rule.cascadeRules = nil
+		if len(rule.Cascade) == 0 {
+			continue
+		}
+		if !rule.HardCrud {
+			return errors.Errorf("cascade of %s.%s needs write_policy hard", rule.Schema, rule.Table)
+		}
+
+		for _, key := range rule.Cascade {
+			seps := strings.SplitN(key, ".", 2)
+			if len(seps) != 2 {
+				return errors.Errorf("cascade rule %s of %s.%s must be schema.table", key, rule.Schema, rule.Table)
+			}
+			child, ok := r.rules[ruleKey(seps[0], seps[1])]
+			if !ok {
+				return errors.Errorf("cascade rule %s of %s.%s not defined", key, rule.Schema, rule.Table)
+			}
+			if len(child.Parent) == 0 {
+				return errors.Errorf("cascade rule %s of %s.%s has no parent", key, rule.Schema, rule.Table)
+			}
+			rule.cascadeRules = append(rule.cascadeRules, child)
+		}
+	}
+	return nil
+}
+
+// cascadeQueries returns the delete by queries removing the children of the parent document id.
+// Children are found by their join field, by their _parent with types, else by the parent column field.
+func (r *River) cascadeQueries(rule *Rule, id string) []*elasticwrapper.DeleteQuery {
+	queries := make([]*elasticwrapper.DeleteQuery, 0, len(rule.cascadeRules))
+	for _, child := range rule.cascadeRules {
+		q := &elasticwrapper.DeleteQuery{Index: child.Index, Type: child.Type, Routing: id}
+		switch {
+		case len(child.JoinField) > 0:
+			q.Query = elastic.NewParentIdQuery(child.JoinFieldName, id)
+		case len(child.Type) > 0:
+			q.Query = elastic.NewParentIdQuery(child.Type, id)
+		default:
+			q.Query = elastic.NewTermQuery(r.parentField(child), id)
+		}
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+// parentField returns the name of the field the parent column of the rule is synced to.
+func (r *River) parentField(rule *Rule) string {
+	for k, v := range rule.FieldMapping {
+		if mysql, field, _ := r.getFieldParts(k, v); mysql == rule.Parent {
+			return field
+		}
+	}
+	return rule.Parent
+}
+
+// cascade deletes the children of the parent deletes on every target. It runs in the sync loop once
+// the deletes are written: every target commits what it holds and refreshes the child indices, so the
+// delete by queries find all children written before, and no later write goes out before they are done.
+// A failed delete by query goes to the failure policy of the target with its parent delete.
+func (ts *esTargets) cascade(reqs []*elasticwrapper.BulkRequest) error {
+	// a dry run has no cluster to query
+	if len(ts.r.c.DryRun) > 0 {
+		return nil
+	}
+
+	var indices []string
+	seen := make(map[string]struct{})
+	for _, req := range reqs {
+		for _, q := range req.Cascade {
+			if _, ok := seen[q.Index]; !ok {
+				seen[q.Index] = struct{}{}
+				indices = append(indices, q.Index)
+			}
+		}
+	}
+
+	for _, t := range ts.targets {
+		if err := t.client.Flush(); err != nil {
+			return errors.Annotatef(err, "es_target %s", t.name)
+		}
+		if err := t.client.Refresh(indices...); err != nil {
+			t.cascadeFailed.Add(int64(len(reqs)))
+			ts.fail(t, reqs, errors.Annotatef(err, "refresh %v before the cascade deletes", indices))
+			continue
+		}
+
+		for _, req := range reqs {
+			for _, q := range req.Cascade {
+				deleted, err := t.client.DeleteByQuery(q)
+				if err != nil {
+					t.cascadeFailed.Add(1)
+					ts.fail(t, []*elasticwrapper.BulkRequest{req},
+						errors.Annotatef(err, "cascade delete of %s/%s to index %s", req.Index, req.ID, q.Index))
+					continue
+				}
+				t.cascaded.Add(deleted)
+			}
+		}
+	}
+	return nil
+}
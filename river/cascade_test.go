@@ -0,0 +1,146 @@
+package river
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql-elasticsearch/sink"
+	"github.com/jrots/go-mysql/schema"
+	elastic "github.com/olivere/elastic"
+	. "github.com/pingcap/check"
+)
+
+type cascadeTestSuite struct{}
+
+var _ = Suite(&cascadeTestSuite{})
+
+func (s *cascadeTestSuite) testRiver(c *C) *River {
+	parentTable := &schema.Table{Schema: "test", Name: "posts"}
+	parentTable.AddColumn("id", "int(11)", "")
+	parentTable.AddColumn("title", "varchar(255)", "")
+	parentTable.PKColumns = []int{0}
+
+	childTable := &schema.Table{Schema: "test", Name: "comments"}
+	childTable.AddColumn("id", "int(11)", "")
+	childTable.AddColumn("post_id", "int(11)", "")
+	childTable.PKColumns = []int{0}
+
+	parent := newDefaultRule("test", "posts")
+	parent.Index = "posts"
+	parent.WritePolicy = WritePolicyHard
+	parent.Cascade = []string{"test.comments"}
+	parent.TableInfo = parentTable
+	c.Assert(parent.prepare(), IsNil)
+
+	child := newDefaultRule("test", "comments")
+	child.Index = "comments"
+	child.Parent = "post_id"
+	child.FieldMapping = map[string]string{"post_id": "post"}
+	child.TableInfo = childTable
+	c.Assert(child.prepare(), IsNil)
+
+	r := &River{st: &stat{}, rules: map[string]*Rule{
+		ruleKey("test", "posts"):    parent,
+		ruleKey("test", "comments"): child,
+	}}
+	c.Assert(r.prepareCascades(), IsNil)
+	return r
+}
+
+func (s *cascadeTestSuite) TestPrepare(c *C) {
+	r := s.testRiver(c)
+	parent := r.rules[ruleKey("test", "posts")]
+	c.Assert(parent.cascadeRules, DeepEquals, []*Rule{r.rules[ruleKey("test", "comments")]})
+
+	parent.HardCrud = false
+	c.Assert(r.prepareCascades(), NotNil)
+
+	r = s.testRiver(c)
+	r.rules[ruleKey("test", "posts")].Cascade = []string{"test.missing"}
+	c.Assert(r.prepareCascades(), NotNil)
+	r.rules[ruleKey("test", "posts")].Cascade = []string{"comments"}
+	c.Assert(r.prepareCascades(), NotNil)
+
+	r = s.testRiver(c)
+	r.rules[ruleKey("test", "comments")].Parent = ""
+	c.Assert(r.prepareCascades(), NotNil)
+}
+
+func (s *cascadeTestSuite) TestQueries(c *C) {
+	r := s.testRiver(c)
+	parent := r.rules[ruleKey("test", "posts")]
+	child := r.rules[ruleKey("test", "comments")]
+
+	// a typeless cluster
+	child.Type = ""
+	qs := r.cascadeQueries(parent, "7")
+	c.Assert(qs, HasLen, 1)
+	c.Assert(qs[0].Index, Equals, "comments")
+	c.Assert(qs[0].Routing, Equals, "7")
+	c.Assert(qs[0].Query, DeepEquals, elastic.NewTermQuery("post", "7"))
+
+	child.Type = "comment"
+	c.Assert(r.cascadeQueries(parent, "7")[0].Query, DeepEquals, elastic.NewParentIdQuery("comment", "7"))
+
+	child.JoinField = "join"
+	child.JoinFieldName = "reply"
+	c.Assert(r.cascadeQueries(parent, "7")[0].Query, DeepEquals, elastic.NewParentIdQuery("reply", "7"))
+}
+
+func (s *cascadeTestSuite) TestDelete(c *C) {
+	r := s.testRiver(c)
+	parent := r.rules[ruleKey("test", "posts")]
+
+	reqs, err := r.makeDeleteRequest(parent, [][]interface{}{{int64(7), "title"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].HardCrud, IsTrue)
+	c.Assert(reqs[0].Cascade, HasLen, 1)
+
+	// the children go with the parent, even if it comes back in the same flush
+	index := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionIndex, Index: "posts", ID: "7", HardCrud: true,
+		Data: map[string]interface{}{"title": "again"}}
+	batch, saved := coalesceRequests([]*elasticwrapper.BulkRequest{reqs[0], index})
+	c.Assert(saved, Equals, 0)
+	c.Assert(batch, HasLen, 2)
+
+	// the child rules have nothing to cascade
+	reqs, err = r.makeDeleteRequest(r.rules[ruleKey("test", "comments")], [][]interface{}{{int64(1), int64(7)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Cascade, HasLen, 0)
+}
+
+func (s *cascadeTestSuite) TestFlush(c *C) {
+	var buf bytes.Buffer
+	r := (&targetTestSuite{}).newRiver(ESTargetConfig{Name: "a", FailurePolicy: FailurePolicySkip})
+	ts, err := r.newESTargets(elasticwrapper.ClientConfig{DryRun: &buf})
+	c.Assert(err, IsNil)
+	r.st = &stat{}
+	r.targets = ts
+	r.sinks = map[string]sink.Sink{"": ts}
+	t := ts.targets[0]
+
+	child := func() *elasticwrapper.BulkRequest {
+		return &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionIndex, Index: "comments", ID: "1", Parent: "7",
+			HardCrud: true, Data: map[string]interface{}{"post": "7"}}
+	}
+	del := func(id string) *elasticwrapper.BulkRequest {
+		return &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionDelete, Index: "posts", ID: id, HardCrud: true,
+			Cascade: []*elasticwrapper.DeleteQuery{{Index: "comments", Routing: id, Query: elastic.NewTermQuery("post", id)}}}
+	}
+
+	reqs := []*elasticwrapper.BulkRequest{child(), del("7"), del("8"), child()}
+	start, end := cascadeRun(reqs)
+	c.Assert([]int{start, end}, DeepEquals, []int{1, 3})
+	start, end = cascadeRun(reqs[3:])
+	c.Assert([]int{start, end}, DeepEquals, []int{1, 1})
+
+	c.Assert(r.flushRequests(reqs), IsNil)
+	// the child written again after the cascade isn't merged into the one before
+	c.Assert(strings.Count(buf.String(), `"_id":"1"`), Equals, 2)
+	// the dry run cluster can't refresh, both parent deletes went to the failure policy
+	c.Assert(t.cascaded.Get(), Equals, int64(0))
+	c.Assert(t.cascadeFailed.Get(), Equals, int64(2))
+	c.Assert(t.failed.Get(), Equals, int64(2))
+}
@@ -0,0 +1,126 @@
+package river
+
+import (
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+// docKey identifies the document a request writes to, its parent only routes the request.
+type docKey struct {
+	sink  string
+	index string
+	typ   string
+	id    string
+}
+
+func newDocKey(req *elasticwrapper.BulkRequest) docKey {
+	return docKey{req.Sink, req.Index, req.Type, req.ID}
+}
+
+// coalesceRequests merges successive requests to the same document, so a hot row costs one write per flush.
+// The merged request takes the place of the first one, requests to other documents keep their order.
+// It returns the requests to write and the number of requests saved.
+func coalesceRequests(reqs []*elasticwrapper.BulkRequest) ([]*elasticwrapper.BulkRequest, int) {
+	out := make([]*elasticwrapper.BulkRequest, 0, len(reqs))
+	// position in out of the last request to every document
+	last := make(map[docKey]int, len(reqs))
+
+	for _, req := range reqs {
+		if len(req.ID) == 0 || req.ListRequest || req.Aggregate {
+			// nothing after it is merged into the requests before it
+			delete(last, newDocKey(req))
+			out = append(out, req)
+			continue
+		}
+
+		key := newDocKey(req)
+		if i, ok := last[key]; ok {
+			if merged := mergeRequests(out[i], req); merged != nil {
+				out[i] = merged
+				continue
+			}
+		}
+		last[key] = len(out)
+		out = append(out, req)
+	}
+
+	return out, len(reqs) - len(out)
+}
+
+// mergeRequests returns a request with the final state of prev followed by next, nil if they must both be written.
+// Neither request is modified, they may share their data with other requests.
+// A hard delete or an index replaces whatever came before, but a delete cascading to the children is kept,
+// a create after a create is dropped as the first one wins. Requests with another parent are routed apart.
+// Updates after an update or an index set their fields in it, the later value wins.
+// A soft delete after an update or a soft delete removes the fields of both.
+func mergeRequests(prev *elasticwrapper.BulkRequest, next *elasticwrapper.BulkRequest) *elasticwrapper.BulkRequest {
+	if prev.ListRequest || prev.Retries > 0 || prev.UpdateOnly != next.UpdateOnly || prev.Parent != next.Parent {
+		return nil
+	}
+	// the children of a deleted parent are deleted even if it comes back
+	if len(prev.Cascade) > 0 && (next.Action != elasticwrapper.ActionDelete || !next.HardCrud) {
+		return nil
+	}
+
+	prevSoftDelete := prev.Action == elasticwrapper.ActionDelete && !prev.HardCrud
+
+	switch next.Action {
+	case elasticwrapper.ActionIndex:
+		return next
+	case elasticwrapper.ActionCreate:
+		if prev.Action == elasticwrapper.ActionCreate {
+			return prev
+		}
+	case elasticwrapper.ActionDelete:
+		if next.HardCrud {
+			return next
+		}
+		if prev.Action == elasticwrapper.ActionUpdate {
+			merged := copyRequest(prev)
+			for k := range next.Data {
+				delete(merged.Data, k)
+				merged.DeleteFields[k] = true
+			}
+			return merged
+		}
+		if prevSoftDelete {
+			merged := copyRequest(prev)
+			for k, v := range next.Data {
+				merged.Data[k] = v
+			}
+			return merged
+		}
+	case elasticwrapper.ActionUpdate:
+		if prev.Action != elasticwrapper.ActionUpdate && prev.Action != elasticwrapper.ActionIndex {
+			return nil
+		}
+		merged := copyRequest(prev)
+		for k, v := range next.Data {
+			merged.Data[k] = v
+			delete(merged.DeleteFields, k)
+		}
+		for k := range next.DeleteFields {
+			delete(merged.Data, k)
+			if merged.Action == elasticwrapper.ActionUpdate {
+				merged.DeleteFields[k] = true
+			}
+		}
+		merged.Initial = prev.Initial || next.Initial
+		return merged
+	}
+
+	return nil
+}
+
+// copyRequest returns a copy of the request with its own data and deleted fields.
+func copyRequest(req *elasticwrapper.BulkRequest) *elasticwrapper.BulkRequest {
+	c := *req
+	c.Data = make(map[string]interface{}, len(req.Data))
+	for k, v := range req.Data {
+		c.Data[k] = v
+	}
+	c.DeleteFields = make(map[string]interface{}, len(req.DeleteFields))
+	for k, v := range req.DeleteFields {
+		c.DeleteFields[k] = v
+	}
+	return &c
+}
@@ -0,0 +1,122 @@
+package river
+
+import (
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	. "github.com/pingcap/check"
+)
+
+type coalesceTestSuite struct{}
+
+var _ = Suite(&coalesceTestSuite{})
+
+func testRequest(action string, id string, data map[string]interface{}) *elasticwrapper.BulkRequest {
+	return &elasticwrapper.BulkRequest{Action: action, Index: "river", Type: "river", ID: id, Data: data}
+}
+
+func (s *coalesceTestSuite) TestUpdates(c *C) {
+	first := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"title": "a", "content": "a"})
+	first.Initial = true
+	second := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"title": "b"})
+	third := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"tags": "c"})
+	third.DeleteFields = map[string]interface{}{"content": true}
+	other := testRequest(elasticwrapper.ActionUpdate, "2", map[string]interface{}{"title": "x"})
+
+	reqs, saved := coalesceRequests([]*elasticwrapper.BulkRequest{first, other, second, third})
+	c.Assert(saved, Equals, 2)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"title": "b", "tags": "c"})
+	c.Assert(reqs[0].DeleteFields, DeepEquals, map[string]interface{}{"content": true})
+	c.Assert(reqs[0].Initial, IsTrue)
+	c.Assert(reqs[1], Equals, other)
+
+	// the requests are left as they were
+	c.Assert(first.Data, DeepEquals, map[string]interface{}{"title": "a", "content": "a"})
+
+	// a field set again is no longer deleted
+	fourth := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"content": "d"})
+	reqs, _ = coalesceRequests([]*elasticwrapper.BulkRequest{third, fourth})
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"tags": "c", "content": "d"})
+	c.Assert(reqs[0].DeleteFields, HasLen, 0)
+}
+
+func (s *coalesceTestSuite) TestIndex(c *C) {
+	index := testRequest(elasticwrapper.ActionIndex, "1", map[string]interface{}{"title": "a", "content": "a"})
+	index.HardCrud = true
+	update := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"title": "b"})
+	update.HardCrud = true
+	update.DeleteFields = map[string]interface{}{"content": true}
+
+	reqs, saved := coalesceRequests([]*elasticwrapper.BulkRequest{index, update})
+	c.Assert(saved, Equals, 1)
+	c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionIndex)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"title": "b"})
+	c.Assert(reqs[0].DeleteFields, HasLen, 0)
+
+	// an update before an index is replaced
+	reqs, _ = coalesceRequests([]*elasticwrapper.BulkRequest{update, index})
+	c.Assert(reqs, DeepEquals, []*elasticwrapper.BulkRequest{index})
+
+	// the first create wins
+	create := testRequest(elasticwrapper.ActionCreate, "1", map[string]interface{}{"title": "a"})
+	again := testRequest(elasticwrapper.ActionCreate, "1", map[string]interface{}{"title": "b"})
+	reqs, _ = coalesceRequests([]*elasticwrapper.BulkRequest{create, again})
+	c.Assert(reqs, DeepEquals, []*elasticwrapper.BulkRequest{create})
+}
+
+func (s *coalesceTestSuite) TestBarrier(c *C) {
+	update := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"title": "a"})
+	link := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"tags": int64(3)})
+	link.ListRequest = true
+	link.Initial = true
+	hardDelete := testRequest(elasticwrapper.ActionDelete, "1", nil)
+	hardDelete.HardCrud = true
+
+	// the delete stays after the list update, which would bring the document back
+	reqs, saved := coalesceRequests([]*elasticwrapper.BulkRequest{update, link, hardDelete})
+	c.Assert(saved, Equals, 0)
+	c.Assert(reqs, DeepEquals, []*elasticwrapper.BulkRequest{update, link, hardDelete})
+}
+
+func (s *coalesceTestSuite) TestParent(c *C) {
+	first := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"title": "a"})
+	first.Parent = "p1"
+	moved := testRequest(elasticwrapper.ActionIndex, "1", map[string]interface{}{"title": "b"})
+	moved.Parent = "p2"
+	back := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"title": "c"})
+	back.Parent = "p1"
+
+	// a request with another parent is not merged, the later ones are not merged past it
+	reqs, saved := coalesceRequests([]*elasticwrapper.BulkRequest{first, moved, back})
+	c.Assert(saved, Equals, 0)
+	c.Assert(reqs, DeepEquals, []*elasticwrapper.BulkRequest{first, moved, back})
+}
+
+func (s *coalesceTestSuite) TestDeletes(c *C) {
+	update := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"title": "a", "name": "a"})
+	hardDelete := testRequest(elasticwrapper.ActionDelete, "1", nil)
+	hardDelete.HardCrud = true
+
+	reqs, saved := coalesceRequests([]*elasticwrapper.BulkRequest{update, hardDelete})
+	c.Assert(saved, Equals, 1)
+	c.Assert(reqs, DeepEquals, []*elasticwrapper.BulkRequest{hardDelete})
+
+	// only the fields of the deleted row are removed, the others were set by another table
+	softDelete := testRequest(elasticwrapper.ActionDelete, "1", map[string]interface{}{"title": "a"})
+	reqs, _ = coalesceRequests([]*elasticwrapper.BulkRequest{update, softDelete})
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionUpdate)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"name": "a"})
+	c.Assert(reqs[0].DeleteFields, DeepEquals, map[string]interface{}{"title": true})
+
+	// an insert after a delete must not be merged into it
+	insert := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"title": "b"})
+	reqs, saved = coalesceRequests([]*elasticwrapper.BulkRequest{hardDelete, insert})
+	c.Assert(saved, Equals, 0)
+	c.Assert(reqs, HasLen, 2)
+
+	// list requests are never merged
+	list := testRequest(elasticwrapper.ActionUpdate, "1", map[string]interface{}{"tags": "a"})
+	list.ListRequest = true
+	reqs, saved = coalesceRequests([]*elasticwrapper.BulkRequest{list, list})
+	c.Assert(saved, Equals, 0)
+}
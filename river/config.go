@@ -13,15 +13,74 @@ type SourceConfig struct {
 	Tables []string `toml:"tables"`
 }
 
+// SinkConfig is a destination besides Elasticsearch, rules select it by name.
+type SinkConfig struct {
+	Name string `toml:"name"`
+	// file or webhook
+	Type string `toml:"type"`
+
+	// file: NDJSON file the bulk lines are appended to, - for stdout
+	Path string `toml:"path"`
+
+	// webhook: URL every batch is posted to as NDJSON events
+	URL     string            `toml:"url"`
+	Headers map[string]string `toml:"headers"`
+	Timeout TomlDuration      `toml:"timeout"`
+}
+
+// ESTargetConfig is an Elasticsearch cluster all documents are written to.
+type ESTargetConfig struct {
+	Name     string `toml:"name"`
+	Addr     string `toml:"addr"`
+	User     string `toml:"user"`
+	Password string `toml:"pass"`
+	// instead of user and pass
+	APIKey      string `toml:"api_key"`
+	BearerToken string `toml:"bearer_token"`
+
+	// HTTPS, used for an addr without scheme if any is set
+	CACert             string `toml:"ca_cert"`
+	ClientCert         string `toml:"client_cert"`
+	ClientKey          string `toml:"client_key"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+
+	// the binlog position is only saved once the required targets committed the changes before it
+	Required bool `toml:"required"`
+	// block, skip or dlq
+	FailurePolicy string `toml:"failure_policy"`
+	// dlq: NDJSON file the failed bulk lines are appended to
+	DLQPath string `toml:"dlq_path"`
+}
+
 type Config struct {
 	MyAddr     string `toml:"my_addr"`
 	MyUser     string `toml:"my_user"`
 	MyPassword string `toml:"my_pass"`
 	MyCharset  string `toml:"my_charset"`
+	// TLS for the replication, dump and query connections: preferred, required or verify-identity, disabled if empty
+	MyTLSMode    string `toml:"my_tls_mode"`
+	MyCACert     string `toml:"my_ca_cert"`
+	MyClientCert string `toml:"my_client_cert"`
+	MyClientKey  string `toml:"my_client_key"`
 
 	ESAddr     string `toml:"es_addr"`
 	ESUser     string `toml:"es_user"`
 	ESPassword string `toml:"es_pass"`
+	// instead of es_user and es_pass, an API key as id:key or base64 encoded, or a bearer token
+	ESAPIKey      string `toml:"es_api_key"`
+	ESBearerToken string `toml:"es_bearer_token"`
+	// HTTPS with a custom CA bundle and client certificate, an es_addr without scheme uses https if any is set
+	ESCACert             string `toml:"es_ca_cert"`
+	ESClientCert         string `toml:"es_client_cert"`
+	ESClientKey          string `toml:"es_client_key"`
+	ESInsecureSkipVerify bool   `toml:"es_insecure_skip_verify"`
+
+	// replaces es_addr, es_user and es_pass if set
+	ESTargets []ESTargetConfig `toml:"es_target"`
+
+	// version and distribution (elasticsearch or opensearch) of the cluster, detected if not set
+	ESVersion      string `toml:"es_version"`
+	ESDistribution string `toml:"es_distribution"`
 
 	StatAddr string `toml:"stat_addr"`
 
@@ -33,15 +92,42 @@ type Config struct {
 	SkipMasterData bool   `toml:"skip_master_data"`
 	SkipSync bool `toml:"skip_sync"`
 
+	// mysqldump (default) or native, native reads the tables itself in PK ordered chunks inside a consistent snapshot
+	SnapshotMode      string `toml:"snapshot_mode"`
+	SnapshotWorkers   int    `toml:"snapshot_workers"`
+	SnapshotChunkSize int    `toml:"snapshot_chunk_size"`
+
+	// schema.table written by a backfill to mark the chunks in the binlog, created if it doesn't exist
+	WatermarkTable string `toml:"watermark_table"`
+	// how long a backfill waits for a watermark in the binlog, a minute if not set
+	BackfillTimeout TomlDuration `toml:"backfill_timeout"`
+
+	// the POST endpoints of stat_addr (backfill, reindex) need it as bearer token, they are disabled without it
+	AdminToken string `toml:"admin_token"`
+
 	BinlogName string   `toml:"binlogname"`
 
+	// DryRun is a file, or - for stdout, which gets the bulk lines instead of Elasticsearch.
+	// master.info is never saved in dry run mode, the binlog is read from DryRunPos (file:pos) if set.
+	DryRun    string `toml:"dry_run"`
+	DryRunPos string `toml:"dry_run_pos"`
+
 	Sources []SourceConfig `toml:"source"`
 
 	Rules []*Rule `toml:"rule"`
 
+	Sinks []SinkConfig `toml:"sink"`
+
 	BulkSize int `toml:"bulk_size"`
 
 	FlushBulkTime TomlDuration `toml:"flush_bulk_time"`
+
+	// bulk_size is also the starting point of the bulk processor,
+	// adaptive_bulk adjusts it within the bounds by the latency and rejections
+	AdaptiveBulk      bool         `toml:"adaptive_bulk"`
+	BulkMinSize       int          `toml:"bulk_min_size"`
+	BulkMaxSize       int          `toml:"bulk_max_size"`
+	BulkTargetLatency TomlDuration `toml:"bulk_target_latency"`
 }
 
 func NewConfigWithFile(name string) (*Config, error) {
@@ -0,0 +1,320 @@
+package river
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/schema"
+)
+
+// Converters of the values extracted from JSON columns, besides list
+const (
+	jsonTypeString = "string"
+	jsonTypeInt    = "int"
+	jsonTypeFloat  = "float"
+	jsonTypeBool   = "bool"
+)
+
+// JSONColumn writes the values at paths of a JSON column to their own fields, and or flattens
+// its objects into fields, instead of storing the whole JSON.
+type JSONColumn struct {
+	Column string `toml:"column"`
+	// path to field[,converter], e.g. "$.address.zip" = "zip,string",
+	// the converters are string, int, float, bool and list
+	Paths map[string]string `toml:"paths"`
+	// only the extracted fields are written, not the JSON itself
+	Drop bool `toml:"drop"`
+
+	// every key of the JSON object is written to prefix + key, the keys of nested objects
+	// are joined by _ up to depth levels, 0 for all
+	Flatten bool   `toml:"flatten"`
+	Prefix  string `toml:"prefix"`
+	Depth   int    `toml:"depth"`
+
+	paths []*jsonPath
+}
+
+type jsonPath struct {
+	path  string
+	keys  []interface{}
+	field string
+	typ   string
+}
+
+// parseJSONPath splits a path like $.items[0].id into its object keys and array indexes.
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.Errorf("json path %s must start with $", path)
+	}
+
+	var keys []interface{}
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, errors.Errorf("empty key in json path %s", path)
+			}
+			keys = append(keys, rest[1:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.Errorf("unclosed index in json path %s", path)
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			if err != nil || i < 0 {
+				return nil, errors.Errorf("invalid index in json path %s", path)
+			}
+			keys = append(keys, i)
+			rest = rest[end+1:]
+		default:
+			return nil, errors.Errorf("invalid json path %s", path)
+		}
+	}
+	return keys, nil
+}
+
+func (r *Rule) prepareJSON() error {
+	for _, jc := range r.JSON {
+		if len(jc.Column) == 0 {
+			return errors.Errorf("json of %s.%s must have a column", r.Schema, r.Table)
+		}
+		if len(jc.Paths) == 0 && !jc.Flatten {
+			return errors.Errorf("json column %s of %s.%s needs paths or flatten", jc.Column, r.Schema, r.Table)
+		}
+		if jc.Depth < 0 {
+			return errors.Errorf("invalid depth %d of json column %s of %s.%s", jc.Depth, jc.Column, r.Schema, r.Table)
+		}
+
+		jc.paths = make([]*jsonPath, 0, len(jc.Paths))
+		for path, v := range jc.Paths {
+			keys, err := parseJSONPath(path)
+			if err != nil {
+				return errors.Annotatef(err, "json column %s of %s.%s", jc.Column, r.Schema, r.Table)
+			}
+
+			p := &jsonPath{path: path, keys: keys}
+			composedField := strings.SplitN(v, ",", 2)
+			p.field = composedField[0]
+			if len(p.field) == 0 {
+				return errors.Errorf("json path %s of %s.%s must have a field", path, r.Schema, r.Table)
+			}
+			if len(composedField) == 2 {
+				p.typ = composedField[1]
+			}
+			switch p.typ {
+			case "", jsonTypeString, jsonTypeInt, jsonTypeFloat, jsonTypeBool, fieldTypeList:
+			default:
+				return errors.Errorf("invalid converter %s of json path %s of %s.%s", p.typ, path, r.Schema, r.Table)
+			}
+			jc.paths = append(jc.paths, p)
+		}
+	}
+	return nil
+}
+
+// jsonColumn returns the json settings of the column, nil if it has none.
+func (r *Rule) jsonColumn(name string) *JSONColumn {
+	for _, jc := range r.JSON {
+		if jc.Column == name {
+			return jc
+		}
+	}
+	return nil
+}
+
+// keepsColumn reports whether the JSON itself is written besides the extracted fields.
+func (jc *JSONColumn) keepsColumn() bool {
+	return !jc.Drop && !jc.Flatten
+}
+
+// jsonFields returns the fields extracted from the value of the JSON column.
+// Paths which are missing or null in the JSON, or whose value can't be converted, give no field.
+func (r *River) jsonFields(jc *JSONColumn, col *schema.TableColumn, value interface{}) map[string]interface{} {
+	v := r.makeReqColumnData(col, value)
+	if col.Type != schema.TYPE_JSON {
+		// JSON stored in a text column
+		var err error
+		switch s := v.(type) {
+		case string:
+			err = json.Unmarshal([]byte(s), &v)
+		case []byte:
+			err = json.Unmarshal(s, &v)
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	if v == nil {
+		return nil
+	}
+
+	fields := make(map[string]interface{})
+	if jc.Flatten {
+		if obj, ok := v.(map[string]interface{}); ok {
+			prefix := jc.Prefix
+			if len(prefix) == 0 {
+				prefix = jc.Column + "_"
+			}
+			depth := jc.Depth
+			if depth == 0 {
+				depth = -1
+			}
+			for k, e := range obj {
+				flattenJSON(fields, prefix+k, e, depth-1)
+			}
+		} else {
+			// no object to flatten
+			fields[jc.Column] = v
+		}
+	}
+
+	for _, p := range jc.paths {
+		e := lookupJSON(v, p.keys)
+		if e == nil {
+			continue
+		}
+		converted, err := convertJSON(e, p.typ)
+		if err != nil {
+			log.Warnf("json path %s of column %s to %s err %v", p.path, jc.Column, p.field, err)
+			continue
+		}
+		fields[p.field] = converted
+	}
+	return fields
+}
+
+// flattenJSON adds the value as field name, the keys of an object as fields of their own
+// until depth is 0.
+func flattenJSON(fields map[string]interface{}, name string, v interface{}, depth int) {
+	obj, ok := v.(map[string]interface{})
+	if !ok || depth == 0 {
+		if v != nil {
+			fields[name] = v
+		}
+		return
+	}
+	for k, e := range obj {
+		flattenJSON(fields, name+"_"+k, e, depth-1)
+	}
+}
+
+// lookupJSON returns the value at the keys of the path, nil if it is missing.
+func lookupJSON(v interface{}, keys []interface{}) interface{} {
+	for _, key := range keys {
+		switch key := key.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = obj[key]
+		case int:
+			list, ok := v.([]interface{})
+			if !ok || key >= len(list) {
+				return nil
+			}
+			v = list[key]
+		}
+	}
+	return v
+}
+
+// convertJSON converts a value of decoded JSON, a string, float64, bool, list or object.
+func convertJSON(v interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case jsonTypeString:
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		default:
+			data, err := json.Marshal(v)
+			return string(data), errors.Trace(err)
+		}
+	case jsonTypeInt:
+		switch v := v.(type) {
+		case float64:
+			return int64(v), nil
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case string:
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return i, nil
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			return int64(f), errors.Trace(err)
+		}
+	case jsonTypeFloat:
+		switch v := v.(type) {
+		case float64:
+			return v, nil
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			return f, errors.Trace(err)
+		}
+	case jsonTypeBool:
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			return v != 0, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			return b, errors.Trace(err)
+		}
+	case fieldTypeList:
+		switch v := v.(type) {
+		case []interface{}:
+			return v, nil
+		case string:
+			return strings.Split(v, ","), nil
+		default:
+			return []interface{}{v}, nil
+		}
+	default:
+		return v, nil
+	}
+	return nil, errors.Errorf("can not convert %T to %s", v, typ)
+}
+
+// makeJSONInsertData adds the fields extracted from the JSON column to the document.
+func (r *River) makeJSONInsertData(req *elasticwrapper.BulkRequest, jc *JSONColumn, col *schema.TableColumn, value interface{}) {
+	for field, v := range r.jsonFields(jc, col, value) {
+		req.Data[field] = v
+	}
+}
+
+// makeJSONUpdateData sets the extracted fields which changed and removes the ones gone from the JSON.
+func (r *River) makeJSONUpdateData(req *elasticwrapper.BulkRequest, jc *JSONColumn, col *schema.TableColumn,
+	before interface{}, after interface{}) {
+	beforeFields := r.jsonFields(jc, col, before)
+	afterFields := r.jsonFields(jc, col, after)
+
+	for field, v := range afterFields {
+		if old, ok := beforeFields[field]; !ok || !reflect.DeepEqual(old, v) {
+			req.Data[field] = v
+		}
+	}
+	for field := range beforeFields {
+		if _, ok := afterFields[field]; !ok {
+			req.DeleteFields[field] = true
+		}
+	}
+}
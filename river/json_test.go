@@ -0,0 +1,113 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+)
+
+type jsonTestSuite struct{}
+
+var _ = Suite(&jsonTestSuite{})
+
+func (s *jsonTestSuite) testRule(c *C, jc *JSONColumn) *Rule {
+	return newTestRule(c, "users", []string{"id int(11)", "profile json", "extra text"}, func(rule *Rule) {
+		rule.JSON = []*JSONColumn{jc}
+	})
+}
+
+func (s *jsonTestSuite) TestParsePath(c *C) {
+	keys, err := parseJSONPath("$.address.zip")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []interface{}{"address", "zip"})
+
+	keys, err = parseJSONPath("$.items[1].id")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []interface{}{"items", 1, "id"})
+
+	keys, err = parseJSONPath("$")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+
+	for _, path := range []string{"address.zip", "$..zip", "$.items[x]", "$.items[1", "$address"} {
+		_, err = parseJSONPath(path)
+		c.Assert(err, NotNil, Commentf(path))
+	}
+}
+
+func (s *jsonTestSuite) TestPrepare(c *C) {
+	rule := newDefaultRule("test", "users")
+	rule.JSON = []*JSONColumn{{Column: "profile"}}
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.JSON = []*JSONColumn{{Column: "profile", Paths: map[string]string{"$.zip": "zip,date"}}}
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.JSON = []*JSONColumn{{Column: "profile", Paths: map[string]string{"$.zip": ",string"}}}
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.JSON = []*JSONColumn{{Column: "profile", Flatten: true, Depth: -1}}
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.JSON = []*JSONColumn{{Column: "profile", Paths: map[string]string{"$.zip": "zip,string"}}}
+	c.Assert(rule.prepare(), IsNil)
+}
+
+func (s *jsonTestSuite) TestPaths(c *C) {
+	rule := s.testRule(c, &JSONColumn{Column: "profile", Drop: true, Paths: map[string]string{
+		"$.address.zip": "zip,string",
+		"$.age":         "age,int",
+		"$.tags":        "tags,list",
+		"$.missing":     "missing",
+		"$.name":        "name,int",
+	}})
+	r := &River{st: &stat{}}
+
+	profile := `{"address": {"zip": 1000, "city": "Brussels"}, "age": "42", "tags": "a,b", "name": "x"}`
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), profile, nil}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	// the name can't be converted, the rest of the JSON is dropped
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{
+		"id": int64(1), "zip": "1000", "age": int64(42), "tags": []string{"a", "b"},
+	})
+
+	changed := `{"address": {"zip": 1000, "city": "Antwerp"}, "age": 43}`
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), profile, nil}, {int64(1), changed, nil}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"age": int64(43)})
+	c.Assert(reqs[0].DeleteFields, DeepEquals, map[string]interface{}{"tags": true})
+
+	// the JSON is kept without drop
+	rule.JSON[0].Drop = false
+	reqs, err = r.makeInsertRequest(rule, [][]interface{}{{int64(1), `{"age": 7}`, nil}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{
+		"id": int64(1), "age": int64(7), "profile": map[string]interface{}{"age": float64(7)},
+	})
+}
+
+func (s *jsonTestSuite) TestFlatten(c *C) {
+	rule := s.testRule(c, &JSONColumn{Column: "extra", Flatten: true, Depth: 2})
+	r := &River{st: &stat{}}
+
+	extra := `{"a": 1, "b": {"c": "x", "d": {"e": true}}, "f": null, "g": [1, 2]}`
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), nil, extra}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{
+		"id":        int64(1),
+		"extra_a":   float64(1),
+		"extra_b_c": "x",
+		"extra_b_d": map[string]interface{}{"e": true},
+		"extra_g":   []interface{}{float64(1), float64(2)},
+	})
+
+	rule.JSON[0].Depth = 0
+	rule.JSON[0].Prefix = "x."
+	reqs, err = r.makeInsertRequest(rule, [][]interface{}{{int64(1), nil, extra}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data["x.b_d_e"], Equals, true)
+
+	// not JSON
+	reqs, err = r.makeInsertRequest(rule, [][]interface{}{{int64(1), nil, "plain"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int64(1)})
+}
@@ -0,0 +1,137 @@
+package river
+
+import (
+	"reflect"
+
+	"github.com/juju/errors"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/canal"
+)
+
+// IsLink reports whether the rule syncs a link table, e.g. user_tags(user_id, tag_id), whose rows are
+// the values of the link_field array of the document their id columns point to.
+func (r *Rule) IsLink() bool {
+	return len(r.LinkField) > 0
+}
+
+func (r *Rule) prepareLink() error {
+	if !r.IsLink() && len(r.LinkValue) == 0 {
+		return nil
+	}
+
+	switch {
+	case len(r.LinkField) == 0 || len(r.LinkValue) == 0:
+		return errors.Errorf("link_field and link_value must be set together for %s.%s", r.Schema, r.Table)
+	case len(r.ID) == 0:
+		return errors.Errorf("link rule %s.%s needs the id columns of the linked document", r.Schema, r.Table)
+	case len(r.ConcatField) > 0:
+		return errors.Errorf("link rule %s.%s can not have a concatField", r.Schema, r.Table)
+	}
+
+	switch r.WritePolicy {
+	case WritePolicyUpsert, WritePolicyNoDelete, WritePolicyUpdateOnly:
+	default:
+		return errors.Errorf("link rule %s.%s can not have write_policy %s", r.Schema, r.Table, r.WritePolicy)
+	}
+	return nil
+}
+
+// linkValue returns the value the row adds to the link field, nil if the column is NULL.
+func (r *River) linkValue(rule *Rule, row []interface{}) (interface{}, error) {
+	i := rule.TableInfo.FindColumn(rule.LinkValue)
+	if i < 0 || i >= len(row) {
+		return nil, errors.Errorf("link_value %s not found in %s.%s", rule.LinkValue, rule.Schema, rule.Table)
+	}
+	return r.makeReqColumnData(&rule.TableInfo.Columns[i], row[i]), nil
+}
+
+// makeLinkReq returns the request adding the value of the row to the link field of its document,
+// or removing it for a delete. A row with a NULL value links nothing.
+func (r *River) makeLinkReq(rule *Rule, action string, row []interface{}) (*elasticwrapper.BulkRequest, error) {
+	value, err := r.linkValue(rule, row)
+	if err != nil || value == nil {
+		return nil, errors.Trace(err)
+	}
+
+	req, err := r.newBulkRequest(rule, row)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// add_to_list and remove_from_list leave the other values, and fields, alone
+	req.ListRequest = true
+	req.ListKey = rule.LinkField
+	req.HardCrud = false
+	req.Data = map[string]interface{}{rule.LinkField: value}
+	if action == canal.DeleteAction {
+		req.Action = elasticwrapper.ActionDelete
+	} else {
+		req.Action = elasticwrapper.ActionUpdate
+		req.Initial = true
+	}
+	return req, nil
+}
+
+// makeLinkRequest turns the rows of a link table into link field updates. An insert adds the value
+// to the document, a delete removes it and an update changing the document or value moves it.
+// Adding a value twice or removing a missing one changes nothing, so replaying the binlog is harmless.
+func (r *River) makeLinkRequest(rule *Rule, action string, rows [][]interface{}) ([]*elasticwrapper.BulkRequest, error) {
+	step := 1
+	if action == canal.UpdateAction {
+		if len(rows)%2 != 0 {
+			return nil, errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(rows))
+		}
+		step = 2
+	}
+
+	reqs := make([]*elasticwrapper.BulkRequest, 0, len(rows))
+	add := func(action string, row []interface{}) error {
+		req, err := r.makeLinkReq(rule, action, row)
+		if req != nil {
+			reqs = append(reqs, req)
+		}
+		return errors.Trace(err)
+	}
+
+	for i := 0; i < len(rows); i += step {
+		switch action {
+		case canal.InsertAction:
+			r.st.InsertNum.Add(1)
+			if err := add(canal.InsertAction, rows[i]); err != nil {
+				return nil, err
+			}
+		case canal.DeleteAction:
+			if rule.IgnoreDeletes() {
+				continue
+			}
+			r.st.DeleteNum.Add(1)
+			if err := add(canal.DeleteAction, rows[i]); err != nil {
+				return nil, err
+			}
+		case canal.UpdateAction:
+			before, err := r.makeLinkReq(rule, canal.DeleteAction, rows[i])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			after, err := r.makeLinkReq(rule, canal.InsertAction, rows[i+1])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if before != nil && after != nil && before.ID == after.ID && before.Parent == after.Parent &&
+				reflect.DeepEqual(before.Data, after.Data) {
+				continue
+			}
+			r.st.UpdateNum.Add(1)
+			if before != nil && !rule.IgnoreDeletes() {
+				reqs = append(reqs, before)
+			}
+			if after != nil {
+				reqs = append(reqs, after)
+			}
+		default:
+			return nil, errors.Errorf("invalid rows action %s", action)
+		}
+	}
+
+	return reqs, nil
+}
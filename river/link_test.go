@@ -0,0 +1,85 @@
+package river
+
+import (
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/canal"
+	. "github.com/pingcap/check"
+)
+
+type linkTestSuite struct{}
+
+var _ = Suite(&linkTestSuite{})
+
+func (s *linkTestSuite) testRule(c *C) *Rule {
+	return newTestRule(c, "user_tags", []string{"id int(11)", "user_id int(11)", "tag_id int(11)"}, func(rule *Rule) {
+		rule.Index = "users"
+		rule.ID = []string{"user_id"}
+		rule.LinkField = "tags"
+		rule.LinkValue = "tag_id"
+	})
+}
+
+func (s *linkTestSuite) TestPrepare(c *C) {
+	rule := s.testRule(c)
+	c.Assert(rule.IsLink(), IsTrue)
+
+	rule.ID = nil
+	c.Assert(rule.prepare(), NotNil)
+
+	rule = s.testRule(c)
+	rule.WritePolicy = WritePolicyHard
+	c.Assert(rule.prepare(), NotNil)
+
+	rule = s.testRule(c)
+	rule.LinkField = ""
+	c.Assert(rule.prepare(), NotNil)
+}
+
+func (s *linkTestSuite) TestRequests(c *C) {
+	rule := s.testRule(c)
+	r := &River{st: &stat{}}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), int64(10), int64(7)}, {int64(2), int64(10), nil}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionUpdate)
+	c.Assert(reqs[0].ID, Equals, "10")
+	c.Assert(reqs[0].Index, Equals, "users")
+	c.Assert(reqs[0].ListRequest, IsTrue)
+	c.Assert(reqs[0].ListKey, Equals, "tags")
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"tags": int64(7)})
+
+	lines, err := reqs[0].Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines[1], Matches, `.*"id":"add_to_list_v2".*`)
+
+	reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{int64(1), int64(10), int64(7)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionDelete)
+	c.Assert(reqs[0].HardCrud, IsFalse)
+	lines, err = reqs[0].Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines[1], Matches, `.*"id":"remove_from_list_v2".*`)
+
+	// moved to another user
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), int64(10), int64(7)}, {int64(1), int64(11), int64(7)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 2)
+	c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionDelete)
+	c.Assert(reqs[0].ID, Equals, "10")
+	c.Assert(reqs[1].Action, Equals, elasticwrapper.ActionUpdate)
+	c.Assert(reqs[1].ID, Equals, "11")
+
+	// nothing linked changed
+	reqs, err = r.makeLinkRequest(rule, canal.UpdateAction, [][]interface{}{{int64(1), int64(10), int64(7)}, {int64(3), int64(10), int64(7)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 0)
+
+	// the old link stays without deletes
+	rule.WritePolicy = WritePolicyNoDelete
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), int64(10), int64(7)}, {int64(1), int64(10), int64(8)}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"tags": int64(8)})
+}
@@ -0,0 +1,84 @@
+package river
+
+import (
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/canal"
+	"github.com/jrots/go-mysql/mysql"
+	"github.com/jrots/go-mysql/replication"
+	. "github.com/pingcap/check"
+)
+
+type metaTestSuite struct{}
+
+var _ = Suite(&metaTestSuite{})
+
+func (s *metaTestSuite) testRule(c *C) *Rule {
+	return newTestRule(c, "t_0001", []string{"id int(11)", "name varchar(255)"}, func(rule *Rule) {
+		rule.Index = "t"
+		rule.Meta = MetaFields{SyncedAt: "_synced_at", BinlogFile: "_file", BinlogPos: "_pos", GTID: "_gtid",
+			Timestamp: "_event_at", Action: "_action", Table: "_table"}
+	})
+}
+
+func (s *metaTestSuite) TestBinlog(c *C) {
+	rule := s.testRule(c)
+	r := &River{st: &stat{}}
+
+	e := &canal.RowsEvent{
+		Table:    rule.TableInfo,
+		Action:   canal.UpdateAction,
+		Rows:     [][]interface{}{{int64(1), "a"}, {int64(1), "b"}},
+		Header:   &replication.EventHeader{Timestamp: 1500000000},
+		Position: mysql.Position{Name: "mysql-bin.000003", Pos: 1234},
+		GTID:     "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+	}
+	reqs, err := r.makeRowsRequest(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+
+	data := reqs[0].Data
+	c.Assert(data["name"], Equals, "b")
+	c.Assert(data["_file"], Equals, "mysql-bin.000003")
+	c.Assert(data["_pos"], Equals, uint32(1234))
+	c.Assert(data["_gtid"], Equals, "3e11fa47-71ca-11e1-9e33-c80aa9429562:23")
+	c.Assert(data["_event_at"], Equals, "2017-07-14T02:40:00Z")
+	c.Assert(data["_action"], Equals, canal.UpdateAction)
+	c.Assert(data["_table"], Equals, "t_0001")
+	c.Assert(data["_synced_at"], Matches, `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z`)
+	_, ok := data["_schema"]
+	c.Assert(ok, IsFalse)
+
+	// a soft delete would remove the fields it is given
+	e.Action = canal.DeleteAction
+	e.Rows = e.Rows[1:]
+	reqs, err = r.makeRowsRequest(rule, e)
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionDelete)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int64(1), "name": "b"})
+
+	e.Action = "truncate"
+	_, err = r.makeRowsRequest(rule, e)
+	c.Assert(err, NotNil)
+}
+
+func (s *metaTestSuite) TestDump(c *C) {
+	rule := s.testRule(c)
+	r := &River{st: &stat{}}
+
+	// rows from mysqldump or the snapshot have no binlog event
+	reqs, err := r.makeRowsRequest(rule, &canal.RowsEvent{Table: rule.TableInfo, Action: canal.InsertAction,
+		Rows: [][]interface{}{{int64(1), "a"}}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, HasLen, 5)
+	c.Assert(reqs[0].Data["_action"], Equals, canal.InsertAction)
+	c.Assert(reqs[0].Data["_table"], Equals, "t_0001")
+	_, ok := reqs[0].Data["_file"]
+	c.Assert(ok, IsFalse)
+
+	// no meta fields named, nothing added
+	rule.Meta = MetaFields{}
+	reqs, err = r.makeRowsRequest(rule, &canal.RowsEvent{Table: rule.TableInfo, Action: canal.InsertAction,
+		Rows: [][]interface{}{{int64(1), "a"}}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int64(1), "name": "a"})
+}
@@ -0,0 +1,80 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+// Null policies, they decide what a NULL column becomes in the document.
+const (
+	// the field is left alone, an insert doesn't write it and an update doesn't change it
+	NullPolicyOmit = "omit"
+	// the field is removed from the document
+	NullPolicyRemove = "remove"
+	// the field is stored as an explicit null
+	NullPolicyNull = "null"
+	// the null_defaults value of the column is stored instead
+	NullPolicyDefault = "default"
+)
+
+func (r *Rule) prepareNulls() error {
+	switch r.NullPolicy {
+	case "", NullPolicyOmit, NullPolicyRemove, NullPolicyNull:
+	case NullPolicyDefault:
+		return errors.Errorf("null_policy default of %s.%s needs a value per column, set null_defaults", r.Schema, r.Table)
+	default:
+		return errors.Errorf("invalid null_policy %s for %s.%s", r.NullPolicy, r.Schema, r.Table)
+	}
+
+	for column, policy := range r.NullFields {
+		switch policy {
+		case NullPolicyOmit, NullPolicyRemove, NullPolicyNull:
+			if _, ok := r.NullDefaults[column]; ok {
+				return errors.Errorf("column %s of %s.%s has null policy %s and a null_defaults value, set one of them",
+					column, r.Schema, r.Table, policy)
+			}
+		case NullPolicyDefault:
+			if _, ok := r.NullDefaults[column]; !ok {
+				return errors.Errorf("null policy default of column %s of %s.%s has no null_defaults value", column, r.Schema, r.Table)
+			}
+		default:
+			return errors.Errorf("invalid null policy %s of column %s of %s.%s", policy, column, r.Schema, r.Table)
+		}
+	}
+	return nil
+}
+
+// nullPolicy returns the policy of a NULL value of the column. Without any policy set an insert omits
+// the field and an update removes it.
+func (r *Rule) nullPolicy(column string, update bool) string {
+	if _, ok := r.NullDefaults[column]; ok {
+		return NullPolicyDefault
+	}
+
+	policy := r.NullFields[column]
+	if len(policy) == 0 {
+		policy = r.NullPolicy
+	}
+	if len(policy) == 0 {
+		if update {
+			return NullPolicyRemove
+		}
+		return NullPolicyOmit
+	}
+	return policy
+}
+
+// makeNullData applies the null policy of the column to the field of a NULL value.
+func (r *River) makeNullData(req *elasticwrapper.BulkRequest, rule *Rule, column string, field string, update bool) {
+	switch rule.nullPolicy(column, update) {
+	case NullPolicyRemove:
+		if req.DeleteFields == nil {
+			req.DeleteFields = make(map[string]interface{})
+		}
+		req.DeleteFields[field] = true
+	case NullPolicyNull:
+		req.Data[field] = nil
+	case NullPolicyDefault:
+		req.Data[field] = rule.NullDefaults[column]
+	}
+}
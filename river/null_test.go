@@ -0,0 +1,104 @@
+package river
+
+import (
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	. "github.com/pingcap/check"
+)
+
+type nullTestSuite struct{}
+
+var _ = Suite(&nullTestSuite{})
+
+func (s *nullTestSuite) testRule(c *C, policy string) *Rule {
+	columns := []string{"id int(11)", "name varchar(255)", "score int(11)", "email varchar(255)"}
+	return newTestRule(c, "users", columns, func(rule *Rule) {
+		rule.NullPolicy = policy
+		rule.NullFields = map[string]string{"email": NullPolicyOmit}
+		rule.NullDefaults = map[string]interface{}{"score": int64(0)}
+		rule.FieldMapping = map[string]string{"email": "mail"}
+	})
+}
+
+func (s *nullTestSuite) TestPrepare(c *C) {
+	rule := newDefaultRule("test", "users")
+	rule.NullPolicy = "zero"
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.NullPolicy = NullPolicyDefault
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.NullPolicy = ""
+	rule.NullFields = map[string]string{"score": NullPolicyDefault}
+	c.Assert(rule.prepare(), NotNil)
+
+	rule.NullDefaults = map[string]interface{}{"score": 0}
+	c.Assert(rule.prepare(), IsNil)
+
+	// a default doesn't silently override the policy of the column
+	rule.NullFields = map[string]string{"score": NullPolicyNull}
+	c.Assert(rule.prepare(), NotNil)
+}
+
+func (s *nullTestSuite) TestUnset(c *C) {
+	rule := newDefaultRule("test", "users")
+	c.Assert(rule.nullPolicy("name", false), Equals, NullPolicyOmit)
+	c.Assert(rule.nullPolicy("name", true), Equals, NullPolicyRemove)
+}
+
+func (s *nullTestSuite) TestPolicies(c *C) {
+	r := &River{st: &stat{}}
+	row := []interface{}{int64(1), nil, nil, nil}
+	before := []interface{}{int64(1), "a", int64(5), "a@b"}
+
+	for _, t := range []struct {
+		policy string
+		data   map[string]interface{}
+		remove map[string]interface{}
+	}{
+		{NullPolicyOmit, map[string]interface{}{"score": int64(0)}, nil},
+		{NullPolicyRemove, map[string]interface{}{"score": int64(0)}, map[string]interface{}{"name": true}},
+		{NullPolicyNull, map[string]interface{}{"name": nil, "score": int64(0)}, nil},
+	} {
+		rule := s.testRule(c, t.policy)
+
+		// the same fields for an insert, an update to NULL and a dump row
+		reqs, err := r.makeInsertRequest(rule, [][]interface{}{row})
+		c.Assert(err, IsNil)
+		data := map[string]interface{}{"id": int64(1)}
+		for k, v := range t.data {
+			data[k] = v
+		}
+		c.Assert(reqs[0].Data, DeepEquals, data, Commentf(t.policy))
+		c.Assert(len(reqs[0].DeleteFields), Equals, len(t.remove), Commentf(t.policy))
+
+		reqs, err = r.makeUpdateRequest(rule, [][]interface{}{before, row})
+		c.Assert(err, IsNil)
+		c.Assert(reqs[0].Data, DeepEquals, t.data, Commentf(t.policy))
+		if t.remove == nil {
+			c.Assert(reqs[0].DeleteFields, HasLen, 0, Commentf(t.policy))
+		} else {
+			c.Assert(reqs[0].DeleteFields, DeepEquals, t.remove, Commentf(t.policy))
+		}
+
+		// a delete removes every field the row wrote
+		reqs, err = r.makeDeleteRequest(rule, [][]interface{}{row})
+		c.Assert(err, IsNil)
+		c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionDelete)
+		c.Assert(reqs[0].Data, DeepEquals, data, Commentf(t.policy))
+		c.Assert(reqs[0].DeleteFields, IsNil)
+	}
+}
+
+func (s *nullTestSuite) TestRemoveOnInsert(c *C) {
+	rule := s.testRule(c, NullPolicyRemove)
+	r := &River{st: &stat{}}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), nil, int64(3), "a@b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].DeleteFields, DeepEquals, map[string]interface{}{"name": true})
+
+	// the upsert removes the field from an existing document
+	lines, err := reqs[0].Lines()
+	c.Assert(err, IsNil)
+	c.Assert(lines[1], Matches, `.*"remove":\["name"\].*`)
+}
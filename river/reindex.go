@@ -0,0 +1,277 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+// reindex builds a new index for the table of a rule whose index is an alias.
+// The binlog changes are written to the alias and to the new index while a backfill
+// loads the table into the new index. Once the backfill is synced, the alias is moved
+// to the new index in one step and the old index is deleted, unless it is kept.
+type reindex struct {
+	sync.Mutex
+
+	r    *River
+	rule *Rule
+
+	alias    string
+	oldIndex string
+	newIndex string
+	keepOld  bool
+
+	// requests for the alias are also written to the new index until the alias is moved
+	writeBoth bool
+	// set once the old index is deleted too, or the reindex failed
+	done  bool
+	state string
+}
+
+// StartReindex rebuilds the alias index of the table's rule into newIndex in the background.
+// The new index is created with the default settings if it doesn't exist, create it
+// before with the new mapping or analyzers. With keepOld the old index is left as is.
+func (r *River) StartReindex(schema string, table string, newIndex string, keepOld bool) error {
+	rule, ok := r.getRule(schema, table)
+	if !ok {
+		return errors.NewNotFound(nil, fmt.Sprintf("no rule for %s.%s", schema, table))
+	}
+
+	if len(rule.Sink) > 0 {
+		return errors.Errorf("rule %s.%s writes to sink %s, not Elasticsearch", schema, table, rule.Sink)
+	}
+
+	rx, err := newReindex(r, rule, newIndex)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rx.keepOld = keepOld
+
+	// the backfill writes the rows to the new index only
+	target := *rule
+	target.Index = newIndex
+	b, err := newBackfill(r, &target, nil, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	r.reindexLock.Lock()
+	defer r.reindexLock.Unlock()
+
+	if r.reindex != nil && !r.reindex.isDone() {
+		return errors.NewAlreadyExists(nil, fmt.Sprintf("reindex of %s into %s is still running", r.reindex.alias, r.reindex.newIndex))
+	}
+
+	for _, t := range r.targets.targets {
+		if err = t.client.EnsureIndex(newIndex); err != nil {
+			return errors.Annotatef(err, "es_target %s", t.name)
+		}
+	}
+
+	if err = r.setBackfill(b); err != nil {
+		return errors.Trace(err)
+	}
+
+	// write both indices before the backfill reads the first chunk
+	r.reindex = rx
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		log.Infof("reindex %s from %s into %s started", rx.alias, rx.oldIndex, rx.newIndex)
+		if err := rx.run(b); err != nil {
+			log.Errorf("reindex %s into %s err %v", rx.alias, rx.newIndex, err)
+			rx.finish("failed: " + err.Error())
+			return
+		}
+		log.Infof("reindex %s OK, alias moved from %s to %s", rx.alias, rx.oldIndex, rx.newIndex)
+		rx.finish("done")
+	}()
+	return nil
+}
+
+func newReindex(r *River, rule *Rule, newIndex string) (*reindex, error) {
+	if len(newIndex) == 0 {
+		return nil, errors.Errorf("empty new index for reindex")
+	}
+
+	// the alias must point to the same index in all targets
+	var oldIndex string
+	for _, t := range r.targets.targets {
+		indices, err := t.client.AliasIndices(rule.Index)
+		if err != nil {
+			return nil, errors.Annotatef(err, "es_target %s", t.name)
+		}
+		if len(indices) != 1 {
+			return nil, errors.Errorf("index %s of %s.%s must be an alias of one index for a reindex, but is an alias of %v in es_target %s",
+				rule.Index, rule.Schema, rule.Table, indices, t.name)
+		}
+		if len(oldIndex) > 0 && indices[0] != oldIndex {
+			return nil, errors.Errorf("alias %s points to %s in es_target %s, but to %s in es_target %s",
+				rule.Index, indices[0], t.name, oldIndex, r.targets.targets[0].name)
+		}
+		oldIndex = indices[0]
+	}
+	if oldIndex == newIndex {
+		return nil, errors.Errorf("alias %s already points to %s", rule.Index, newIndex)
+	}
+
+	return &reindex{
+		r:         r,
+		rule:      rule,
+		alias:     rule.Index,
+		oldIndex:  oldIndex,
+		newIndex:  newIndex,
+		writeBoth: true,
+		state:     "backfill",
+	}, nil
+}
+
+func (r *River) currentReindex() *reindex {
+	r.reindexLock.Lock()
+	defer r.reindexLock.Unlock()
+
+	return r.reindex
+}
+
+func (rx *reindex) run(b *backfill) error {
+	if err := rx.r.runBackfill(b); err != nil {
+		return errors.Trace(err)
+	}
+
+	rx.setState("catchup")
+
+	// the backfilled rows and the binlog changes read so far must be in the new index
+	// before the alias is moved
+	if err := rx.r.waitFlush(); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, t := range rx.r.targets.targets {
+		if err := t.client.SwapAlias(rx.alias, rx.oldIndex, rx.newIndex); err != nil {
+			return errors.Annotatef(err, "es_target %s", t.name)
+		}
+	}
+
+	// writes to the alias go to the new index now
+	rx.Lock()
+	rx.writeBoth = false
+	rx.Unlock()
+
+	if rx.keepOld {
+		return nil
+	}
+	rx.setState("retire")
+	for _, t := range rx.r.targets.targets {
+		if err := t.client.DeleteIndex(rx.oldIndex); err != nil {
+			return errors.Annotatef(err, "delete old index %s of es_target %s", rx.oldIndex, t.name)
+		}
+	}
+	log.Infof("reindex %s deleted old index %s", rx.alias, rx.oldIndex)
+	return nil
+}
+
+// dualWrite adds a copy for the new index of every request for the alias. A copy changing some fields
+// only updates a document the backfill wrote already, it would create a document with just those fields,
+// the backfill writes the whole row later.
+func (rx *reindex) dualWrite(rule *Rule, reqs []*elasticwrapper.BulkRequest) []*elasticwrapper.BulkRequest {
+	rx.Lock()
+	defer rx.Unlock()
+
+	if !rx.writeBoth || rule != rx.rule {
+		return reqs
+	}
+
+	n := len(reqs)
+	for i := 0; i < n; i++ {
+		if reqs[i].Index != rx.alias {
+			continue
+		}
+		req := *reqs[i]
+		req.Index = rx.newIndex
+		if !req.Initial && req.Action != elasticwrapper.ActionIndex && req.Action != elasticwrapper.ActionCreate {
+			req.UpdateOnly = true
+		}
+		reqs = append(reqs, &req)
+	}
+	return reqs
+}
+
+func (rx *reindex) setState(state string) {
+	rx.Lock()
+	defer rx.Unlock()
+
+	rx.state = state
+}
+
+func (rx *reindex) finish(state string) {
+	rx.Lock()
+	defer rx.Unlock()
+
+	rx.state = state
+	rx.writeBoth = false
+	rx.done = true
+}
+
+func (rx *reindex) isDone() bool {
+	rx.Lock()
+	defer rx.Unlock()
+
+	return rx.done
+}
+
+// Status writes the state of the reindex for the stat endpoint.
+func (rx *reindex) Status(buf *bytes.Buffer) {
+	rx.Lock()
+	defer rx.Unlock()
+
+	buf.WriteString(fmt.Sprintf("reindex:%s.%s alias:%s old:%s new:%s state:%s\n",
+		rx.rule.Schema, rx.rule.Table, rx.alias, rx.oldIndex, rx.newIndex, rx.state))
+}
+
+// reindexHandler starts a reindex, e.g. POST /reindex?table=test.users&index=users_v7&keep_old=true
+type reindexHandler struct {
+	r *River
+}
+
+func (h *reindexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	seps := strings.Split(req.FormValue("table"), ".")
+	if len(seps) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("table must be schema.table"))
+		return
+	}
+
+	var keepOld bool
+	if s := req.FormValue("keep_old"); len(s) > 0 {
+		var err error
+		if keepOld, err = strconv.ParseBool(s); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("invalid keep_old %s", s)))
+			return
+		}
+	}
+
+	index := req.FormValue("index")
+	if err := h.r.StartReindex(seps[0], seps[1], index, keepOld); err != nil {
+		w.WriteHeader(startStatus(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf("reindex of %s.%s into %s started\n", seps[0], seps[1], index)))
+}
@@ -0,0 +1,68 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/pingcap/check"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+type reindexTestSuite struct{}
+
+var _ = Suite(&reindexTestSuite{})
+
+func (s *reindexTestSuite) TestDualWrite(c *C) {
+	rule := newDefaultRule("test", "users")
+	rule.Index = "users"
+
+	rx := &reindex{rule: rule, alias: "users", oldIndex: "users_v6", newIndex: "users_v7", writeBoth: true}
+
+	reqs := []*elasticwrapper.BulkRequest{
+		{Action: elasticwrapper.ActionUpdate, Index: "users", ID: "1"},
+		{Action: elasticwrapper.ActionIndex, Index: "users_audit", ID: "bin.000001:4:0"},
+		{Action: elasticwrapper.ActionUpdate, Index: "users", ID: "2", Initial: true},
+	}
+
+	reqs = rx.dualWrite(rule, reqs)
+	c.Assert(reqs, HasLen, 5)
+	c.Assert(reqs[0].Index, Equals, "users")
+	c.Assert(reqs[0].UpdateOnly, IsFalse)
+	c.Assert(reqs[3].Index, Equals, "users_v7")
+	c.Assert(reqs[3].ID, Equals, "1")
+	// the update of some fields doesn't create a partial document, the insert does create it
+	c.Assert(reqs[3].UpdateOnly, IsTrue)
+	c.Assert(reqs[4].ID, Equals, "2")
+	c.Assert(reqs[4].UpdateOnly, IsFalse)
+
+	// other rules are not touched
+	c.Assert(rx.dualWrite(newDefaultRule("test", "users"), reqs[:1]), HasLen, 1)
+
+	// the alias is moved but the old index is still deleted
+	rx.writeBoth = false
+	c.Assert(rx.isDone(), IsFalse)
+
+	rx.finish("done")
+	c.Assert(rx.isDone(), IsTrue)
+	c.Assert(rx.dualWrite(rule, reqs[:1]), HasLen, 1)
+}
+
+func (s *reindexTestSuite) TestHandler(c *C) {
+	r := &River{c: &Config{}, rules: map[string]*Rule{}}
+	h := &reindexHandler{r: r}
+
+	for query, status := range map[string]int{
+		"table=test.users&index=users_v7":             http.StatusNotFound,
+		"table=test.users&index=users_v7&keep_old=no": http.StatusBadRequest,
+		"table=users&index=users_v7":                  http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reindex?"+query, nil))
+		c.Assert(w.Code, Equals, status, Commentf(query))
+	}
+
+	// disabled without an admin token
+	w := httptest.NewRecorder()
+	(&adminHandler{h: h}).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reindex?table=test.users&index=users_v7", nil))
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+}
@@ -2,13 +2,18 @@ package river
 
 import (
 	"fmt"
-	"regexp"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
 	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql-elasticsearch/sink"
 	"github.com/jrots/go-mysql/canal"
+	"github.com/jrots/go-mysql/client"
+	"github.com/jrots/go-mysql/mysql"
 	"golang.org/x/net/context"
 )
 
@@ -21,19 +26,39 @@ type River struct {
 	canal *canal.Canal
 
 	rules map[string]*Rule
+	// guards rules, the sync adds the rules of the schemas created later
+	rulesLock sync.RWMutex
+	// the rules of wildcard schemas by wildcard, and the tables of the binlog found without a rule
+	wildRules map[string]*Rule
+	noRules   map[string]bool
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
 	wg sync.WaitGroup
 
-	es *elasticwrapper.Client
+	// es is the first of the targets, for requests which are not bulk writes
+	es      *elasticwrapper.Client
+	targets *esTargets
+
+	// sinks by name, Elasticsearch is the empty name
+	sinks map[string]sink.Sink
 
 	st *stat
 
 	master *masterInfo
 
+	snapshotProgress *snapshotProgress
+
+	backfillLock sync.Mutex
+	backfill     *backfill
+
+	reindexLock sync.Mutex
+	reindex     *reindex
+
 	syncCh chan interface{}
+
+	dryRunOut *os.File
 }
 
 func NewRiver(c *Config) (*River, error) {
@@ -41,6 +66,11 @@ func NewRiver(c *Config) (*River, error) {
 
 	r.c = c
 	r.rules = make(map[string]*Rule)
+	r.wildRules = make(map[string]*Rule)
+	r.noRules = make(map[string]bool)
+	if len(c.SnapshotMode) > 0 && c.SnapshotMode != SnapshotModeMysqldump && c.SnapshotMode != SnapshotModeNative {
+		return nil, errors.Errorf("invalid snapshot_mode %s", c.SnapshotMode)
+	}
 	r.syncCh = make(chan interface{}, 4096)
 	r.ctx, r.cancel = context.WithCancel(context.Background())
 
@@ -49,6 +79,26 @@ func NewRiver(c *Config) (*River, error) {
 		return nil, errors.Trace(err)
 	}
 
+	snapshotDir := c.DataDir
+	if len(c.DryRun) > 0 {
+		// a dry run never changes the saved state
+		r.master.filePath = ""
+		snapshotDir = ""
+
+		if len(c.DryRunPos) > 0 {
+			pos, err := parsePosition(c.DryRunPos)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			r.master.Name = pos.Name
+			r.master.Pos = pos.Pos
+		}
+	}
+
+	if r.snapshotProgress, err = loadSnapshotProgress(snapshotDir); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	if err = r.newCanal(); err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -66,13 +116,52 @@ func NewRiver(c *Config) (*River, error) {
 		return nil, errors.Trace(err)
 	}
 
-	cfg := new(elasticwrapper.ClientConfig)
-	cfg.Addr = r.c.ESAddr
-	cfg.User = r.c.ESUser
-	cfg.Password = r.c.ESPassword
-	r.es = elasticwrapper.NewClient(cfg)
+	var cfg elasticwrapper.ClientConfig
+	cfg.Bulk = elasticwrapper.BulkConfig{
+		Actions:       r.c.BulkSize,
+		FlushInterval: r.c.FlushBulkTime.Duration,
+		Adaptive:      r.c.AdaptiveBulk,
+		MinActions:    r.c.BulkMinSize,
+		MaxActions:    r.c.BulkMaxSize,
+		TargetLatency: r.c.BulkTargetLatency.Duration,
+	}
+	if len(r.c.DryRun) > 0 {
+		if r.c.DryRun == "-" {
+			r.dryRunOut = os.Stdout
+		} else if r.dryRunOut, err = os.OpenFile(r.c.DryRun, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg.DryRun = r.dryRunOut
+	}
+	if len(r.c.ESVersion) > 0 {
+		version, err := elasticwrapper.NewVersion(r.c.ESVersion, r.c.ESDistribution)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg.Version = &version
+	}
+	if r.targets, err = r.newESTargets(cfg); err != nil {
+		return nil, errors.Trace(err)
+	}
+	r.es = r.targets.primary()
+
+	if err = r.targets.checkVersions(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err = r.targets.putScripts(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err = r.prepareTypes(); err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	r.st = &stat{r: r}
+
+	if err = r.newSinks(); err != nil {
+		return nil, errors.Trace(err)
+	}
 	go r.st.Run(r.c.StatAddr)
 
 	return r, nil
@@ -90,10 +179,20 @@ func (r *River) newCanal() error {
 
 	cfg.ServerID = r.c.ServerID
 	cfg.Dump.ExecutionPath = r.c.DumpExec
+	if r.c.SnapshotMode == SnapshotModeNative {
+		// the river reads the tables itself, see snapshot
+		cfg.Dump.ExecutionPath = ""
+	}
 	cfg.Dump.DiscardErr = false
 	cfg.Dump.SkipMasterData = r.c.SkipMasterData
+	cfg.Dump.ExtraArgs = r.mysqldumpTLSArgs()
 
 	var err error
+	if cfg.TLSConfig, err = r.mysqlTLS(); err != nil {
+		return errors.Trace(err)
+	}
+	cfg.TLSPreferred = r.c.MyTLSMode == MySQLTLSPreferred
+
 	r.canal, err = canal.NewCanal(cfg)
 	return errors.Trace(err)
 }
@@ -142,41 +241,45 @@ func (r *River) parseSource() (map[string][]string, error) {
 
 	// first, check sources
 	for _, s := range r.c.Sources {
-		for _, table := range s.Tables {
-			if len(s.Schema) == 0 {
-				return nil, errors.Errorf("empty schema not allowed for source")
-			}
+		if len(s.Schema) == 0 {
+			return nil, errors.Errorf("empty schema not allowed for source")
+		}
 
-			if regexp.QuoteMeta(table) != table {
+		for _, table := range s.Tables {
+			if isWildcard(s.Schema) || isWildcard(table) {
 				if _, ok := wildTables[ruleKey(s.Schema, table)]; ok {
 					return nil, errors.Errorf("duplicate wildcard table defined for %s.%s", s.Schema, table)
 				}
+				wildTables[ruleKey(s.Schema, table)] = []string{}
+			}
+		}
 
-				tables := []string{}
-
-				sql := fmt.Sprintf(`SELECT table_name FROM information_schema.tables WHERE
-                    table_name RLIKE "%s" AND table_schema = "%s";`, table, s.Schema)
+		schemas := []string{s.Schema}
+		if isWildcard(s.Schema) {
+			var err error
+			if schemas, err = r.matchSchemas(s.Schema, ""); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
 
-				res, err := r.canal.Execute(sql)
+		for _, schema := range schemas {
+			for _, table := range s.Tables {
+				tables, err := r.sourceTables(schema, table, isWildcard(s.Schema))
 				if err != nil {
 					return nil, errors.Trace(err)
 				}
 
-				for i := 0; i < res.Resultset.RowNumber(); i++ {
-					f, _ := res.GetString(i, 0)
-					err := r.newRule(s.Schema, f)
-					if err != nil {
+				for _, f := range tables {
+					if err = r.newRule(schema, f); err != nil {
 						return nil, errors.Trace(err)
 					}
-
-					tables = append(tables, f)
 				}
 
-				wildTables[ruleKey(s.Schema, table)] = tables
-			} else {
-				err := r.newRule(s.Schema, table)
-				if err != nil {
-					return nil, errors.Trace(err)
+				if keys, ok := wildTables[ruleKey(s.Schema, table)]; ok {
+					for _, f := range tables {
+						keys = append(keys, ruleKey(schema, f))
+					}
+					wildTables[ruleKey(s.Schema, table)] = keys
 				}
 			}
 		}
@@ -202,52 +305,223 @@ func (r *River) prepareRule() error {
 				return errors.Errorf("empty schema not allowed for rule")
 			}
 
-			if regexp.QuoteMeta(rule.Table) != rule.Table {
-				//wildcard table
-				tables, ok := wildtables[ruleKey(rule.Schema, rule.Table)]
+			if isWildcard(rule.Schema) || isWildcard(rule.Table) {
+				//wildcard schema or table
+				keys, ok := wildtables[ruleKey(rule.Schema, rule.Table)]
 				if !ok {
 					return errors.Errorf("wildcard table for %s.%s is not defined in source", rule.Schema, rule.Table)
 				}
 
-				if len(rule.Index) == 0 {
+				if isWildcard(rule.Table) && len(rule.Index) == 0 {
 					return errors.Errorf("wildcard table rule %s.%s must have a index, can not empty", rule.Schema, rule.Table)
 				}
 
-				rule.prepare()
+				if err = rule.prepare(); err != nil {
+					return errors.Trace(err)
+				}
+
+				if isWildcard(rule.Schema) {
+					// for the schemas created later
+					r.wildRules[ruleKey(rule.Schema, rule.Table)] = rule
+				}
 
-				for _, table := range tables {
-					rr := r.rules[ruleKey(rule.Schema, table)]
-					rr.Index = rule.Index
-					rr.Type = rule.Type
-					rr.Parent = rule.Parent
-					rr.ID = rule.ID
-					rr.FieldMapping = rule.FieldMapping
+				for _, key := range keys {
+					rr := r.rules[key]
+					r.rules[key] = wildcardRule(rule, rr.Schema, rr.Table)
 				}
 			} else {
 				key := ruleKey(rule.Schema, rule.Table)
 				if _, ok := r.rules[key]; !ok {
 					return errors.Errorf("rule %s, %s not defined in source", rule.Schema, rule.Table)
 				}
-				rule.prepare()
+				if err = rule.prepare(); err != nil {
+					return errors.Trace(err)
+				}
 				r.rules[key] = rule
 			}
 		}
 	}
 
+	// the tables of all tenants would end up in the same documents of the default rule
+	for _, s := range r.c.Sources {
+		if !isWildcard(s.Schema) {
+			continue
+		}
+		for _, table := range s.Tables {
+			if _, ok := r.wildRules[ruleKey(s.Schema, table)]; !ok {
+				return errors.Errorf("wildcard schema %s.%s must have a rule", s.Schema, table)
+			}
+		}
+	}
+
 	for _, rule := range r.rules {
-		if rule.TableInfo, err = r.canal.GetTable(rule.Schema, rule.Table); err != nil {
+		if err = r.prepareTable(rule); err != nil {
 			return errors.Trace(err)
 		}
+	}
+
+	return r.prepareCascades()
+}
+
+// prepareTable loads the table of the rule and checks the columns the rule needs.
+func (r *River) prepareTable(rule *Rule) error {
+	var err error
+	if rule.TableInfo, err = r.canal.GetTable(rule.Schema, rule.Table); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(rule.TableInfo.PKColumns) == 0 {
+		return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
+	}
+
+	if rule.IsLink() && rule.TableInfo.FindColumn(rule.LinkValue) < 0 {
+		return errors.Errorf("link_value %s is no column of %s.%s", rule.LinkValue, rule.Schema, rule.Table)
+	}
+	for _, agg := range rule.Aggregates {
+		if len(agg.Column) > 0 && rule.TableInfo.FindColumn(agg.Column) < 0 {
+			return errors.Errorf("aggregate column %s is no column of %s.%s", agg.Column, rule.Schema, rule.Table)
+		}
+	}
+	for _, jc := range rule.JSON {
+		if rule.TableInfo.FindColumn(jc.Column) < 0 {
+			return errors.Errorf("json column %s is no column of %s.%s", jc.Column, rule.Schema, rule.Table)
+		}
+	}
+	return nil
+}
+
+// prepareTypes drops the document types of the rules for a typeless cluster.
+// A configured type is ignored with a warning where types are deprecated,
+// and rejected where they are not supported anymore.
+func (r *River) prepareTypes() error {
+	version := r.es.Version()
+	if !version.Typeless() {
+		return nil
+	}
 
-		if len(rule.TableInfo.PKColumns) == 0 {
-			return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
+	for _, rules := range []map[string]*Rule{r.rules, r.wildRules} {
+		for _, rule := range rules {
+			if rule.typeSet {
+				if version.RejectsTypes() {
+					return errors.Errorf("%s doesn't support types, remove type and audit_type of rule %s.%s",
+						version, rule.Schema, rule.Table)
+				}
+				log.Warnf("%s has no types, type %s of rule %s.%s is ignored", version, rule.Type, rule.Schema, rule.Table)
+			}
+			rule.Type = ""
+			rule.AuditType = ""
 		}
+	}
+	return nil
+}
 
+// newSinks creates the sinks of the config and checks the sink of every rule exists.
+// In dry run mode all sinks write to the dry run output.
+func (r *River) newSinks() error {
+	r.sinks = map[string]sink.Sink{"": r.targets}
+	r.st.sinks = map[string]*sinkStat{"": new(sinkStat)}
+
+	for _, cfg := range r.c.Sinks {
+		if len(cfg.Name) == 0 {
+			return errors.Errorf("empty sink name not allowed")
+		}
+		if _, ok := r.sinks[cfg.Name]; ok || cfg.Name == sink.TypeElasticsearch {
+			return errors.Errorf("duplicate sink %s", cfg.Name)
+		}
+
+		var s sink.Sink
+		switch {
+		case len(r.c.DryRun) > 0:
+			s = r.targets
+		case cfg.Type == sink.TypeFile:
+			f, err := sink.NewFile(cfg.Path)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			s = f
+		case cfg.Type == sink.TypeWebhook:
+			if len(cfg.URL) == 0 {
+				return errors.Errorf("webhook sink %s must have an url", cfg.Name)
+			}
+			s = sink.NewWebhook(cfg.URL, cfg.Headers, cfg.Timeout.Duration)
+		default:
+			return errors.Errorf("invalid type %s of sink %s", cfg.Type, cfg.Name)
+		}
+
+		r.sinks[cfg.Name] = s
+		r.st.sinks[cfg.Name] = new(sinkStat)
+	}
+
+	// the wildcard rules are the templates of the tables created later
+	for _, rules := range []map[string]*Rule{r.rules, r.wildRules} {
+		for _, rule := range rules {
+			if rule.Sink == sink.TypeElasticsearch {
+				rule.Sink = ""
+			}
+			if _, ok := r.sinks[rule.Sink]; !ok {
+				return errors.Errorf("sink %s of rule %s.%s not defined", rule.Sink, rule.Schema, rule.Table)
+			}
+		}
+	}
+
+	for name, s := range r.sinks {
+		if s == sink.Sink(r.targets) && len(name) > 0 {
+			// dry run
+			continue
+		}
+		s.SetAckHandler(r.st.sinks[name].ack(name))
 	}
+	return nil
+}
 
+// flushSinks sends the requests queued in all sinks and waits for them.
+func (r *River) flushSinks() error {
+	for name, s := range r.sinks {
+		if err := s.Flush(); err != nil {
+			return errors.Errorf("flush sink %s err %v", sinkName(name), err)
+		}
+	}
 	return nil
 }
 
+func sinkName(name string) string {
+	if len(name) == 0 {
+		return sink.TypeElasticsearch
+	}
+	return name
+}
+
+// connectMySQL opens a new connection to MySQL, besides the canal one.
+func (r *River) connectMySQL() (*client.Conn, error) {
+	tlsConfig, err := r.mysqlTLS()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn, err := client.Connect(r.c.MyAddr, r.c.MyUser, r.c.MyPassword, "", func(c *client.Conn) {
+		c.TLSConfig = tlsConfig
+		c.TLSPreferred = r.c.MyTLSMode == MySQLTLSPreferred
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(r.c.MyCharset) > 0 {
+		if err = conn.SetCharset(r.c.MyCharset); err != nil {
+			conn.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	return conn, nil
+}
+
+func (r *River) snapshotChunkSize() int {
+	if r.c.SnapshotChunkSize > 0 {
+		return r.c.SnapshotChunkSize
+	}
+	return 1000
+}
+
 func ruleKey(schema string, table string) string {
 	return fmt.Sprintf("%s:%s", schema, table)
 }
@@ -257,6 +531,16 @@ func (r *River) Start() error {
 	go r.syncLoop()
 
 	pos := r.master.Position()
+	if r.c.SnapshotMode == SnapshotModeNative && (len(pos.Name) == 0 || pos.Pos == 0) {
+		if !r.snapshotProgress.IsDone() {
+			r.wg.Add(1)
+			go r.snapshotAndStart()
+			return nil
+		}
+		// snapshot finished, but no binlog position saved yet
+		pos = r.snapshotProgress.Position()
+	}
+
 	if err := r.canal.StartFrom(pos); err != nil {
 		log.Errorf("start canal err %v", err)
 		return errors.Trace(err)
@@ -265,6 +549,29 @@ func (r *River) Start() error {
 	return nil
 }
 
+// snapshotAndStart runs the native snapshot and starts syncing the binlog from the snapshot position.
+func (r *River) snapshotAndStart() {
+	defer r.wg.Done()
+
+	pos, err := newSnapshot(r).Run()
+	if err != nil {
+		log.Errorf("snapshot err %v, close sync", err)
+		r.cancel()
+		return
+	}
+
+	select {
+	case r.syncCh <- posSaver{pos, true}:
+	case <-r.ctx.Done():
+		return
+	}
+
+	if err = r.canal.StartFrom(pos); err != nil {
+		log.Errorf("start canal err %v", err)
+		r.cancel()
+	}
+}
+
 func (r *River) Ctx() context.Context {
 	return r.ctx
 }
@@ -272,7 +579,9 @@ func (r *River) Ctx() context.Context {
 func (r *River) Close() {
 	log.Infof("closing river")
 
-	r.es.BulkProcessor.Close()
+	for _, s := range r.sinks {
+		s.Close()
+	}
 
 	r.cancel()
 
@@ -281,4 +590,22 @@ func (r *River) Close() {
 	r.master.Close()
 
 	r.wg.Wait()
+
+	if r.dryRunOut != nil && r.dryRunOut != os.Stdout {
+		r.dryRunOut.Close()
+	}
+}
+
+// parsePosition parses a binlog position like mysql-bin.000001:4
+func parsePosition(s string) (mysql.Position, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return mysql.Position{}, errors.Errorf("invalid binlog position %s, must be file:pos", s)
+	}
+
+	pos, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil {
+		return mysql.Position{}, errors.Errorf("invalid binlog position %s, must be file:pos", s)
+	}
+	return mysql.Position{Name: s[:i], Pos: uint32(pos)}, nil
 }
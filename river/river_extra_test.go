@@ -5,11 +5,30 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/jrots/go-mysql/schema"
 	. "github.com/pingcap/check"
 )
 
+// newTestRule returns the prepared default rule of test.<table>, the columns are given as "name type"
+// with the PK first and set changes the rule before it is prepared.
+func newTestRule(c *C, table string, columns []string, set func(rule *Rule)) *Rule {
+	t := &schema.Table{Schema: "test", Name: table}
+	for _, column := range columns {
+		f := strings.SplitN(column, " ", 2)
+		t.AddColumn(f[0], f[1], "")
+	}
+	t.PKColumns = []int{0}
+
+	rule := newDefaultRule("test", table)
+	rule.TableInfo = t
+	set(rule)
+	c.Assert(rule.prepare(), IsNil)
+	return rule
+}
+
 func (s *riverTestSuite) setupExtra(c *C) (r *River) {
 	var err error
 
@@ -8,7 +8,7 @@ import (
 	"time"
 
 	. "github.com/pingcap/check"
-	"github.com/jrots/go-mysql-elasticsearch/elastic"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
 	"github.com/jrots/go-mysql/client"
 )
 
@@ -216,7 +216,7 @@ func (s *riverTestSuite) testPrepareData(c *C) {
 	}
 }
 
-func (s *riverTestSuite) testElasticGet(c *C, id string) *elastic.Response {
+func (s *riverTestSuite) testElasticGet(c *C, id string) *elasticwrapper.Response {
 	index := "river"
 	docType := "river"
 
@@ -250,7 +250,7 @@ func (s *riverTestSuite) TestRiver(c *C) {
 
 	testWaitSyncDone(c, s.r)
 
-	var r *elastic.Response
+	var r *elasticwrapper.Response
 	r = s.testElasticGet(c, "1")
 	c.Assert(r.Found, Equals, true)
 	c.Assert(r.Source["tenum"], Equals, "e1")
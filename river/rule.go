@@ -1,9 +1,26 @@
 package river
 
 import (
+	"github.com/juju/errors"
 	"github.com/jrots/go-mysql/schema"
 )
 
+// Write policies, they decide which bulk action a row change is turned into.
+const (
+	// partial upserts, a delete removes the synced fields from the document (default)
+	WritePolicyUpsert = "upsert"
+	// one on one mapping, insert indexes the whole document and delete removes it (same as hardcrud = true)
+	WritePolicyHard = "hard"
+	// like upsert, but deletes are ignored so documents stay searchable (archival search)
+	WritePolicyNoDelete = "no_delete"
+	// alias of no_delete
+	WritePolicyAppendOnly = "append_only"
+	// documents are only created, an existing document is never overwritten
+	WritePolicyCreateOnly = "create_only"
+	// documents are only updated, a missing document is never created
+	WritePolicyUpdateOnly = "update_only"
+)
+
 // If you want to sync MySQL data into elasticsearch, you must set a rule to let use know how to do it.
 // The mapping rule may thi: schema + table <-> index + document type.
 // schema and table is for MySQL, index and document type is for Elasticsearch.
@@ -16,12 +33,51 @@ type Rule struct {
 	JoinField string  `toml:"joinfield"`
 	JoinFieldName string  `toml:"joinfieldname"`
 	IdPrefix string `toml:"idprefix"`
-	HardCrud bool `toml:hardcrud` // one on one mapping of mysql to elastic (delete in mysql == delete in in elastic), by default ==> delete == delete of fields in elastic (not the whole document)
+	HardCrud bool `toml:"hardcrud"` // one on one mapping of mysql to elastic (delete in mysql == delete in in elastic), by default ==> delete == delete of fields in elastic (not the whole document)
+	// upsert, hard, no_delete (append_only), create_only or update_only, defaults to hard when HardCrud is set, else upsert
+	WritePolicy string `toml:"write_policy"`
+
+	// Every binlog row event is also written as its own document to AuditIndex (change audit trail)
+	AuditIndex string `toml:"audit_index"`
+	AuditType  string `toml:"audit_type"`
+	// Only write the audit documents, leave the rule's own index untouched
+	AuditOnly bool `toml:"audit_only"`
+
+	// name of the sink the documents are written to, Elasticsearch if empty
+	Sink string `toml:"sink"`
 
 	ConcatPrefix string `toml:"concatPrefix"`
 	ConcatFields []string `toml:"concatFields"`
 	ConcatField string `toml:"concatField"`
 
+	// Link table rules: the link_value column of every row is an element of the link_field array
+	// of the document the id columns point to, e.g. tag_id in tags of the user_id document
+	LinkField string `toml:"link_field"`
+	LinkValue string `toml:"link_value"`
+
+	// Aggregate rules keep values computed from the rows on the document the id columns point to,
+	// e.g. comment_count of a post
+	Aggregates []*Aggregate `toml:"aggregate"`
+
+	// what a NULL column becomes in the document: omit, remove or null, per column in null_fields,
+	// null_defaults stores a value instead. Unset, an insert omits the field and an update removes it.
+	NullPolicy   string                 `toml:"null_policy"`
+	NullFields   map[string]string      `toml:"null_fields"`
+	NullDefaults map[string]interface{} `toml:"null_defaults"`
+
+	// names of the metadata fields added to the documents, a field is only added if it is named
+	Meta MetaFields `toml:"meta"`
+
+	// JSON columns whose paths are extracted into fields of their own, or flattened
+	JSON []*JSONColumn `toml:"json"`
+
+	// field the schema name of the row is written to, e.g. the tenant of a wildcard schema
+	SchemaField string `toml:"schema_field"`
+
+	// schema.table of the child rules whose documents are deleted with the parent document
+	Cascade []string `toml:"cascade"`
+	cascadeRules []*Rule
+
 	ID []string `toml:"id"`
 
 	// Default, a MySQL table field name is mapped to Elasticsearch field name.
@@ -32,6 +88,9 @@ type Rule struct {
 	// MySQL table information
 	TableInfo *schema.Table
 
+	// set if the type is configured, not defaulted
+	typeSet bool
+
 	//only MySQL fields in fileter will be synced , default sync all fields
 	Fileter []string `toml:"filter"`
 }
@@ -43,6 +102,7 @@ func newDefaultRule(schema string, table string) *Rule {
 	r.Table = table
 	r.Index = table
 	r.Type = table
+	r.WritePolicy = WritePolicyUpsert
 	r.FieldMapping = make(map[string]string)
 
 	return r
@@ -57,11 +117,72 @@ func (r *Rule) prepare() error {
 		r.Index = r.Table
 	}
 
+	r.typeSet = len(r.Type) > 0 || len(r.AuditType) > 0
 	if len(r.Type) == 0 {
 		r.Type = r.Index
 	}
 
-	return nil
+	if len(r.AuditIndex) > 0 && len(r.AuditType) == 0 {
+		r.AuditType = r.AuditIndex
+	} else if r.AuditOnly && len(r.AuditIndex) == 0 {
+		return errors.Errorf("audit_only needs an audit_index for %s.%s", r.Schema, r.Table)
+	}
+
+	switch r.WritePolicy {
+	case "":
+		if r.HardCrud {
+			r.WritePolicy = WritePolicyHard
+		} else {
+			r.WritePolicy = WritePolicyUpsert
+		}
+	case WritePolicyAppendOnly:
+		r.WritePolicy = WritePolicyNoDelete
+	case WritePolicyUpsert, WritePolicyHard, WritePolicyNoDelete, WritePolicyCreateOnly, WritePolicyUpdateOnly:
+	default:
+		return errors.Errorf("invalid write_policy %s for %s.%s", r.WritePolicy, r.Schema, r.Table)
+	}
+
+	if r.HardCrud && r.WritePolicy != WritePolicyHard {
+		return errors.Errorf("hardcrud can not be combined with write_policy %s for %s.%s", r.WritePolicy, r.Schema, r.Table)
+	}
+	r.HardCrud = r.WritePolicy == WritePolicyHard
+
+	if err := r.prepareLink(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := r.prepareJSON(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := r.prepareNulls(); err != nil {
+		return errors.Trace(err)
+	}
+	return r.prepareAggregates()
+}
+
+// MetaFields are the names of the metadata fields about the change a document was written for.
+type MetaFields struct {
+	// the time the river made the request
+	SyncedAt string `toml:"synced_at"`
+	// binlog file and end position of the rows event
+	BinlogFile string `toml:"binlog_file"`
+	BinlogPos  string `toml:"binlog_pos"`
+	GTID       string `toml:"gtid"`
+	// the time of the rows event in MySQL
+	Timestamp string `toml:"timestamp"`
+	// insert, update or delete
+	Action string `toml:"action"`
+	// the source table, e.g. of a wildcard table
+	Schema string `toml:"schema"`
+	Table  string `toml:"table"`
+}
+
+func (m MetaFields) enabled() bool {
+	return m != MetaFields{}
+}
+
+// IgnoreDeletes reports whether deleted rows leave the document untouched.
+func (r *Rule) IgnoreDeletes() bool {
+	return r.WritePolicy == WritePolicyNoDelete || r.WritePolicy == WritePolicyCreateOnly
 }
 
 func (r *Rule) CheckFilter(field string) bool {
@@ -0,0 +1,213 @@
+package river
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+// isWildcard reports whether the schema or table name of a source is a regular expression.
+func isWildcard(name string) bool {
+	return regexp.QuoteMeta(name) != name
+}
+
+// expandTemplate replaces {schema} and {table} with the names of a table a wildcard matched.
+func expandTemplate(s string, schema string, table string) string {
+	return strings.NewReplacer("{schema}", schema, "{table}", table).Replace(s)
+}
+
+// wildcardRule returns the rule of a table a wildcard rule matched, it has all settings of the wildcard rule
+// with {schema} and {table} of the index, type, audit index, id prefix and cascade rules replaced.
+func wildcardRule(rule *Rule, schema string, table string) *Rule {
+	rr := *rule
+	rr.Schema = schema
+	rr.Table = table
+	rr.Index = expandTemplate(rule.Index, schema, table)
+	rr.Type = expandTemplate(rule.Type, schema, table)
+	rr.AuditIndex = expandTemplate(rule.AuditIndex, schema, table)
+	rr.AuditType = expandTemplate(rule.AuditType, schema, table)
+	rr.IdPrefix = expandTemplate(rule.IdPrefix, schema, table)
+	rr.Cascade = make([]string, 0, len(rule.Cascade))
+	for _, key := range rule.Cascade {
+		rr.Cascade = append(rr.Cascade, expandTemplate(key, schema, table))
+	}
+	rr.cascadeRules = nil
+	rr.TableInfo = nil
+	return &rr
+}
+
+// matchSchemas returns the schemas matching the wildcard, only schema itself if it is set.
+func (r *River) matchSchemas(wildcard string, schema string) ([]string, error) {
+	sql := fmt.Sprintf(`SELECT schema_name FROM information_schema.schemata WHERE schema_name RLIKE "%s"`, wildcard)
+	if len(schema) > 0 {
+		sql += fmt.Sprintf(` AND schema_name = "%s"`, schema)
+	}
+
+	res, err := r.canal.Execute(sql)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	schemas := make([]string, 0, res.Resultset.RowNumber())
+	for i := 0; i < res.Resultset.RowNumber(); i++ {
+		name, _ := res.GetString(i, 0)
+		schemas = append(schemas, name)
+	}
+	return schemas, nil
+}
+
+// sourceTables returns the tables of schema a source table stands for. A wildcard table is matched
+// against the tables of the schema, a table name too if the schema was matched by a wildcard, tenant
+// databases may not have all tables yet.
+func (r *River) sourceTables(schema string, table string, matched bool) ([]string, error) {
+	if !isWildcard(table) && !matched {
+		return []string{table}, nil
+	}
+
+	cond := fmt.Sprintf(`table_name = "%s"`, table)
+	if isWildcard(table) {
+		cond = fmt.Sprintf(`table_name RLIKE "%s"`, table)
+	}
+	sql := fmt.Sprintf(`SELECT table_name FROM information_schema.tables WHERE
+                    %s AND table_schema = "%s";`, cond, schema)
+
+	res, err := r.canal.Execute(sql)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tables := make([]string, 0, res.Resultset.RowNumber())
+	for i := 0; i < res.Resultset.RowNumber(); i++ {
+		name, _ := res.GetString(i, 0)
+		tables = append(tables, name)
+	}
+	return tables, nil
+}
+
+var (
+	expCreateTable    = regexp.MustCompile("(?i)^CREATE\\s+TABLE\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?`?([^`\\.\\s(]+)`?(?:\\.`?([^`\\.\\s(]+)`?)?")
+	expCreateDatabase = regexp.MustCompile("(?i)^CREATE\\s+(?:DATABASE|SCHEMA)\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?`?([^`\\s;]+)`?")
+)
+
+// parseCreate returns the schema and the table a CREATE TABLE statement creates, the table is empty for
+// a CREATE DATABASE statement. The schema of the query event is the default of a table without one.
+func parseCreate(schema string, query string) (string, string, bool) {
+	if m := expCreateTable.FindStringSubmatch(query); m != nil {
+		if len(m[2]) == 0 {
+			return schema, m[1], true
+		}
+		return m[1], m[2], true
+	}
+	if m := expCreateDatabase.FindStringSubmatch(query); m != nil {
+		return m[1], "", true
+	}
+	return "", "", false
+}
+
+// onCreate forgets the tables found without a rule of a created database or table, a created table of a
+// schema a wildcard source matches gets its rule at once.
+func (r *River) onCreate(schema string, query string) error {
+	schema, table, ok := parseCreate(schema, query)
+	if !ok || len(r.wildRules) == 0 {
+		return nil
+	}
+
+	if len(table) == 0 {
+		for key := range r.noRules {
+			if strings.HasPrefix(key, ruleKey(schema, "")) {
+				delete(r.noRules, key)
+			}
+		}
+		return nil
+	}
+
+	delete(r.noRules, ruleKey(schema, table))
+	if _, ok = r.getRule(schema, table); ok {
+		return nil
+	}
+	_, err := r.newSchemaRules(schema, table)
+	return errors.Trace(err)
+}
+
+// newSchemaRules creates the rules of the tables of a schema a wildcard schema of the sources matches
+// that have none yet, e.g. of a tenant database or a tenant table created after the start. It returns
+// the rule of the table, nil if the table isn't synced, which is remembered until the table or its
+// database is created again.
+func (r *River) newSchemaRules(schema string, table string) (*Rule, error) {
+	if len(r.wildRules) == 0 || r.noRules[ruleKey(schema, table)] {
+		return nil, nil
+	}
+
+	rules := make(map[string]*Rule)
+	for _, s := range r.c.Sources {
+		if !isWildcard(s.Schema) {
+			continue
+		}
+		matched, err := r.matchSchemas(s.Schema, schema)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		for _, t := range s.Tables {
+			tables, err := r.sourceTables(schema, t, true)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			for _, name := range tables {
+				key := ruleKey(schema, name)
+				if _, ok := rules[key]; ok {
+					return nil, errors.Errorf("duplicate source %s, %s defined in config", schema, name)
+				}
+				if _, ok := r.getRule(schema, name); ok {
+					continue
+				}
+				rule := wildcardRule(r.wildRules[ruleKey(s.Schema, t)], schema, name)
+				if err = r.prepareTable(rule); err != nil {
+					return nil, errors.Trace(err)
+				}
+				rules[key] = rule
+			}
+		}
+	}
+	if _, ok := rules[ruleKey(schema, table)]; !ok {
+		r.noRules[ruleKey(schema, table)] = true
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	r.rulesLock.Lock()
+	defer r.rulesLock.Unlock()
+
+	for key, rule := range rules {
+		r.rules[key] = rule
+	}
+	if err := r.prepareCascades(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	log.Infof("schema %s, sync %d new tables", schema, len(rules))
+	return r.rules[ruleKey(schema, table)], nil
+}
+
+// getRule returns the rule of the table, the sync may add rules at any time.
+func (r *River) getRule(schema string, table string) (*Rule, bool) {
+	r.rulesLock.RLock()
+	defer r.rulesLock.RUnlock()
+
+	rule, ok := r.rules[ruleKey(schema, table)]
+	return rule, ok
+}
+
+// addSchemaField adds the schema of the row to the document if the rule has a schema_field.
+func addSchemaField(req *elasticwrapper.BulkRequest, rule *Rule) {
+	if len(rule.SchemaField) > 0 && req.Data != nil {
+		req.Data[rule.SchemaField] = rule.Schema
+	}
+}
@@ -0,0 +1,132 @@
+package river
+
+import (
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/schema"
+	. "github.com/pingcap/check"
+)
+
+type schemasTestSuite struct{}
+
+var _ = Suite(&schemasTestSuite{})
+
+func (s *schemasTestSuite) wildcardRule(c *C) *Rule {
+	rule := newDefaultRule("tenant_[0-9]{4}", "users")
+	rule.Index = "{schema}_users"
+	rule.Type = ""
+	rule.IdPrefix = "{schema}"
+	rule.SchemaField = "tenant"
+	rule.Cascade = []string{"{schema}.comments"}
+	c.Assert(rule.prepare(), IsNil)
+	return rule
+}
+
+func (s *schemasTestSuite) TestIsWildcard(c *C) {
+	c.Assert(isWildcard("tenant_[0-9]{4}"), IsTrue)
+	c.Assert(isWildcard("tenant_.*"), IsTrue)
+	c.Assert(isWildcard("tenant_0001"), IsFalse)
+}
+
+func (s *schemasTestSuite) TestWildcardRule(c *C) {
+	rule := s.wildcardRule(c)
+
+	rr := wildcardRule(rule, "tenant_0001", "users")
+	c.Assert(rr.Schema, Equals, "tenant_0001")
+	c.Assert(rr.Table, Equals, "users")
+	c.Assert(rr.Index, Equals, "tenant_0001_users")
+	c.Assert(rr.Type, Equals, "tenant_0001_users")
+	c.Assert(rr.IdPrefix, Equals, "tenant_0001")
+	c.Assert(rr.Cascade, DeepEquals, []string{"tenant_0001.comments"})
+	c.Assert(rr.SchemaField, Equals, "tenant")
+	c.Assert(rr.WritePolicy, Equals, WritePolicyUpsert)
+
+	// the wildcard rule is the template of every schema
+	c.Assert(rule.Index, Equals, "{schema}_users")
+	c.Assert(rule.Cascade, DeepEquals, []string{"{schema}.comments"})
+}
+
+func (s *schemasTestSuite) TestSchemaField(c *C) {
+	table := &schema.Table{Schema: "tenant_0001", Name: "users"}
+	table.AddColumn("id", "int(11)", "")
+	table.AddColumn("name", "varchar(255)", "")
+	table.PKColumns = []int{0}
+
+	rule := wildcardRule(s.wildcardRule(c), "tenant_0001", "users")
+	rule.TableInfo = table
+	r := &River{st: &stat{}}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), "a"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Index, Equals, "tenant_0001_users")
+	c.Assert(reqs[0].ID, Equals, "tenant_0001:1")
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int64(1), "name": "a", "tenant": "tenant_0001"})
+
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), "a"}, {int64(1), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"name": "b", "tenant": "tenant_0001"})
+
+	// removing the fields of the row leaves the schema
+	reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{int64(1), "b"}})
+	c.Assert(err, IsNil)
+	c.Assert(reqs[0].Action, Equals, elasticwrapper.ActionDelete)
+	c.Assert(reqs[0].Data, DeepEquals, map[string]interface{}{"id": int64(1), "name": "b"})
+}
+
+func (s *schemasTestSuite) TestParseCreate(c *C) {
+	tests := []struct {
+		query  string
+		schema string
+		table  string
+		ok     bool
+	}{
+		{"CREATE TABLE users (id int)", "tenant_0001", "users", true},
+		{"create table if not exists `tenant_0002`.`users`(id int)", "tenant_0002", "users", true},
+		{"CREATE TABLE tenant_0002.users LIKE tenant_0001.users", "tenant_0002", "users", true},
+		{"CREATE DATABASE `tenant_0003`", "tenant_0003", "", true},
+		{"CREATE SCHEMA IF NOT EXISTS tenant_0003;", "tenant_0003", "", true},
+		{"ALTER TABLE users ADD name varchar(255)", "", "", false},
+		{"CREATE INDEX name ON users (name)", "", "", false},
+	}
+
+	for _, t := range tests {
+		schema, table, ok := parseCreate("tenant_0001", t.query)
+		c.Assert(ok, Equals, t.ok, Commentf(t.query))
+		c.Assert(schema, Equals, t.schema, Commentf(t.query))
+		c.Assert(table, Equals, t.table, Commentf(t.query))
+	}
+}
+
+func (s *schemasTestSuite) TestNewSchemaRules(c *C) {
+	r := &River{rules: make(map[string]*Rule), noRules: map[string]bool{ruleKey("tenant_0001", "logs"): true}}
+
+	// no wildcard schemas
+	rule, err := r.newSchemaRules("other", "users")
+	c.Assert(err, IsNil)
+	c.Assert(rule, IsNil)
+
+	// the tables found without a rule are not matched again
+	r.wildRules = map[string]*Rule{ruleKey("tenant_[0-9]{4}", "users"): s.wildcardRule(c)}
+	rule, err = r.newSchemaRules("tenant_0001", "logs")
+	c.Assert(err, IsNil)
+	c.Assert(rule, IsNil)
+}
+
+func (s *schemasTestSuite) TestOnCreate(c *C) {
+	r := &River{rules: make(map[string]*Rule), noRules: map[string]bool{
+		ruleKey("tenant_0001", "logs"):   true,
+		ruleKey("tenant_0001", "events"): true,
+		ruleKey("tenant_0002", "logs"):   true,
+	}}
+	r.wildRules = map[string]*Rule{ruleKey("tenant_[0-9]{4}", "users"): s.wildcardRule(c)}
+	r.rules[ruleKey("tenant_0001", "users")] = wildcardRule(s.wildcardRule(c), "tenant_0001", "users")
+
+	// a table with a rule is not matched again
+	c.Assert(r.onCreate("tenant_0001", "CREATE TABLE users (id int)"), IsNil)
+	c.Assert(r.onCreate("tenant_0001", "INSERT INTO logs VALUES (1)"), IsNil)
+	c.Assert(r.noRules, HasLen, 3)
+
+	// a created database is matched again with all its tables
+	c.Assert(r.onCreate("", "CREATE DATABASE tenant_0001"), IsNil)
+	c.Assert(r.noRules, DeepEquals, map[string]bool{ruleKey("tenant_0002", "logs"): true})
+}
@@ -0,0 +1,92 @@
+package river
+
+import (
+	"bytes"
+
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql-elasticsearch/sink"
+	"github.com/jrots/go-mysql/schema"
+	. "github.com/pingcap/check"
+)
+
+type sinkTestSuite struct{}
+
+var _ = Suite(&sinkTestSuite{})
+
+// testSink keeps the requests written to it.
+type testSink struct {
+	reqs []*elasticwrapper.BulkRequest
+}
+
+func (s *testSink) Write(reqs []*elasticwrapper.BulkRequest) error {
+	s.reqs = append(s.reqs, reqs...)
+	return nil
+}
+
+func (s *testSink) Flush() error { return nil }
+
+func (s *testSink) SetAckHandler(fn func(reqs []*elasticwrapper.BulkRequest, err error)) {}
+
+func (s *testSink) Close() error { return nil }
+
+func (s *sinkTestSuite) TestRoute(c *C) {
+	table := &schema.Table{Schema: "test", Name: "users"}
+	table.AddColumn("id", "int(11)", "")
+	table.AddColumn("name", "varchar(255)", "")
+	table.PKColumns = []int{0}
+
+	rule := newDefaultRule("test", "users")
+	rule.Sink = "events"
+	rule.IdPrefix = "u"
+	rule.TableInfo = table
+	c.Assert(rule.prepare(), IsNil)
+
+	es, events := new(testSink), new(testSink)
+	r := &River{st: &stat{}, sinks: map[string]sink.Sink{"": es, "events": events}}
+
+	var reqs []*elasticwrapper.BulkRequest
+	insert, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), "a"}})
+	c.Assert(err, IsNil)
+	reqs = append(reqs, insert...)
+	update, err := r.makeUpdateRequest(rule, [][]interface{}{{int64(1), "a"}, {int64(1), "b"}})
+	c.Assert(err, IsNil)
+	reqs = append(reqs, update...)
+	del, err := r.makeDeleteRequest(rule, [][]interface{}{{int64(2), "c"}})
+	c.Assert(err, IsNil)
+	reqs = append(reqs, del...)
+
+	for _, req := range reqs {
+		c.Assert(req.Sink, Equals, "events")
+	}
+	c.Assert(update[0].ID, Equals, "u:1")
+
+	c.Assert(r.flushRequests(reqs), IsNil)
+	c.Assert(es.reqs, HasLen, 0)
+	// the update went into the insert of its document
+	c.Assert(events.reqs, HasLen, 2)
+	c.Assert(events.reqs[0].ID, Equals, "u:1")
+	c.Assert(events.reqs[0].Data, DeepEquals, map[string]interface{}{"id": int64(1), "name": "b"})
+	c.Assert(events.reqs[1].ID, Equals, "u:2")
+	c.Assert(events.reqs[1].Action, Equals, elasticwrapper.ActionDelete)
+}
+
+func (s *sinkTestSuite) TestWildcardRules(c *C) {
+	var buf bytes.Buffer
+	r := (&targetTestSuite{}).newRiver()
+	ts, err := r.newESTargets(elasticwrapper.ClientConfig{DryRun: &buf})
+	c.Assert(err, IsNil)
+	r.targets = ts
+	r.st = &stat{}
+
+	rule := newDefaultRule("tenant_[0-9]{4}", "users")
+	rule.Sink = sink.TypeElasticsearch
+	r.rules = map[string]*Rule{}
+	r.wildRules = map[string]*Rule{ruleKey(rule.Schema, rule.Table): rule}
+
+	// the rules of the tenants created later get the sink of the wildcard rule
+	c.Assert(r.newSinks(), IsNil)
+	c.Assert(rule.Sink, Equals, "")
+
+	rule.Sink = "evnets"
+	c.Assert(r.newSinks(), NotNil)
+}
@@ -0,0 +1,464 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/jrots/go-mysql/canal"
+	"github.com/jrots/go-mysql/client"
+	"github.com/jrots/go-mysql/mysql"
+	"github.com/jrots/go-mysql/schema"
+)
+
+const (
+	SnapshotModeMysqldump = "mysqldump"
+	SnapshotModeNative    = "native"
+)
+
+// snapshotChunk is a PK range of a table, read chunk by chunk in PK order by one snapshot worker.
+type snapshotChunk struct {
+	rule *Rule
+
+	table    *snapshotTableProgress
+	progress *snapshotChunkProgress
+
+	// PK values of the last row read, the next chunk starts after it, nil to start at the beginning
+	last []interface{}
+	// inclusive upper bound for a single integer PK, nil for no bound
+	upper *int64
+}
+
+// snapshot reads the tables of all rules inside one consistent snapshot over several connections,
+// without mysqldump. The rows go through the same request builders as the binlog rows.
+// The progress of every chunk is saved, a restarted snapshot resumes after the last synced chunk.
+type snapshot struct {
+	r *River
+
+	conns    []*client.Conn
+	pos      mysql.Position
+	progress *snapshotProgress
+}
+
+func newSnapshot(r *River) *snapshot {
+	return &snapshot{r: r, progress: r.snapshotProgress}
+}
+
+func (s *snapshot) connect() (*client.Conn, error) {
+	return s.r.connectMySQL()
+}
+
+// begin opens the worker connections, every one with a transaction on the same consistent snapshot,
+// and records the binlog position of that snapshot.
+// A resumed snapshot keeps the binlog position of the first one, binlog syncing catches up from there.
+func (s *snapshot) begin(workers int, resume bool) error {
+	var lockConn *client.Conn
+	var err error
+	if !s.r.c.SkipMasterData && !resume {
+		// hold the global read lock while the snapshots are opened, so all of them see
+		// the same data and the binlog position matches them
+		if lockConn, err = s.connect(); err != nil {
+			return errors.Trace(err)
+		}
+		defer lockConn.Close()
+
+		if _, err = lockConn.Execute("FLUSH TABLES WITH READ LOCK"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if resume {
+		s.pos = s.progress.Position()
+	} else if s.r.c.BinlogName != "" {
+		s.pos, err = s.r.canal.GetMasterPosByName(s.r.c.BinlogName)
+	} else {
+		s.pos, err = s.r.canal.GetMasterPos()
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for i := 0; i < workers; i++ {
+		conn, err := s.connect()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		s.conns = append(s.conns, conn)
+
+		if _, err = conn.Execute("SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err = conn.Execute("START TRANSACTION /*!40108 WITH CONSISTENT SNAPSHOT */"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if lockConn != nil {
+		if _, err = lockConn.Execute("UNLOCK TABLES"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	log.Infof("snapshot started with %d connections at binlog %s", workers, s.pos)
+	return nil
+}
+
+func (s *snapshot) close() {
+	for _, conn := range s.conns {
+		conn.Execute("ROLLBACK")
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// Run reads all the rule tables and returns the binlog position to start syncing from.
+func (s *snapshot) Run() (mysql.Position, error) {
+	defer s.close()
+
+	workers := s.r.c.SnapshotWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+
+	start := time.Now()
+	resume := s.progress.Started()
+	if err := s.begin(workers, resume); err != nil {
+		return s.pos, errors.Trace(err)
+	}
+
+	chunks, err := s.prepareChunks(workers)
+	if err != nil {
+		return s.pos, errors.Trace(err)
+	}
+	if err = s.progress.Save(true); err != nil {
+		return s.pos, errors.Trace(err)
+	}
+	if resume {
+		log.Infof("resume snapshot with %d unfinished chunks", len(chunks))
+	}
+
+	ch := make(chan *snapshotChunk, len(chunks))
+	for _, chunk := range chunks {
+		ch <- chunk
+	}
+	close(ch)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(s.conns))
+	for _, conn := range s.conns {
+		wg.Add(1)
+		go func(conn *client.Conn) {
+			defer wg.Done()
+			for chunk := range ch {
+				if err := s.readChunk(conn, chunk); err != nil {
+					errs <- errors.Trace(err)
+					return
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return s.pos, err
+	}
+
+	// mark the snapshot as done once the last rows are flushed
+	select {
+	case s.r.syncCh <- snapshotSaver{done: true}:
+	case <-s.r.ctx.Done():
+		return s.pos, s.r.ctx.Err()
+	}
+
+	log.Infof("snapshot of %d tables OK, use %0.2f seconds, start binlog replication at %s",
+		len(s.r.rules), time.Now().Sub(start).Seconds(), s.pos)
+	return s.pos, nil
+}
+
+// prepareChunks returns the chunks still to read. Chunks of a resumed snapshot continue after their
+// last synced row, tables which were not part of it yet are split and added to the progress.
+func (s *snapshot) prepareChunks(workers int) ([]*snapshotChunk, error) {
+	s.progress.Lock()
+	defer s.progress.Unlock()
+
+	s.progress.Name = s.pos.Name
+	s.progress.Pos = s.pos.Pos
+
+	var chunks []*snapshotChunk
+	for _, rule := range s.r.rules {
+		// the rows of the snapshot are no change events, an audit only rule has nothing to write
+		if rule.AuditOnly {
+			continue
+		}
+
+		t := s.progress.table(rule.Schema, rule.Table)
+		if t == nil {
+			ruleChunks, err := s.splitTable(s.conns[0], rule, workers)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			t = &snapshotTableProgress{Schema: rule.Schema, Table: rule.Table}
+			if t.Total, err = s.estimateRows(rule); err != nil {
+				return nil, errors.Trace(err)
+			}
+			for _, chunk := range ruleChunks {
+				chunk.progress = &snapshotChunkProgress{Last: formatPKValues(chunk.last)}
+				if chunk.upper != nil {
+					chunk.progress.Bounded = true
+					chunk.progress.Upper = *chunk.upper
+				}
+				t.Chunks = append(t.Chunks, chunk.progress)
+			}
+			s.progress.Tables = append(s.progress.Tables, t)
+			chunks = append(chunks, ruleChunks...)
+		} else {
+			for _, progress := range t.Chunks {
+				if progress.Done {
+					continue
+				}
+				chunk := &snapshotChunk{rule: rule, progress: progress}
+				for _, v := range progress.Last {
+					chunk.last = append(chunk.last, v)
+				}
+				if progress.Bounded {
+					upper := progress.Upper
+					chunk.upper = &upper
+				}
+				chunks = append(chunks, chunk)
+			}
+		}
+
+		t.startRows = t.Rows
+		t.startTime = time.Now()
+		for _, chunk := range chunks {
+			if chunk.rule == rule {
+				chunk.table = t
+			}
+		}
+	}
+
+	return chunks, nil
+}
+
+func (s *snapshot) estimateRows(rule *Rule) (int64, error) {
+	res, err := s.r.canal.Execute(`SELECT table_rows FROM information_schema.tables WHERE
+		table_schema = ? AND table_name = ?`, rule.Schema, rule.Table)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if res.RowNumber() == 0 {
+		return 0, nil
+	}
+	rows, _ := res.GetInt(0, 0)
+	return rows, nil
+}
+
+// splitTable splits a table with a single integer PK in one PK range per worker,
+// other tables are read as a whole by one worker.
+func (s *snapshot) splitTable(conn *client.Conn, rule *Rule, workers int) ([]*snapshotChunk, error) {
+	pks := rule.TableInfo.PKColumns
+	if workers == 1 || len(pks) != 1 || rule.TableInfo.Columns[pks[0]].Type != schema.TYPE_NUMBER {
+		return []*snapshotChunk{{rule: rule}}, nil
+	}
+
+	pk := quoteName(rule.TableInfo.Columns[pks[0]].Name)
+	res, err := conn.Execute(fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", pk, pk, quoteTable(rule)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if isNull, _ := res.IsNull(0, 0); isNull {
+		// empty table
+		return nil, nil
+	}
+
+	min, _ := res.GetInt(0, 0)
+	max, _ := res.GetInt(0, 1)
+	size := (max - min) / int64(workers)
+	if size < int64(s.chunkSize()) {
+		return []*snapshotChunk{{rule: rule}}, nil
+	}
+
+	chunks := make([]*snapshotChunk, 0, workers)
+	for lower := min - 1; lower < max; lower += size {
+		chunk := &snapshotChunk{rule: rule, last: []interface{}{lower}}
+		if upper := lower + size; upper < max {
+			chunk.upper = &upper
+		}
+		chunks = append(chunks, chunk)
+		if chunk.upper == nil {
+			break
+		}
+	}
+	return chunks, nil
+}
+
+func (s *snapshot) chunkSize() int {
+	return s.r.snapshotChunkSize()
+}
+
+// readChunk reads the PK range chunk by chunk and hands the rows to the sync loop.
+func (s *snapshot) readChunk(conn *client.Conn, chunk *snapshotChunk) error {
+	rule := chunk.rule
+	for {
+		if err := s.r.ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := conn.Execute(chunkQuery(rule, chunk.last, chunk.upper, s.chunkSize()))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		n := res.RowNumber()
+		saver := snapshotSaver{chunk: chunk, rows: n, done: n < s.chunkSize()}
+
+		if n > 0 {
+			rows := make([][]interface{}, n)
+			for i, values := range res.Values {
+				rows[i] = snapshotRow(rule.TableInfo, values)
+			}
+
+			reqs, err := s.r.makeRowsRequest(rule, &canal.RowsEvent{Table: rule.TableInfo, Action: canal.InsertAction, Rows: rows})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			select {
+			case s.r.syncCh <- reqs:
+			case <-s.r.ctx.Done():
+				return s.r.ctx.Err()
+			}
+
+			chunk.last, err = pkValues(rule.TableInfo, res.Values[n-1])
+			if err != nil {
+				return errors.Trace(err)
+			}
+			saver.last = chunk.last
+		}
+
+		// the progress is saved once the rows above are flushed
+		select {
+		case s.r.syncCh <- saver:
+		case <-s.r.ctx.Done():
+			return s.r.ctx.Err()
+		}
+
+		if saver.done {
+			return nil
+		}
+	}
+}
+
+// chunkQuery selects the next rows after the last PK in PK order,
+// columns are selected in table order so the rows look like binlog rows.
+func chunkQuery(rule *Rule, last []interface{}, upper *int64, limit int) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("SELECT ")
+	for i, c := range rule.TableInfo.Columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(quoteName(c.Name))
+	}
+	buf.WriteString(" FROM ")
+	buf.WriteString(quoteTable(rule))
+
+	pks := rule.TableInfo.PKColumns
+	where := make([]string, 0, 2)
+	if last != nil {
+		// (a > x) OR (a = x AND b > y) ...
+		var cond bytes.Buffer
+		for i := range pks {
+			if i > 0 {
+				cond.WriteString(" OR ")
+			}
+			cond.WriteString("(")
+			for j := 0; j < i; j++ {
+				cond.WriteString(fmt.Sprintf("%s = %s AND ", quoteName(rule.TableInfo.Columns[pks[j]].Name), quoteValue(last[j])))
+			}
+			cond.WriteString(fmt.Sprintf("%s > %s)", quoteName(rule.TableInfo.Columns[pks[i]].Name), quoteValue(last[i])))
+		}
+		where = append(where, "("+cond.String()+")")
+	}
+	if upper != nil {
+		where = append(where, fmt.Sprintf("%s <= %d", quoteName(rule.TableInfo.Columns[pks[0]].Name), *upper))
+	}
+	for i, cond := range where {
+		if i == 0 {
+			buf.WriteString(" WHERE ")
+		} else {
+			buf.WriteString(" AND ")
+		}
+		buf.WriteString(cond)
+	}
+
+	buf.WriteString(" ORDER BY ")
+	for i, pk := range pks {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(quoteName(rule.TableInfo.Columns[pk].Name))
+	}
+	buf.WriteString(fmt.Sprintf(" LIMIT %d", limit))
+
+	return buf.String()
+}
+
+// snapshotRow converts a text protocol row to the values mysqldump rows have:
+// numbers are int64 or float64, everything else is a string.
+func snapshotRow(table *schema.Table, values []interface{}) []interface{} {
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		b, ok := v.([]byte)
+		if !ok {
+			row[i] = v
+			continue
+		}
+
+		row[i] = string(b)
+		if i < len(table.Columns) && table.Columns[i].Type == schema.TYPE_FLOAT {
+			// decimal
+			if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+				row[i] = f
+			}
+		}
+	}
+	return row
+}
+
+func pkValues(table *schema.Table, row []interface{}) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(table.PKColumns))
+	for _, pk := range table.PKColumns {
+		if pk >= len(row) || row[pk] == nil {
+			return nil, errors.Errorf("invalid PK value in %s row %v", table, row)
+		}
+		values = append(values, row[pk])
+	}
+	return values, nil
+}
+
+func quoteName(name string) string {
+	return "`" + name + "`"
+}
+
+func quoteTable(rule *Rule) string {
+	return quoteName(rule.Schema) + "." + quoteName(rule.Table)
+}
+
+func quoteValue(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return "'" + mysql.Escape(string(v)) + "'"
+	case string:
+		return "'" + mysql.Escape(v) + "'"
+	default:
+		return fmt.Sprint(v)
+	}
+}
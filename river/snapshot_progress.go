@@ -0,0 +1,233 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/jrots/go-mysql/mysql"
+	"github.com/siddontang/go/ioutil2"
+)
+
+// snapshotChunkProgress is the persisted state of a snapshotChunk.
+type snapshotChunkProgress struct {
+	// PK values of the last row synced, empty if nothing was synced yet
+	Last []string `toml:"last"`
+	// Upper is only used if Bounded is set
+	Bounded bool  `toml:"bounded"`
+	Upper   int64 `toml:"upper"`
+	Done    bool  `toml:"done"`
+}
+
+type snapshotTableProgress struct {
+	Schema string `toml:"schema"`
+	Table  string `toml:"table"`
+	// estimated number of rows, from information_schema
+	Total int64 `toml:"total"`
+	Rows  int64 `toml:"rows"`
+
+	Chunks []*snapshotChunkProgress `toml:"chunk"`
+
+	// rows synced and time when this process started on the table, for the ETA
+	startRows int64
+	startTime time.Time
+}
+
+// snapshotProgress is saved in data_dir/snapshot.info while the native snapshot runs,
+// so a restarted river resumes the snapshot instead of starting it all over again.
+type snapshotProgress struct {
+	sync.RWMutex
+
+	// binlog position of the first snapshot, binlog syncing starts here once all tables are read
+	Name string `toml:"bin_name"`
+	Pos  uint32 `toml:"bin_pos"`
+	Done bool   `toml:"done"`
+
+	Tables []*snapshotTableProgress `toml:"table"`
+
+	filePath     string
+	lastSaveTime time.Time
+}
+
+// snapshotSaver is sent through the sync loop after the rows of a chunk,
+// the progress is saved once these rows are flushed.
+type snapshotSaver struct {
+	chunk *snapshotChunk
+	last  []interface{}
+	rows  int
+	done  bool
+}
+
+func loadSnapshotProgress(dataDir string) (*snapshotProgress, error) {
+	var p snapshotProgress
+
+	if len(dataDir) == 0 {
+		return &p, nil
+	}
+
+	p.filePath = path.Join(dataDir, "snapshot.info")
+
+	f, err := os.Open(p.filePath)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Trace(err)
+	} else if os.IsNotExist(errors.Cause(err)) {
+		return &p, nil
+	}
+	defer f.Close()
+
+	_, err = toml.DecodeReader(f, &p)
+	return &p, errors.Trace(err)
+}
+
+func (p *snapshotProgress) Position() mysql.Position {
+	p.RLock()
+	defer p.RUnlock()
+
+	return mysql.Position{
+		Name: p.Name,
+		Pos:  p.Pos,
+	}
+}
+
+// Started reports whether a snapshot was started before, its position must be kept.
+func (p *snapshotProgress) Started() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	return len(p.Name) > 0
+}
+
+func (p *snapshotProgress) IsDone() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.Done
+}
+
+func (p *snapshotProgress) table(schema string, table string) *snapshotTableProgress {
+	for _, t := range p.Tables {
+		if t.Schema == schema && t.Table == table {
+			return t
+		}
+	}
+	return nil
+}
+
+// Update applies a synced chunk and saves the progress, at most once per second unless
+// the chunk is done. A saver without chunk marks the whole snapshot as done.
+func (p *snapshotProgress) Update(v snapshotSaver) error {
+	if v.chunk == nil {
+		return p.Finish()
+	}
+
+	p.Lock()
+	chunk := v.chunk
+	chunk.table.Rows += int64(v.rows)
+	if v.last != nil {
+		chunk.progress.Last = formatPKValues(v.last)
+	}
+	if v.done {
+		chunk.progress.Done = true
+	}
+	p.Unlock()
+
+	return p.Save(v.done)
+}
+
+func (p *snapshotProgress) Finish() error {
+	p.Lock()
+	p.Done = true
+	p.Unlock()
+
+	return p.Save(true)
+}
+
+func (p *snapshotProgress) Save(force bool) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.filePath) == 0 {
+		return nil
+	}
+
+	n := time.Now()
+	if !force && n.Sub(p.lastSaveTime) < time.Second {
+		return nil
+	}
+
+	p.lastSaveTime = n
+	var buf bytes.Buffer
+	e := toml.NewEncoder(&buf)
+
+	if err := e.Encode(p); err != nil {
+		return errors.Trace(err)
+	}
+
+	var err error
+	if err = ioutil2.WriteFileAtomic(p.filePath, buf.Bytes(), 0644); err != nil {
+		log.Errorf("save snapshot progress to file %s err %v", p.filePath, err)
+	}
+
+	return errors.Trace(err)
+}
+
+// Status writes the progress and ETA of every table for the stat endpoint.
+func (p *snapshotProgress) Status(buf *bytes.Buffer) {
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, t := range p.Tables {
+		total := t.Total
+		if total < t.Rows {
+			// estimation was too low
+			total = t.Rows
+		}
+
+		done := true
+		for _, c := range t.Chunks {
+			done = done && c.Done
+		}
+
+		percent := float64(100)
+		if !done {
+			percent = 0
+			if total > 0 {
+				percent = float64(t.Rows) * 100 / float64(total)
+			}
+		}
+
+		eta := "-"
+		if done {
+			eta = "0s"
+		} else if synced := t.Rows - t.startRows; synced > 0 && !t.startTime.IsZero() {
+			elapsed := time.Now().Sub(t.startTime)
+			remaining := time.Duration(float64(elapsed) * float64(total-t.Rows) / float64(synced))
+			eta = remaining.Truncate(time.Second).String()
+		}
+
+		buf.WriteString(fmt.Sprintf("snapshot:%s.%s rows:%d/%d progress:%0.2f%% eta:%s\n",
+			t.Schema, t.Table, t.Rows, total, percent, eta))
+	}
+}
+
+func formatPKValues(values []interface{}) []string {
+	last := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case []byte:
+			last[i] = string(v)
+		case float64:
+			last[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		default:
+			last[i] = fmt.Sprint(v)
+		}
+	}
+	return last
+}
@@ -0,0 +1,102 @@
+package river
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	. "github.com/pingcap/check"
+	"github.com/jrots/go-mysql/schema"
+)
+
+type snapshotTestSuite struct{}
+
+var _ = Suite(&snapshotTestSuite{})
+
+func (s *snapshotTestSuite) testRule() *Rule {
+	table := &schema.Table{Schema: "test", Name: "t"}
+	table.AddColumn("a", "int(11)", "")
+	table.AddColumn("b", "varchar(256)", "")
+	table.AddColumn("c", "decimal(10,2)", "")
+	table.PKColumns = []int{0, 1}
+
+	rule := newDefaultRule("test", "t")
+	rule.TableInfo = table
+	return rule
+}
+
+func (s *snapshotTestSuite) TestChunkQuery(c *C) {
+	rule := s.testRule()
+
+	c.Assert(chunkQuery(rule, nil, nil, 10), Equals,
+		"SELECT `a`, `b`, `c` FROM `test`.`t` ORDER BY `a`, `b` LIMIT 10")
+
+	c.Assert(chunkQuery(rule, []interface{}{int64(3), []byte("it's")}, nil, 10), Equals,
+		"SELECT `a`, `b`, `c` FROM `test`.`t` WHERE ((`a` > 3) OR (`a` = 3 AND `b` > 'it\\'s')) ORDER BY `a`, `b` LIMIT 10")
+
+	rule.TableInfo.PKColumns = []int{0}
+	upper := int64(100)
+	c.Assert(chunkQuery(rule, []interface{}{int64(50)}, &upper, 10), Equals,
+		"SELECT `a`, `b`, `c` FROM `test`.`t` WHERE ((`a` > 50)) AND `a` <= 100 ORDER BY `a` LIMIT 10")
+}
+
+func (s *snapshotTestSuite) TestSnapshotRow(c *C) {
+	rule := s.testRule()
+
+	row := snapshotRow(rule.TableInfo, []interface{}{int64(1), []byte("first"), []byte("1.50")})
+	c.Assert(row, DeepEquals, []interface{}{int64(1), "first", float64(1.5)})
+}
+
+func (s *snapshotTestSuite) TestSnapshotProgress(c *C) {
+	dir, err := ioutil.TempDir("", "snapshot_progress")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	p, err := loadSnapshotProgress(dir)
+	c.Assert(err, IsNil)
+	c.Assert(p.Started(), IsFalse)
+
+	rule := s.testRule()
+	t := &snapshotTableProgress{Schema: "test", Table: "t", Total: 10}
+	chunk := &snapshotChunk{rule: rule, table: t, progress: &snapshotChunkProgress{Bounded: true, Upper: 100}}
+	t.Chunks = append(t.Chunks, chunk.progress, &snapshotChunkProgress{Done: true})
+	p.Name = "mysql-bin.000001"
+	p.Pos = 4
+	p.Tables = append(p.Tables, t)
+
+	c.Assert(p.Update(snapshotSaver{chunk: chunk, last: []interface{}{int64(5), []byte("e")}, rows: 5}), IsNil)
+	c.Assert(p.Save(true), IsNil)
+
+	p, err = loadSnapshotProgress(dir)
+	c.Assert(err, IsNil)
+	c.Assert(p.Started(), IsTrue)
+	c.Assert(p.IsDone(), IsFalse)
+	c.Assert(p.Position().Pos, Equals, uint32(4))
+	c.Assert(p.Tables, HasLen, 1)
+	c.Assert(p.Tables[0].Rows, Equals, int64(5))
+	c.Assert(p.Tables[0].Chunks[0].Last, DeepEquals, []string{"5", "e"})
+	c.Assert(p.Tables[0].Chunks[0].Upper, Equals, int64(100))
+	c.Assert(p.Tables[0].Chunks[1].Done, IsTrue)
+
+	var buf bytes.Buffer
+	p.Status(&buf)
+	c.Assert(buf.String(), Equals, "snapshot:test.t rows:5/10 progress:50.00% eta:-\n")
+
+	c.Assert(p.Update(snapshotSaver{}), IsNil)
+	p, err = loadSnapshotProgress(dir)
+	c.Assert(err, IsNil)
+	c.Assert(p.IsDone(), IsTrue)
+}
+
+func (s *snapshotTestSuite) TestAuditOnly(c *C) {
+	rule := s.testRule()
+	rule.AuditIndex = "t_audit"
+	rule.AuditOnly = true
+	r := &River{rules: map[string]*Rule{ruleKey("test", "t"): rule}, snapshotProgress: &snapshotProgress{}}
+
+	// the table of an audit only rule isn't read
+	chunks, err := newSnapshot(r).prepareChunks(2)
+	c.Assert(err, IsNil)
+	c.Assert(chunks, HasLen, 0)
+	c.Assert(r.snapshotProgress.Tables, HasLen, 0)
+}
@@ -2,14 +2,34 @@ package river
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"fmt"
 	"net"
 	"net/http"
+	"sort"
 
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
 	"github.com/ngaut/log"
 	"github.com/siddontang/go/sync2"
 )
 
+// sinkStat counts the requests a sink acknowledged.
+type sinkStat struct {
+	Acked  sync2.AtomicInt64
+	Failed sync2.AtomicInt64
+}
+
+func (s *sinkStat) ack(name string) func(reqs []*elasticwrapper.BulkRequest, err error) {
+	return func(reqs []*elasticwrapper.BulkRequest, err error) {
+		if err != nil {
+			log.Errorf("sink %s failed to write %d requests: %v", sinkName(name), len(reqs), err)
+			s.Failed.Add(int64(len(reqs)))
+			return
+		}
+		s.Acked.Add(int64(len(reqs)))
+	}
+}
+
 type stat struct {
 	r *River
 
@@ -18,6 +38,10 @@ type stat struct {
 	InsertNum sync2.AtomicInt64
 	UpdateNum sync2.AtomicInt64
 	DeleteNum sync2.AtomicInt64
+	// requests merged into an earlier one to the same document
+	CoalescedNum sync2.AtomicInt64
+
+	sinks map[string]*sinkStat
 }
 
 func (s *stat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -41,6 +65,33 @@ func (s *stat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	buf.WriteString(fmt.Sprintf("insert_num:%d\n", s.InsertNum.Get()))
 	buf.WriteString(fmt.Sprintf("update_num:%d\n", s.UpdateNum.Get()))
 	buf.WriteString(fmt.Sprintf("delete_num:%d\n", s.DeleteNum.Get()))
+	buf.WriteString(fmt.Sprintf("coalesced_num:%d\n", s.CoalescedNum.Get()))
+
+	names := make([]string, 0, len(s.sinks))
+	for name := range s.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf.WriteString(fmt.Sprintf("sink:%s acked:%d failed:%d\n",
+			sinkName(name), s.sinks[name].Acked.Get(), s.sinks[name].Failed.Get()))
+	}
+
+	if s.r.targets != nil {
+		s.r.targets.Status(&buf)
+	}
+
+	if s.r.snapshotProgress != nil {
+		s.r.snapshotProgress.Status(&buf)
+	}
+
+	if b := s.r.currentBackfill(); b != nil {
+		b.Status(&buf)
+	}
+
+	if rx := s.r.currentReindex(); rx != nil {
+		rx.Status(&buf)
+	}
 
 	w.Write(buf.Bytes())
 }
@@ -60,11 +111,33 @@ func (s *stat) Run(addr string) {
 	srv := http.Server{}
 	mux := http.NewServeMux()
 	mux.Handle("/stat", s)
+	mux.Handle("/backfill", &adminHandler{s.r.c.AdminToken, &backfillHandler{s.r}})
+	mux.Handle("/reindex", &adminHandler{s.r.c.AdminToken, &reindexHandler{s.r}})
 	srv.Handler = mux
 
 	srv.Serve(s.l)
 }
 
+// adminHandler serves a handler changing the synced data only to requests with the admin token,
+// without an admin_token it is disabled.
+type adminHandler struct {
+	token string
+	h     http.Handler
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(a.token) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("set admin_token to enable this endpoint"))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	a.h.ServeHTTP(w, req)
+}
+
 func (s *stat) Close() {
 	if s.l != nil {
 		s.l.Close()
@@ -31,19 +31,42 @@ const (
 
 )
 
+// metaTimeFormat is the format of the synced_at metadata field, RFC 3339 with milliseconds
+const metaTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
 type posSaver struct {
 	pos   mysql.Position
 	force bool
 }
 
+// flushWaiter gets the result of committing all requests sent to the sync loop before it.
+type flushWaiter chan error
+
+// waitFlush waits until the requests sent to the sync loop before are committed.
+func (r *River) waitFlush() error {
+	w := make(flushWaiter, 1)
+	select {
+	case r.syncCh <- w:
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+
+	select {
+	case err := <-w:
+		return errors.Trace(err)
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
 type eventHandler struct {
 	r *River
 }
 
 func (h *eventHandler) OnRotate(e *replication.RotateEvent) error {
 	pos := mysql.Position{
-		string(e.NextLogName),
-		uint32(e.Position),
+		Name: string(e.NextLogName),
+		Pos:  uint32(e.Position),
 	}
 
 	h.r.syncCh <- posSaver{pos, true}
@@ -51,7 +74,11 @@ func (h *eventHandler) OnRotate(e *replication.RotateEvent) error {
 	return h.r.ctx.Err()
 }
 
-func (h *eventHandler) OnDDL(nextPos mysql.Position, _ *replication.QueryEvent) error {
+func (h *eventHandler) OnDDL(nextPos mysql.Position, e *replication.QueryEvent) error {
+	if err := h.r.onCreate(string(e.Schema), string(e.Query)); err != nil {
+		h.r.cancel()
+		return errors.Errorf("add rules of %s err %v, close sync", e.Query, err)
+	}
 	h.r.syncCh <- posSaver{nextPos, true}
 	return h.r.ctx.Err()
 }
@@ -62,21 +89,44 @@ func (h *eventHandler) OnXID(nextPos mysql.Position) error {
 }
 
 func (h *eventHandler) OnRow(e *canal.RowsEvent) error {
+	if b := h.r.currentBackfill(); b != nil {
+		reqs, err := b.onRow(e)
+		if err != nil {
+			h.r.cancel()
+			return errors.Errorf("backfill %s.%s err %v, close sync", b.rule.Schema, b.rule.Table, err)
+		}
+		if len(reqs) > 0 {
+			h.r.syncCh <- reqs
+		}
+	}
+
 	rule, ok := h.r.rules[ruleKey(e.Table.Schema, e.Table.Name)]
 	if !ok {
-		return nil
+		var err error
+		if rule, err = h.r.newSchemaRules(e.Table.Schema, e.Table.Name); err != nil {
+			h.r.cancel()
+			return errors.Errorf("add rules of %s.%s err %v, close sync", e.Table.Schema, e.Table.Name, err)
+		}
+		if rule == nil {
+			return nil
+		}
 	}
 	var reqs []*elasticwrapper.BulkRequest
 	var err error
-	switch e.Action {
-	case canal.InsertAction:
-		reqs, err = h.r.makeInsertRequest(rule, e.Rows)
-	case canal.DeleteAction:
-		reqs, err = h.r.makeDeleteRequest(rule, e.Rows)
-	case canal.UpdateAction:
-		reqs, err = h.r.makeUpdateRequest(rule, e.Rows)
-	default:
-		err = errors.Errorf("invalid rows action %s", e.Action)
+	if !rule.AuditOnly {
+		reqs, err = h.r.makeRowsRequest(rule, e)
+
+		if rx := h.r.currentReindex(); rx != nil && err == nil {
+			reqs = rx.dualWrite(rule, reqs)
+		}
+	}
+
+	// rows from mysqldump have no header, they are no change events
+	if err == nil && len(rule.AuditIndex) > 0 && e.Header != nil {
+		var auditReqs []*elasticwrapper.BulkRequest
+		if auditReqs, err = h.r.makeAuditRequest(rule, e); err == nil {
+			reqs = append(reqs, auditReqs...)
+		}
 	}
 
 	if err != nil {
@@ -112,10 +162,14 @@ func (r *River) syncLoop() {
 	reqs := make([]*elasticwrapper.BulkRequest, 0, 1024)
 
 	var pos mysql.Position
+	// positions saved once the required targets committed the requests before them
+	var pending []pendingPos
 
 	for {
 		needFlush := false
 		needSavePos := false
+		var snapshotSave *snapshotSaver
+		var waiter flushWaiter
 
 		select {
 		case v := <-r.syncCh:
@@ -131,6 +185,12 @@ func (r *River) syncLoop() {
 			case []*elasticwrapper.BulkRequest:
 				reqs = append(reqs, v...)
 				needFlush = len(reqs) >= bulkSize
+			case snapshotSaver:
+				needFlush = true
+				snapshotSave = &v
+			case flushWaiter:
+				needFlush = true
+				waiter = v
 			}
 		case <-ticker.C:
 			needFlush = true
@@ -140,7 +200,7 @@ func (r *River) syncLoop() {
 
 		if needFlush {
 			// TODO: retry some times?
-			if err := r.doBulk(reqs); err != nil {
+			if err := r.flushRequests(reqs); err != nil {
 				log.Errorf("do ES bulk err %v, close sync", err)
 				r.cancel()
 				return
@@ -148,62 +208,133 @@ func (r *River) syncLoop() {
 			reqs = reqs[0:0]
 		}
 
-		if needSavePos {
-			if err := r.master.Save(pos); err != nil {
-				log.Errorf("save sync position %s err %v, close sync", pos, err)
-				r.cancel()
-				return
-			}
+		if waiter != nil {
+			waiter <- r.flushSinks()
 		}
-	}
-}
 
-// for insert and delete
-func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]*elasticwrapper.BulkRequest, error) {
-	reqs := make([]*elasticwrapper.BulkRequest, 0, len(rows))
+		// the rows of the chunk must be committed before the resume skips them
+		if snapshotSave != nil {
+			pending = append(pending, pendingPos{snapshot: snapshotSave, queued: r.targets.marks()})
+		}
 
-	for _, values := range rows {
-		id, err := r.getDocID(rule, values)
-		if err != nil {
-			return nil, errors.Trace(err)
+		if needSavePos {
+			pending = append(pending, pendingPos{pos: pos, queued: r.targets.marks()})
 		}
 
-		parentID := ""
-		if len(rule.Parent) > 0 {
-			if parentID, err = r.getParentID(rule, values, rule.Parent); err != nil {
-				return nil, errors.Trace(err)
+		var err error
+		if pending, err = r.savePending(pending); err != nil {
+			log.Errorf("save sync progress err %v, close sync", err)
+			r.cancel()
+			return
+		}
+	}
+}
+
+// flushRequests coalesces and writes the requests. A run of parent deletes cascading to their children
+// ends a batch: the requests up to them are written and the children deleted before the rest goes out,
+// so a child written after its parent was deleted survives.
+func (r *River) flushRequests(reqs []*elasticwrapper.BulkRequest) error {
+	for len(reqs) > 0 {
+		start, end := cascadeRun(reqs)
+
+		batch, saved := coalesceRequests(reqs[:end])
+		r.st.CoalescedNum.Add(int64(saved))
+		if err := r.doBulk(batch); err != nil {
+			return errors.Trace(err)
+		}
+		if start < end {
+			if err := r.targets.cascade(reqs[start:end]); err != nil {
+				return errors.Trace(err)
 			}
 		}
+		reqs = reqs[end:]
+	}
+	return nil
+}
 
-		req := &elasticwrapper.BulkRequest{Index: rule.Index, Type: rule.Type, ID: id, Parent: parentID}
+// cascadeRun returns the first run of Elasticsearch requests cascading to children, empty at the end
+// of the requests if there is none.
+func cascadeRun(reqs []*elasticwrapper.BulkRequest) (int, int) {
+	cascades := func(req *elasticwrapper.BulkRequest) bool {
+		return len(req.Cascade) > 0 && len(req.Sink) == 0
+	}
 
-		if len(rule.IdPrefix) > 0 {
-			req.ID = rule.IdPrefix + ":" + req.ID
-		}
+	start := 0
+	for start < len(reqs) && !cascades(reqs[start]) {
+		start++
+	}
+	end := start
+	for end < len(reqs) && cascades(reqs[end]) {
+		end++
+	}
+	return start, end
+}
 
-		if rule.ConcatField != "" {
-			req.ListRequest = true
+// savePending saves the snapshot progress and the last position whose requests were committed by
+// the required targets and returns the ones still waiting.
+func (r *River) savePending(pending []pendingPos) ([]pendingPos, error) {
+	n := 0
+	var pos *mysql.Position
+	for ; n < len(pending) && r.targets.committed(pending[n].queued); n++ {
+		if pending[n].snapshot == nil {
+			pos = &pending[n].pos
+			continue
 		}
+		if err := r.snapshotProgress.Update(*pending[n].snapshot); err != nil {
+			return pending, errors.Annotate(err, "snapshot progress")
+		}
+	}
+	if n == 0 {
+		return pending, nil
+	}
 
-		if len(rule.JoinField) > 0 {
-			req.JoinField = rule.JoinField
+	if pos != nil {
+		if err := r.master.Save(*pos); err != nil {
+			return pending, errors.Annotatef(err, "position %s", *pos)
 		}
-		if len(rule.JoinFieldName) > 0 {
-			req.JoinFieldName = rule.JoinFieldName
+	}
+	return pending[:copy(pending, pending[n:])], nil
+}
+
+// for insert and delete
+func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]*elasticwrapper.BulkRequest, error) {
+	if rule.IsLink() {
+		return r.makeLinkRequest(rule, action, rows)
+	}
+	if rule.IsAggregate() {
+		return r.makeAggregateRequest(rule, action, rows)
+	}
+
+	reqs := make([]*elasticwrapper.BulkRequest, 0, len(rows))
+
+	for _, values := range rows {
+		req, err := r.newBulkRequest(rule, values)
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
-		req.HardCrud = rule.HardCrud
 
 		if action == canal.DeleteAction {
+			if rule.IgnoreDeletes() {
+				continue
+			}
 			if !rule.HardCrud {
+				// every field the row wrote is removed, the ones its NULLs removed are gone already
 				r.makeInsertReqData(req, rule, values)
+				req.DeleteFields = nil
+			} else if len(rule.cascadeRules) > 0 {
+				req.Cascade = r.cascadeQueries(rule, req.ID)
 			}
 			req.Action = elasticwrapper.ActionDelete
 			r.st.DeleteNum.Add(1)
 		} else {
 			r.makeInsertReqData(req, rule, values)
-			if rule.HardCrud {
+			addSchemaField(req, rule)
+			switch rule.WritePolicy {
+			case WritePolicyHard:
 				req.Action = elasticwrapper.ActionIndex
-			} else {
+			case WritePolicyCreateOnly:
+				req.Action = elasticwrapper.ActionCreate
+			default:
 				req.Action = elasticwrapper.ActionUpdate //upsert in this case (don't override complete document with the data)
 			}
 			req.Initial = true
@@ -216,6 +347,104 @@ func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]
 	return reqs, nil
 }
 
+// newBulkRequest returns a request for the document of the row, without action and data.
+func (r *River) newBulkRequest(rule *Rule, values []interface{}) (*elasticwrapper.BulkRequest, error) {
+	id, err := r.getDocID(rule, values)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	parentID := ""
+	if len(rule.Parent) > 0 {
+		if parentID, err = r.getParentID(rule, values, rule.Parent); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	req := &elasticwrapper.BulkRequest{Index: rule.Index, Type: rule.Type, ID: id, Parent: parentID}
+
+	if len(rule.IdPrefix) > 0 {
+		req.ID = rule.IdPrefix + ":" + req.ID
+	}
+
+	if rule.ConcatField != "" {
+		req.ListRequest = true
+		req.ListKey = rule.ConcatField
+	}
+
+	if len(rule.JoinField) > 0 {
+		req.JoinField = rule.JoinField
+	}
+	if len(rule.JoinFieldName) > 0 {
+		req.JoinFieldName = rule.JoinFieldName
+	}
+	req.HardCrud = rule.HardCrud
+
+	req.UpdateOnly = rule.WritePolicy == WritePolicyUpdateOnly
+	req.Sink = rule.Sink
+
+	return req, nil
+}
+
+// makeRowsRequest turns the rows of a rows event into requests, with the metadata fields of the rule.
+// Rows which don't come from the binlog, like the snapshot rows, have no event header.
+func (r *River) makeRowsRequest(rule *Rule, e *canal.RowsEvent) ([]*elasticwrapper.BulkRequest, error) {
+	var reqs []*elasticwrapper.BulkRequest
+	var err error
+	switch e.Action {
+	case canal.InsertAction:
+		reqs, err = r.makeInsertRequest(rule, e.Rows)
+	case canal.DeleteAction:
+		reqs, err = r.makeDeleteRequest(rule, e.Rows)
+	case canal.UpdateAction:
+		reqs, err = r.makeUpdateRequest(rule, e.Rows)
+	default:
+		err = errors.Errorf("invalid rows action %s", e.Action)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r.makeMetaData(rule, e, reqs)
+	return reqs, nil
+}
+
+// makeMetaData adds the metadata fields of the rule to the documents the requests write.
+// Deletes, link and aggregate requests write no document of the row, they are left alone.
+func (r *River) makeMetaData(rule *Rule, e *canal.RowsEvent, reqs []*elasticwrapper.BulkRequest) {
+	if !rule.Meta.enabled() {
+		return
+	}
+
+	meta := make(map[string]interface{})
+	set := func(field string, value interface{}) {
+		if len(field) > 0 {
+			meta[field] = value
+		}
+	}
+	set(rule.Meta.SyncedAt, time.Now().UTC().Format(metaTimeFormat))
+	set(rule.Meta.Action, e.Action)
+	set(rule.Meta.Schema, rule.Schema)
+	set(rule.Meta.Table, rule.Table)
+	if e.Header != nil {
+		set(rule.Meta.BinlogFile, e.Position.Name)
+		set(rule.Meta.BinlogPos, e.Position.Pos)
+		set(rule.Meta.Timestamp, time.Unix(int64(e.Header.Timestamp), 0).UTC().Format(time.RFC3339))
+	}
+	if len(e.GTID) > 0 {
+		set(rule.Meta.GTID, e.GTID)
+	}
+
+	for _, req := range reqs {
+		if req.Action == elasticwrapper.ActionDelete || req.ListRequest || req.Aggregate || req.Data == nil {
+			continue
+		}
+		for field, value := range meta {
+			req.Data[field] = value
+		}
+	}
+}
+
 func (r *River) makeInsertRequest(rule *Rule, rows [][]interface{}) ([]*elasticwrapper.BulkRequest, error) {
 	return r.makeRequest(rule, canal.InsertAction, rows)
 }
@@ -225,6 +454,12 @@ func (r *River) makeDeleteRequest(rule *Rule, rows [][]interface{}) ([]*elasticw
 }
 
 func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}) ([]*elasticwrapper.BulkRequest, error) {
+	if rule.IsLink() {
+		return r.makeLinkRequest(rule, canal.UpdateAction, rows)
+	}
+	if rule.IsAggregate() {
+		return r.makeAggregateRequest(rule, canal.UpdateAction, rows)
+	}
 	if len(rows)%2 != 0 {
 		return nil, errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(rows))
 	}
@@ -232,39 +467,22 @@ func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}) ([]*elasticw
 	reqs := make([]*elasticwrapper.BulkRequest, 0, len(rows))
 
 	for i := 0; i < len(rows); i += 2 {
-		beforeID, err := r.getDocID(rule, rows[i])
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-
-		beforeParentID := ""
-		if len(rule.Parent) > 0 {
-			if beforeParentID, err = r.getParentID(rule, rows[i], rule.Parent); err != nil {
-				return nil, errors.Trace(err)
-			}
-		}
+		// Simplify .. no support for changing PK of rows as this would complicate things too much
+		req, err := r.newBulkRequest(rule, rows[i])
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
-		// Simplify .. no support for changing PK of rows as this would complicate things too much
-		req := &elasticwrapper.BulkRequest{Index: rule.Index, Type: rule.Type, ID: beforeID, Parent: beforeParentID, HardCrud: rule.HardCrud}
-
-		if rule.ConcatField != "" {
-			req.ListRequest = true
-		}
-
-		if len(rule.IdPrefix) > 0 {
-			req.ID = rule.IdPrefix + ":" + req.ID
-		}
 
-		if len(rule.JoinField) > 0 {
-			req.JoinField = rule.JoinField
-		}
-		if len(rule.JoinFieldName) > 0 {
-			req.JoinFieldName = rule.JoinFieldName
+		switch rule.WritePolicy {
+		case WritePolicyCreateOnly:
+			// never overwrite, only create the document when it is still missing
+			r.makeInsertReqData(req, rule, rows[i+1])
+			req.Action = elasticwrapper.ActionCreate
+			req.Initial = true
+		default:
+			r.makeUpdateReqData(req, rule, rows[i], rows[i+1])
 		}
-
-		r.makeUpdateReqData(req, rule, rows[i], rows[i+1])
+		addSchemaField(req, rule)
 		r.st.UpdateNum.Add(1)
 
 		reqs = append(reqs, req)
@@ -383,9 +601,6 @@ func (r *River) getFieldParts(k string, v string) (string, string, string) {
 
 func (r *River) makeInsertReqData(req *elasticwrapper.BulkRequest, rule *Rule, values []interface{}) {
 	req.Data = make(map[string]interface{}, len(values))
-	if !rule.HardCrud {
-		req.Action = elasticwrapper.ActionUpdate
-	}
 	concatField := bytes.NewBufferString("")
 	if rule.ConcatField != "" {
 		concatField.WriteString(rule.ConcatPrefix)
@@ -398,6 +613,12 @@ func (r *River) makeInsertReqData(req *elasticwrapper.BulkRequest, rule *Rule, v
 		if i >= len(values) {
 			continue
 		}
+		if jc := rule.jsonColumn(c.Name); jc != nil {
+			r.makeJSONInsertData(req, jc, &c, values[i])
+			if !jc.keepsColumn() {
+				continue
+			}
+		}
 		mapped := false
 		for k, v := range rule.FieldMapping {
 			mysql, elasticwrapper, fieldType := r.getFieldParts(k, v)
@@ -405,6 +626,9 @@ func (r *River) makeInsertReqData(req *elasticwrapper.BulkRequest, rule *Rule, v
 				mapped = true
 				v := r.makeReqColumnData(&c, values[i])
 				if v == nil {
+					if fieldType != fieldTypeGeoLat && fieldType != fieldTypeGeoLon {
+						r.makeNullData(req, rule, c.Name, elasticwrapper, false)
+					}
 					continue
 				}
 				if fieldType == fieldTypeList {
@@ -446,6 +670,8 @@ func (r *River) makeInsertReqData(req *elasticwrapper.BulkRequest, rule *Rule, v
 				} else {
 					req.Data[c.Name] = v
 				}
+			} else if rule.ConcatField == "" {
+				r.makeNullData(req, rule, c.Name, c.Name, false)
 			}
 		}
 	}
@@ -479,6 +705,12 @@ func (r *River) makeUpdateReqData(req *elasticwrapper.BulkRequest, rule *Rule,
 			//nothing changed
 			continue
 		}
+		if jc := rule.jsonColumn(c.Name); jc != nil {
+			r.makeJSONUpdateData(req, jc, &c, beforeValues[i], afterValues[i])
+			if !jc.keepsColumn() {
+				continue
+			}
+		}
 		for k, v := range rule.FieldMapping {
 			mysql, elasticwrapper, fieldType := r.getFieldParts(k, v)
 			if mysql == c.Name {
@@ -487,7 +719,11 @@ func (r *River) makeUpdateReqData(req *elasticwrapper.BulkRequest, rule *Rule,
 				v := r.makeReqColumnData(&c, afterValues[i])
 
 				if v == nil {
-					req.DeleteFields[elasticwrapper] = true
+					if fieldType == fieldTypeGeoLat || fieldType == fieldTypeGeoLon {
+						req.DeleteFields[elasticwrapper] = true
+					} else {
+						r.makeNullData(req, rule, c.Name, elasticwrapper, true)
+					}
 					continue
 				}
 				str, ok := v.(string)
@@ -525,7 +761,7 @@ func (r *River) makeUpdateReqData(req *elasticwrapper.BulkRequest, rule *Rule,
 			v := r.makeReqColumnData(&c, afterValues[i])
 
 			if v == nil {
-				req.DeleteFields[c.Name] = true
+				r.makeNullData(req, rule, c.Name, c.Name, true)
 			} else {
 				if rule.ConcatField != "" {
 					concatField.WriteString("_")
@@ -593,17 +829,24 @@ func (r *River) doBulk(reqs []*elasticwrapper.BulkRequest) error {
 		return nil
 	}
 
-	if resp, err := r.es.Bulk(reqs); err != nil {
-		log.Errorf("sync docs err %v after binlog %s", err, r.canal.SyncedPosition())
-		return errors.Trace(err)
-	} else if resp.Code / 100 == 2 || resp.Errors {
-		for i := 0; i < len(resp.Items); i++ {
-			for action, item := range resp.Items[i] {
-				if len(item.Error) > 0 {
-					log.Errorf("%s index: %s, type: %s, id: %s, status: %d, error: %s",
-						action, item.Index, item.Type, item.ID, item.Status, item.Error)
-				}
-			}
+	// one batch per sink, in the order of the requests
+	var names []string
+	batches := make(map[string][]*elasticwrapper.BulkRequest)
+	for _, req := range reqs {
+		if _, ok := batches[req.Sink]; !ok {
+			names = append(names, req.Sink)
+		}
+		batches[req.Sink] = append(batches[req.Sink], req)
+	}
+
+	for _, name := range names {
+		s, ok := r.sinks[name]
+		if !ok {
+			return errors.Errorf("sink %s not defined", name)
+		}
+		if err := s.Write(batches[name]); err != nil {
+			log.Errorf("sync docs to sink %s err %v after binlog %s", sinkName(name), err, r.canal.SyncedPosition())
+			return errors.Trace(err)
 		}
 	}
 
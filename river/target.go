@@ -0,0 +1,554 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql-elasticsearch/sink"
+	"github.com/jrots/go-mysql/mysql"
+	"github.com/siddontang/go/sync2"
+)
+
+// What to do when a target fails to commit a bulk request
+const (
+	// stop syncing, the position is not saved past the failed requests (default)
+	FailurePolicyBlock = "block"
+	// log the failed requests and go on
+	FailurePolicySkip = "skip"
+	// append the failed requests to the dead letter file and go on
+	FailurePolicyDLQ = "dlq"
+)
+
+// esTarget is one Elasticsearch cluster every document is written to.
+type esTarget struct {
+	name     string
+	client   *elasticwrapper.Client
+	required bool
+	policy   string
+	dlq      *sink.File
+
+	failed  sync2.AtomicInt64
+	blocked sync2.AtomicBool
+
+	// bulk actions by outcome
+	outcomes map[string]*sync2.AtomicInt64
+	// requests written again after a conflict or rejection, and those not committed yet
+	retried  sync2.AtomicInt64
+	retrying sync2.AtomicInt64
+	// children deleted by cascading parent deletes, and the delete by queries which failed
+	cascaded      sync2.AtomicInt64
+	cascadeFailed sync2.AtomicInt64
+
+	// the requests written for every document, in order, until they and the ones before are done,
+	// a retry leaves out what later requests for the document wrote
+	docsLock sync.Mutex
+	docs     map[string][]*docWrite
+}
+
+// docWrite is a request written for a document, done once the ack handler saw it.
+type docWrite struct {
+	req  *elasticwrapper.BulkRequest
+	done bool
+}
+
+// targetDocKey returns the document of the request in a target.
+func targetDocKey(req *elasticwrapper.BulkRequest) string {
+	return req.Index + "/" + req.Type + "/" + req.ID
+}
+
+// maxRetries is how often a request is written again after a version conflict or a rejection.
+const maxRetries = 3
+
+// esTargets writes the requests to all Elasticsearch targets, it is the Elasticsearch sink.
+type esTargets struct {
+	r       *River
+	targets []*esTarget
+	ack     func(reqs []*elasticwrapper.BulkRequest, err error)
+}
+
+// pendingPos is a binlog position, or the snapshot progress of a chunk, waiting for the required
+// targets to commit the bulk actions queued before it.
+type pendingPos struct {
+	pos      mysql.Position
+	snapshot *snapshotSaver
+	queued   []int64
+}
+
+// newESTargets creates a client for every target of the config, or for es_addr if there are none.
+// The clients get the dry run output and the version of base.
+func (r *River) newESTargets(base elasticwrapper.ClientConfig) (*esTargets, error) {
+	cfgs := r.c.ESTargets
+	if len(cfgs) == 0 || len(r.c.DryRun) > 0 {
+		// failed requests of es_addr are only logged, like before targets
+		cfgs = []ESTargetConfig{{
+			Name:        "default",
+			Addr:        r.c.ESAddr,
+			User:        r.c.ESUser,
+			Password:    r.c.ESPassword,
+			APIKey:      r.c.ESAPIKey,
+			BearerToken: r.c.ESBearerToken,
+
+			CACert:             r.c.ESCACert,
+			ClientCert:         r.c.ESClientCert,
+			ClientKey:          r.c.ESClientKey,
+			InsecureSkipVerify: r.c.ESInsecureSkipVerify,
+
+			Required:      true,
+			FailurePolicy: FailurePolicySkip,
+		}}
+	}
+
+	ts := &esTargets{r: r}
+	required := false
+	names := make(map[string]struct{}, len(cfgs))
+	for _, cfg := range cfgs {
+		if len(cfg.Name) == 0 {
+			return nil, errors.Errorf("empty es_target name not allowed")
+		}
+		if _, ok := names[cfg.Name]; ok {
+			return nil, errors.Errorf("duplicate es_target %s", cfg.Name)
+		}
+		names[cfg.Name] = struct{}{}
+
+		auths := 0
+		for _, set := range []bool{len(cfg.User) > 0, len(cfg.APIKey) > 0, len(cfg.BearerToken) > 0} {
+			if set {
+				auths++
+			}
+		}
+		if auths > 1 {
+			return nil, errors.Errorf("es_target %s must have only one of user, api_key and bearer_token", cfg.Name)
+		}
+
+		var err error
+		t := &esTarget{name: cfg.Name, required: cfg.Required, policy: cfg.FailurePolicy}
+		t.docs = make(map[string][]*docWrite)
+		t.outcomes = make(map[string]*sync2.AtomicInt64)
+		for _, outcome := range []string{elasticwrapper.OutcomeSuccess, elasticwrapper.OutcomeConflict, elasticwrapper.OutcomeNotFound,
+			elasticwrapper.OutcomeMappingError, elasticwrapper.OutcomeRejected, elasticwrapper.OutcomeFailed} {
+			t.outcomes[outcome] = new(sync2.AtomicInt64)
+		}
+		required = required || t.required
+
+		switch t.policy {
+		case "":
+			t.policy = FailurePolicyBlock
+		case FailurePolicyBlock, FailurePolicySkip:
+		case FailurePolicyDLQ:
+			if len(cfg.DLQPath) == 0 {
+				return nil, errors.Errorf("es_target %s with failure_policy dlq must have a dlq_path", cfg.Name)
+			}
+			if t.dlq, err = sink.NewFile(cfg.DLQPath); err != nil {
+				return nil, errors.Trace(err)
+			}
+		default:
+			return nil, errors.Errorf("invalid failure_policy %s of es_target %s", t.policy, cfg.Name)
+		}
+
+		clientCfg := base
+		clientCfg.Addr = cfg.Addr
+		clientCfg.User = cfg.User
+		clientCfg.Password = cfg.Password
+		clientCfg.APIKey = cfg.APIKey
+		clientCfg.BearerToken = cfg.BearerToken
+		if clientCfg.TLS, err = esTLS(&cfg); err != nil {
+			return nil, errors.Annotatef(err, "es_target %s", cfg.Name)
+		}
+		t.client = elasticwrapper.NewClient(&clientCfg)
+		t.client.SetItemHandler(ts.onItems(t))
+		t.client.SetAckHandler(ts.onAck(t))
+		ts.targets = append(ts.targets, t)
+	}
+
+	if !required {
+		// the position must wait for one target at least
+		ts.targets[0].required = true
+	}
+
+	return ts, nil
+}
+
+// primary is the first target, verify and the version checks use it.
+func (ts *esTargets) primary() *elasticwrapper.Client {
+	return ts.targets[0].client
+}
+
+// checkVersions checks all targets take the same requests, with or without types.
+func (ts *esTargets) checkVersions() error {
+	primary := ts.primary().Version()
+	for _, t := range ts.targets[1:] {
+		version := t.client.Version()
+		if version.Typeless() != primary.Typeless() {
+			return errors.Errorf("es_target %s (%s) and %s (%s) can't be mixed, one has types and the other not",
+				t.name, version, ts.targets[0].name, primary)
+		}
+	}
+	return nil
+}
+
+// putScripts installs the stored scripts on every target, a dry run has no cluster to install them on.
+func (ts *esTargets) putScripts() error {
+	if len(ts.r.c.DryRun) > 0 {
+		return nil
+	}
+
+	for _, t := range ts.targets {
+		if err := t.client.PutScripts(); err != nil {
+			return errors.Annotatef(err, "es_target %s", t.name)
+		}
+	}
+	return nil
+}
+
+func (ts *esTargets) onAck(t *esTarget) func(reqs []*elasticwrapper.BulkRequest, err error) {
+	return func(reqs []*elasticwrapper.BulkRequest, err error) {
+		t.done(reqs)
+		if err != nil {
+			ts.fail(t, reqs, err)
+		}
+
+		if t == ts.targets[0] && ts.ack != nil {
+			ts.ack(reqs, err)
+		}
+	}
+}
+
+// fail applies the failure policy of the target to the failed requests.
+func (ts *esTargets) fail(t *esTarget, reqs []*elasticwrapper.BulkRequest, err error) {
+	t.failed.Add(int64(len(reqs)))
+
+	switch t.policy {
+	case FailurePolicySkip:
+		log.Errorf("es_target %s failed to write %d requests, skip them: %v", t.name, len(reqs), err)
+	case FailurePolicyDLQ:
+		log.Errorf("es_target %s failed to write %d requests, write them to the dead letter file: %v", t.name, len(reqs), err)
+		if dlqErr := t.dlq.Write(reqs); dlqErr != nil {
+			log.Errorf("es_target %s failed to write the dead letter file: %v, close sync", t.name, dlqErr)
+			t.blocked.Set(true)
+			ts.r.cancel()
+		}
+	default:
+		log.Errorf("es_target %s failed to write %d requests: %v, close sync", t.name, len(reqs), err)
+		t.blocked.Set(true)
+		ts.r.cancel()
+	}
+}
+
+// onItems counts the outcome of every bulk action of a commit. Requests with a version conflict
+// or rejected by an overloaded cluster are written again, up to maxRetries times, the failure policy
+// gets the others which failed.
+// A missing document is expected, e.g. for update_only requests, and not a failure, as is an existing
+// document for a create of create_only.
+func (ts *esTargets) onItems(t *esTarget) func(results []*elasticwrapper.ItemResult) {
+	return func(results []*elasticwrapper.ItemResult) {
+		var retries, failed []*elasticwrapper.BulkRequest
+		var firstErr string
+		// a request with deleted fields has several bulk actions, handle it once
+		seen := make(map[*elasticwrapper.BulkRequest]struct{}, len(results))
+		for _, res := range results {
+			t.outcomes[res.Outcome].Add(1)
+
+			if _, ok := seen[res.Request]; ok {
+				continue
+			}
+
+			switch res.Outcome {
+			case elasticwrapper.OutcomeSuccess, elasticwrapper.OutcomeNotFound:
+				continue
+			case elasticwrapper.OutcomeConflict, elasticwrapper.OutcomeRejected:
+				if res.Outcome == elasticwrapper.OutcomeConflict && res.Action == elasticwrapper.ActionCreate {
+					// the document exists, create_only keeps it
+					seen[res.Request] = struct{}{}
+					continue
+				}
+				if res.Request.Retries < maxRetries {
+					seen[res.Request] = struct{}{}
+					retries = append(retries, res.Request)
+					continue
+				}
+			}
+
+			log.Errorf("es_target %s %s index: %s, type: %s, id: %s, status: %d, error: %s",
+				t.name, res.Action, res.Request.Index, res.Request.Type, res.Request.ID, res.Status, res.Error)
+			seen[res.Request] = struct{}{}
+			failed = append(failed, res.Request)
+			if len(firstErr) == 0 {
+				firstErr = res.Error
+			}
+		}
+
+		// the retried requests of an earlier commit are done
+		done := make(map[*elasticwrapper.BulkRequest]struct{})
+		for _, res := range results {
+			if res.Request.Retries > 0 {
+				done[res.Request] = struct{}{}
+			}
+		}
+		if len(retries) > 0 {
+			ts.retry(t, retries)
+		}
+		t.retrying.Add(-int64(len(done)))
+
+		if len(failed) > 0 {
+			ts.fail(t, failed, errors.Errorf("%d requests failed, first error %s", len(failed), firstErr))
+		}
+	}
+}
+
+// retry writes copies of the requests to the target again after a backoff. It doesn't wait,
+// the bulk processor calls the item handler from its worker, which must go on to take them.
+// A copy only writes what no request written for the document since changes, the retry of an
+// older version must not overwrite it.
+func (ts *esTargets) retry(t *esTarget, reqs []*elasticwrapper.BulkRequest) {
+	copies := make([]*elasticwrapper.BulkRequest, len(reqs))
+	for i, req := range reqs {
+		c := *req
+		c.Retries++
+		copies[i] = &c
+		t.replace(req, &c)
+	}
+
+	// 100ms, 200ms, 400ms
+	backoff := time.Duration(1<<uint(copies[0].Retries-1)) * 100 * time.Millisecond
+	log.Warnf("es_target %s write %d requests again in %s after a conflict or rejection", t.name, len(copies), backoff)
+	t.retried.Add(int64(len(copies)))
+	// counted before the commit of the conflicts, so the position waits for them
+	t.retrying.Add(int64(len(copies)))
+	go func() {
+		time.Sleep(backoff)
+
+		writes := make([]*elasticwrapper.BulkRequest, 0, len(copies))
+		var stale []*elasticwrapper.BulkRequest
+		for _, c := range copies {
+			if w := t.unwritten(c); w != nil {
+				writes = append(writes, w)
+			} else {
+				stale = append(stale, c)
+			}
+		}
+		if len(stale) > 0 {
+			log.Infof("es_target %s drop %d retries, later requests rewrote their documents", t.name, len(stale))
+			t.done(stale)
+			t.retrying.Add(-int64(len(stale)))
+		}
+		if len(writes) == 0 {
+			return
+		}
+
+		if err := t.client.Write(writes); err != nil {
+			t.done(writes)
+			t.retrying.Add(-int64(len(writes)))
+			ts.fail(t, writes, err)
+		}
+	}()
+}
+
+// written adds the requests to the requests written for their documents.
+func (t *esTarget) written(reqs []*elasticwrapper.BulkRequest) {
+	t.docsLock.Lock()
+	defer t.docsLock.Unlock()
+
+	for _, req := range reqs {
+		key := targetDocKey(req)
+		t.docs[key] = append(t.docs[key], &docWrite{req: req})
+	}
+}
+
+// done marks the requests done, the documents forget them once the requests before are done too.
+func (t *esTarget) done(reqs []*elasticwrapper.BulkRequest) {
+	t.docsLock.Lock()
+	defer t.docsLock.Unlock()
+
+	for _, req := range reqs {
+		key := targetDocKey(req)
+		writes := t.docs[key]
+		for _, w := range writes {
+			if w.req == req {
+				w.done = true
+				break
+			}
+		}
+		for len(writes) > 0 && writes[0].done {
+			writes = writes[1:]
+		}
+		if len(writes) == 0 {
+			delete(t.docs, key)
+		} else {
+			t.docs[key] = writes
+		}
+	}
+}
+
+// replace puts the retry in the place of the request it copies.
+func (t *esTarget) replace(req *elasticwrapper.BulkRequest, retry *elasticwrapper.BulkRequest) {
+	t.docsLock.Lock()
+	defer t.docsLock.Unlock()
+
+	for _, w := range t.docs[targetDocKey(req)] {
+		if w.req == req {
+			w.req = retry
+			return
+		}
+	}
+}
+
+// unwritten returns the request without the fields the requests written for the document after it
+// change, with a replaced or deleted document or no field left it returns nil.
+// List and aggregate scripts add their change to what the document has, they are written as they are.
+func (t *esTarget) unwritten(req *elasticwrapper.BulkRequest) *elasticwrapper.BulkRequest {
+	if req.ListRequest || req.Aggregate {
+		return req
+	}
+
+	t.docsLock.Lock()
+	defer t.docsLock.Unlock()
+
+	var later []*elasticwrapper.BulkRequest
+	writes := t.docs[targetDocKey(req)]
+	for i, w := range writes {
+		if w.req == req {
+			for _, l := range writes[i+1:] {
+				later = append(later, l.req)
+			}
+			break
+		}
+	}
+	if len(later) == 0 {
+		return req
+	}
+	if req.Action == elasticwrapper.ActionDelete && req.HardCrud {
+		return nil
+	}
+
+	changed := make(map[string]struct{})
+	for _, l := range later {
+		switch {
+		case l.ListRequest:
+			changed[l.ListKey] = struct{}{}
+		case l.Aggregate:
+		case l.Action == elasticwrapper.ActionIndex, l.Action == elasticwrapper.ActionCreate,
+			l.Action == elasticwrapper.ActionDelete && l.HardCrud:
+			return nil
+		default:
+			for field := range l.Data {
+				changed[field] = struct{}{}
+			}
+			for field := range l.DeleteFields {
+				changed[field] = struct{}{}
+			}
+		}
+	}
+
+	c := *req
+	c.Data = make(map[string]interface{}, len(req.Data))
+	for field, v := range req.Data {
+		if _, ok := changed[field]; !ok {
+			c.Data[field] = v
+		}
+	}
+	c.DeleteFields = make(map[string]interface{}, len(req.DeleteFields))
+	for field, v := range req.DeleteFields {
+		if _, ok := changed[field]; !ok {
+			c.DeleteFields[field] = v
+		}
+	}
+	if len(c.Data) == 0 && len(c.DeleteFields) == 0 {
+		return nil
+	}
+	if c.Action == elasticwrapper.ActionIndex || c.Action == elasticwrapper.ActionCreate {
+		// the rest of the document merged into what the later requests wrote
+		c.Action = elasticwrapper.ActionUpdate
+	}
+
+	// the trimmed copy takes the place of the retry
+	for _, w := range writes {
+		if w.req == req {
+			w.req = &c
+		}
+	}
+	return &c
+}
+
+func (ts *esTargets) Write(reqs []*elasticwrapper.BulkRequest) error {
+	for _, t := range ts.targets {
+		t.written(reqs)
+		if err := t.client.Write(reqs); err != nil {
+			t.done(reqs)
+			return errors.Annotatef(err, "es_target %s", t.name)
+		}
+	}
+	return nil
+}
+
+func (ts *esTargets) Flush() error {
+	for _, t := range ts.targets {
+		if err := t.client.Flush(); err != nil {
+			return errors.Annotatef(err, "es_target %s", t.name)
+		}
+	}
+	return nil
+}
+
+// SetAckHandler sets the handler called for the requests of the primary target.
+func (ts *esTargets) SetAckHandler(fn func(reqs []*elasticwrapper.BulkRequest, err error)) {
+	ts.ack = fn
+}
+
+func (ts *esTargets) Close() error {
+	var err error
+	for _, t := range ts.targets {
+		if closeErr := t.client.Close(); closeErr != nil && err == nil {
+			err = errors.Annotatef(closeErr, "es_target %s", t.name)
+		}
+		if t.dlq != nil {
+			t.dlq.Close()
+		}
+	}
+	return err
+}
+
+// marks returns the number of bulk actions queued in every required target.
+func (ts *esTargets) marks() []int64 {
+	queued := make([]int64, 0, len(ts.targets))
+	for _, t := range ts.targets {
+		if t.required {
+			queued = append(queued, t.client.Queued())
+		}
+	}
+	return queued
+}
+
+// committed reports whether the required targets committed the bulk actions of the marks.
+func (ts *esTargets) committed(queued []int64) bool {
+	i := 0
+	for _, t := range ts.targets {
+		if !t.required {
+			continue
+		}
+		if t.blocked.Get() || t.retrying.Get() > 0 || t.client.Committed() < queued[i] {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// Status writes the state of every target for the stat endpoint.
+func (ts *esTargets) Status(buf *bytes.Buffer) {
+	for _, t := range ts.targets {
+		buf.WriteString(fmt.Sprintf("es_target:%s required:%v queued:%d committed:%d failed:%d blocked:%v bulk_actions:%d\n",
+			t.name, t.required, t.client.Queued(), t.client.Committed(), t.failed.Get(), t.blocked.Get(), t.client.BulkActions()))
+		buf.WriteString(fmt.Sprintf("es_target_items:%s success:%d conflict:%d not_found:%d mapping_error:%d rejected:%d failed:%d retried:%d cascaded:%d cascade_failed:%d\n",
+			t.name, t.outcomes[elasticwrapper.OutcomeSuccess].Get(), t.outcomes[elasticwrapper.OutcomeConflict].Get(),
+			t.outcomes[elasticwrapper.OutcomeNotFound].Get(), t.outcomes[elasticwrapper.OutcomeMappingError].Get(),
+			t.outcomes[elasticwrapper.OutcomeRejected].Get(), t.outcomes[elasticwrapper.OutcomeFailed].Get(), t.retried.Get(),
+			t.cascaded.Get(), t.cascadeFailed.Get()))
+	}
+}
+
+var _ sink.Sink = (*esTargets)(nil)
@@ -0,0 +1,239 @@
+package river
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/mysql"
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"golang.org/x/net/context"
+)
+
+type targetTestSuite struct{}
+
+var _ = Suite(&targetTestSuite{})
+
+func (s *targetTestSuite) newRiver(targets ...ESTargetConfig) *River {
+	r := &River{c: &Config{ESTargets: targets}, master: &masterInfo{}}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+func (s *targetTestSuite) TestConfig(c *C) {
+	var buf bytes.Buffer
+	base := elasticwrapper.ClientConfig{DryRun: &buf}
+
+	r := s.newRiver()
+	ts, err := r.newESTargets(base)
+	c.Assert(err, IsNil)
+	c.Assert(ts.targets, HasLen, 1)
+	c.Assert(ts.targets[0].required, IsTrue)
+	c.Assert(ts.targets[0].policy, Equals, FailurePolicySkip)
+
+	r = s.newRiver(ESTargetConfig{Name: "a"}, ESTargetConfig{Name: "b", FailurePolicy: FailurePolicySkip})
+	ts, err = r.newESTargets(base)
+	c.Assert(err, IsNil)
+	c.Assert(ts.targets, HasLen, 2)
+	c.Assert(ts.targets[0].required, IsTrue)
+	c.Assert(ts.targets[0].policy, Equals, FailurePolicyBlock)
+	c.Assert(ts.targets[1].required, IsFalse)
+
+	for _, targets := range [][]ESTargetConfig{
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: ""}},
+		{{Name: "a", FailurePolicy: "retry"}},
+		{{Name: "a", FailurePolicy: FailurePolicyDLQ}},
+	} {
+		_, err = s.newRiver(targets...).newESTargets(base)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *targetTestSuite) TestCheckpoint(c *C) {
+	var buf bytes.Buffer
+	base := elasticwrapper.ClientConfig{DryRun: &buf}
+
+	r := s.newRiver(
+		ESTargetConfig{Name: "primary", Required: true},
+		ESTargetConfig{Name: "replica", Required: true},
+		ESTargetConfig{Name: "backup", FailurePolicy: FailurePolicySkip},
+	)
+	ts, err := r.newESTargets(base)
+	c.Assert(err, IsNil)
+	r.targets = ts
+
+	reqs := []*elasticwrapper.BulkRequest{
+		{Action: elasticwrapper.ActionIndex, Index: "test", ID: "1", Data: map[string]interface{}{"a": 1}},
+	}
+	c.Assert(ts.Write(reqs), IsNil)
+
+	// every target writes the request
+	for _, t := range ts.targets {
+		c.Assert(t.client.Queued(), Equals, int64(1))
+	}
+
+	pos1 := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	r.snapshotProgress = &snapshotProgress{}
+	pending := []pendingPos{{pos: pos1, queued: ts.marks()}, {snapshot: &snapshotSaver{done: true}, queued: ts.marks()}}
+	c.Assert(pending[0].queued, DeepEquals, []int64{1, 1})
+
+	pending, err = r.savePending(pending)
+	c.Assert(err, IsNil)
+	c.Assert(pending, HasLen, 0)
+	c.Assert(r.master.Position(), Equals, pos1)
+	c.Assert(r.snapshotProgress.Done, IsTrue)
+
+	// a failed optional target doesn't hold the position back
+	ts.onAck(ts.targets[2])(reqs, errors.New("unavailable"))
+	c.Assert(ts.targets[2].failed.Get(), Equals, int64(1))
+	c.Assert(r.ctx.Err(), IsNil)
+
+	c.Assert(ts.Write(reqs), IsNil)
+	pos2 := mysql.Position{Name: "mysql-bin.000001", Pos: 100}
+	r.snapshotProgress = &snapshotProgress{}
+	pending = []pendingPos{{pos: pos2, queued: ts.marks()}, {snapshot: &snapshotSaver{done: true}, queued: ts.marks()}}
+
+	// a blocked required target does, and the snapshot progress too
+	ts.onAck(ts.targets[1])(reqs, errors.New("unavailable"))
+	c.Assert(ts.targets[1].blocked.Get(), IsTrue)
+	c.Assert(r.ctx.Err(), NotNil)
+
+	pending, err = r.savePending(pending)
+	c.Assert(err, IsNil)
+	c.Assert(pending, HasLen, 2)
+	c.Assert(r.master.Position(), Equals, pos1)
+	c.Assert(r.snapshotProgress.Done, IsFalse)
+}
+
+func (s *targetTestSuite) TestDLQ(c *C) {
+	dir, err := ioutil.TempDir("", "river_dlq")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	base := elasticwrapper.ClientConfig{DryRun: &buf}
+
+	dlq := path.Join(dir, "dlq.json")
+	r := s.newRiver(ESTargetConfig{Name: "a", FailurePolicy: FailurePolicyDLQ, DLQPath: dlq})
+	ts, err := r.newESTargets(base)
+	c.Assert(err, IsNil)
+	defer ts.Close()
+
+	reqs := []*elasticwrapper.BulkRequest{
+		{Action: elasticwrapper.ActionDelete, Index: "test", ID: "1", HardCrud: true},
+	}
+	ts.onAck(ts.targets[0])(reqs, errors.New("unavailable"))
+	c.Assert(ts.targets[0].blocked.Get(), IsFalse)
+	c.Assert(r.ctx.Err(), IsNil)
+
+	data, err := ioutil.ReadFile(dlq)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "{\"delete\":{\"_index\":\"test\",\"_id\":\"1\"}}\n")
+}
+
+func (s *targetTestSuite) TestItems(c *C) {
+	var buf bytes.Buffer
+	base := elasticwrapper.ClientConfig{DryRun: &buf}
+
+	r := s.newRiver(ESTargetConfig{Name: "a", Required: true, FailurePolicy: FailurePolicySkip})
+	ts, err := r.newESTargets(base)
+	c.Assert(err, IsNil)
+	r.targets = ts
+	t := ts.targets[0]
+
+	ok := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionIndex, Index: "test", ID: "1", Data: map[string]interface{}{"a": 1}}
+	missing := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionUpdate, Index: "test", ID: "2", Data: map[string]interface{}{"a": 1}}
+	conflict := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionUpdate, Index: "test", ID: "3", Data: map[string]interface{}{"a": 1}}
+	bad := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionIndex, Index: "test", ID: "4", Data: map[string]interface{}{"a": "x"}}
+
+	ts.onItems(t)([]*elasticwrapper.ItemResult{
+		{Request: ok, Action: "update", Status: 200, Outcome: elasticwrapper.OutcomeSuccess},
+		{Request: missing, Action: "update", Status: 404, Outcome: elasticwrapper.OutcomeNotFound},
+		{Request: conflict, Action: "update", Status: 409, Outcome: elasticwrapper.OutcomeConflict},
+		{Request: bad, Action: "update", Status: 400, Outcome: elasticwrapper.OutcomeMappingError},
+	})
+
+	c.Assert(t.outcomes[elasticwrapper.OutcomeSuccess].Get(), Equals, int64(1))
+	c.Assert(t.outcomes[elasticwrapper.OutcomeNotFound].Get(), Equals, int64(1))
+	c.Assert(t.outcomes[elasticwrapper.OutcomeConflict].Get(), Equals, int64(1))
+	c.Assert(t.outcomes[elasticwrapper.OutcomeMappingError].Get(), Equals, int64(1))
+	// the mapping error went to the failure policy
+	c.Assert(t.failed.Get(), Equals, int64(1))
+
+	// the conflict is written again, the position waits for it
+	c.Assert(t.retried.Get(), Equals, int64(1))
+	c.Assert(t.retrying.Get(), Equals, int64(1))
+	c.Assert(ts.committed(ts.marks()), IsFalse)
+
+	for i := 0; i < 100 && t.client.Queued() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(t.client.Queued(), Equals, int64(1))
+
+	retry := *conflict
+	retry.Retries = 1
+	ts.onItems(t)([]*elasticwrapper.ItemResult{
+		{Request: &retry, Action: "update", Status: 200, Outcome: elasticwrapper.OutcomeSuccess},
+	})
+	c.Assert(t.retrying.Get(), Equals, int64(0))
+	c.Assert(ts.committed(ts.marks()), IsTrue)
+
+	// the last retry fails for good
+	last := *conflict
+	last.Retries = maxRetries
+	t.retrying.Add(1)
+	ts.onItems(t)([]*elasticwrapper.ItemResult{
+		{Request: &last, Action: "update", Status: 409, Outcome: elasticwrapper.OutcomeConflict},
+	})
+	c.Assert(t.retried.Get(), Equals, int64(1))
+	c.Assert(t.retrying.Get(), Equals, int64(0))
+	c.Assert(t.failed.Get(), Equals, int64(2))
+
+	// create_only found the document, nothing to retry or fail
+	exists := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionCreate, Index: "test", ID: "5", Data: map[string]interface{}{"a": 1}}
+	ts.onItems(t)([]*elasticwrapper.ItemResult{
+		{Request: exists, Action: "create", Status: 409, Outcome: elasticwrapper.OutcomeConflict},
+	})
+	c.Assert(t.outcomes[elasticwrapper.OutcomeConflict].Get(), Equals, int64(3))
+	c.Assert(t.retried.Get(), Equals, int64(1))
+	c.Assert(t.failed.Get(), Equals, int64(2))
+}
+
+func (s *targetTestSuite) TestStaleRetry(c *C) {
+	var buf bytes.Buffer
+	r := s.newRiver(ESTargetConfig{Name: "a", Required: true, FailurePolicy: FailurePolicySkip})
+	ts, err := r.newESTargets(elasticwrapper.ClientConfig{DryRun: &buf})
+	c.Assert(err, IsNil)
+	t := ts.targets[0]
+
+	first := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionIndex, Index: "test", ID: "1",
+		Data: map[string]interface{}{"a": 1, "b": 1}}
+	second := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionUpdate, Index: "test", ID: "1",
+		Data: map[string]interface{}{"b": 2}}
+	other := &elasticwrapper.BulkRequest{Action: elasticwrapper.ActionUpdate, Index: "test", ID: "2",
+		Data: map[string]interface{}{"b": 3}}
+	t.written([]*elasticwrapper.BulkRequest{first, second, other})
+
+	// the later update wrote b, the retry only a
+	retry := t.unwritten(first)
+	c.Assert(retry.Data, DeepEquals, map[string]interface{}{"a": 1})
+	c.Assert(retry.Action, Equals, elasticwrapper.ActionUpdate)
+	c.Assert(first.Data, DeepEquals, map[string]interface{}{"a": 1, "b": 1})
+	c.Assert(t.unwritten(other), Equals, other)
+
+	// a later replace leaves nothing
+	t.written([]*elasticwrapper.BulkRequest{{Action: elasticwrapper.ActionIndex, Index: "test", ID: "1",
+		Data: map[string]interface{}{"a": 2}}})
+	c.Assert(t.unwritten(second), IsNil)
+
+	// the documents are forgotten once their requests are done, in any order
+	t.done([]*elasticwrapper.BulkRequest{second, other})
+	c.Assert(t.docs, HasLen, 1)
+	t.done([]*elasticwrapper.BulkRequest{retry, t.docs["test//1"][2].req})
+	c.Assert(t.docs, HasLen, 0)
+}
@@ -0,0 +1,79 @@
+package river
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/jrots/go-mysql-elasticsearch/utils"
+)
+
+// TLS modes of the MySQL connections
+const (
+	// TLS if the server supports it, the certificate is not verified
+	MySQLTLSPreferred = "preferred"
+	// TLS, the certificate is not verified
+	MySQLTLSRequired = "required"
+	// TLS, the certificate must be signed by my_ca_cert (or a system CA) for the host of my_addr
+	MySQLTLSVerifyIdentity = "verify-identity"
+)
+
+// mysqlTLS returns the TLS config of the MySQL connections, nil if TLS is disabled.
+func (r *River) mysqlTLS() (*tls.Config, error) {
+	switch r.c.MyTLSMode {
+	case "":
+		return nil, nil
+	case MySQLTLSPreferred, MySQLTLSRequired, MySQLTLSVerifyIdentity:
+	default:
+		return nil, errors.Errorf("invalid my_tls_mode %s", r.c.MyTLSMode)
+	}
+
+	verify := r.c.MyTLSMode == MySQLTLSVerifyIdentity
+	cfg, err := utils.NewTLSConfig(r.c.MyCACert, r.c.MyClientCert, r.c.MyClientKey, !verify)
+	if err != nil {
+		return nil, errors.Annotate(err, "my_tls_mode")
+	}
+
+	if verify {
+		host, _, err := net.SplitHostPort(r.c.MyAddr)
+		if err != nil {
+			return nil, errors.Annotatef(err, "my_addr %s", r.c.MyAddr)
+		}
+		cfg.ServerName = host
+	}
+	return cfg, nil
+}
+
+// mysqldumpTLSArgs returns the mysqldump options matching my_tls_mode.
+func (r *River) mysqldumpTLSArgs() []string {
+	if len(r.c.MyTLSMode) == 0 {
+		return nil
+	}
+
+	args := []string{fmt.Sprintf("--ssl-mode=%s", strings.ToUpper(strings.Replace(r.c.MyTLSMode, "-", "_", -1)))}
+	if len(r.c.MyCACert) > 0 {
+		args = append(args, fmt.Sprintf("--ssl-ca=%s", r.c.MyCACert))
+	}
+	if len(r.c.MyClientCert) > 0 {
+		args = append(args, fmt.Sprintf("--ssl-cert=%s", r.c.MyClientCert))
+	}
+	if len(r.c.MyClientKey) > 0 {
+		args = append(args, fmt.Sprintf("--ssl-key=%s", r.c.MyClientKey))
+	}
+	return args
+}
+
+// esTLS returns the TLS config of a target, nil if it has no TLS settings.
+// An addr with https:// and no settings uses the system CAs.
+func esTLS(cfg *ESTargetConfig) (*tls.Config, error) {
+	if len(cfg.CACert) == 0 && len(cfg.ClientCert) == 0 && len(cfg.ClientKey) == 0 && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+	if strings.HasPrefix(cfg.Addr, "http://") {
+		return nil, errors.Errorf("TLS settings with plain http addr %s", cfg.Addr)
+	}
+
+	return utils.NewTLSConfig(cfg.CACert, cfg.ClientCert, cfg.ClientKey, cfg.InsecureSkipVerify)
+}
@@ -0,0 +1,52 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+)
+
+type tlsTestSuite struct{}
+
+var _ = Suite(&tlsTestSuite{})
+
+func (s *tlsTestSuite) TestMySQLTLS(c *C) {
+	r := &River{c: &Config{MyAddr: "db.example.com:3306"}}
+	cfg, err := r.mysqlTLS()
+	c.Assert(err, IsNil)
+	c.Assert(cfg, IsNil)
+	c.Assert(r.mysqldumpTLSArgs(), HasLen, 0)
+
+	r.c.MyTLSMode = MySQLTLSRequired
+	cfg, err = r.mysqlTLS()
+	c.Assert(err, IsNil)
+	c.Assert(cfg.InsecureSkipVerify, IsTrue)
+	c.Assert(r.mysqldumpTLSArgs(), DeepEquals, []string{"--ssl-mode=REQUIRED"})
+
+	r.c.MyTLSMode = MySQLTLSVerifyIdentity
+	r.c.MyClientCert = "/etc/river/client.pem"
+	cfg, err = r.mysqlTLS()
+	c.Assert(err, NotNil)
+
+	r.c.MyClientCert = ""
+	cfg, err = r.mysqlTLS()
+	c.Assert(err, IsNil)
+	c.Assert(cfg.InsecureSkipVerify, IsFalse)
+	c.Assert(cfg.ServerName, Equals, "db.example.com")
+	c.Assert(r.mysqldumpTLSArgs(), DeepEquals, []string{"--ssl-mode=VERIFY_IDENTITY"})
+
+	r.c.MyTLSMode = "on"
+	_, err = r.mysqlTLS()
+	c.Assert(err, NotNil)
+}
+
+func (s *tlsTestSuite) TestESTLS(c *C) {
+	cfg, err := esTLS(&ESTargetConfig{Addr: "https://es.example.com:9200"})
+	c.Assert(err, IsNil)
+	c.Assert(cfg, IsNil)
+
+	cfg, err = esTLS(&ESTargetConfig{Addr: "es.example.com:9200", InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	c.Assert(cfg.InsecureSkipVerify, IsTrue)
+
+	_, err = esTLS(&ESTargetConfig{Addr: "http://es.example.com:9200", InsecureSkipVerify: true})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,444 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+	"github.com/jrots/go-mysql/canal"
+	"github.com/jrots/go-mysql/client"
+)
+
+// VerifyResult counts the documents of one rule which drifted from MySQL.
+type VerifyResult struct {
+	Schema string
+	Table  string
+	Index  string
+
+	Rows      int64
+	Missing   int64
+	Extra     int64
+	Different int64
+	Repaired  int64
+
+	// set for rules whose documents can't be compared with one row, e.g. with a concatField,
+	// or which don't write to Elasticsearch
+	Skipped bool
+}
+
+func (v *VerifyResult) String() string {
+	if v.Skipped {
+		return fmt.Sprintf("%s.%s index:%s skipped", v.Schema, v.Table, v.Index)
+	}
+	return fmt.Sprintf("%s.%s index:%s rows:%d missing:%d extra:%d different:%d repaired:%d",
+		v.Schema, v.Table, v.Index, v.Rows, v.Missing, v.Extra, v.Different, v.Repaired)
+}
+
+// Drifted reports whether any document differs from MySQL.
+func (v *VerifyResult) Drifted() bool {
+	return v.Missing > 0 || v.Extra > 0 || v.Different > 0
+}
+
+// Verify walks the table of every rule in PK chunks and compares the fields every row would be
+// synced to with the document in Elasticsearch. Extra documents are only looked for in indices
+// which belong to one rule. With repair, the rows of missing and different documents are read
+// again and synced, extra documents without a row are deleted, through the sync loop like the
+// binlog changes.
+func (r *River) Verify(repair bool) ([]*VerifyResult, error) {
+	conn, err := r.connectMySQL()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+
+	if repair {
+		r.wg.Add(1)
+		go r.syncLoop()
+	}
+
+	r.rulesLock.RLock()
+	keys := make([]string, 0, len(r.rules))
+	for key := range r.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rules := make([]*Rule, 0, len(keys))
+	for _, key := range keys {
+		rules = append(rules, r.rules[key])
+	}
+	r.rulesLock.RUnlock()
+
+	results := make([]*VerifyResult, 0, len(rules))
+	for _, rule := range rules {
+		res, err := r.verifyRule(conn, rule, repair)
+		if err != nil {
+			return results, errors.Trace(err)
+		}
+		log.Infof("verify %s", res)
+		results = append(results, res)
+	}
+
+	if repair {
+		if err = r.waitFlush(); err != nil {
+			return results, errors.Trace(err)
+		}
+	}
+	return results, nil
+}
+
+// ownsIndex reports whether no other rule writes to the index of the rule.
+func (r *River) ownsIndex(rule *Rule) bool {
+	r.rulesLock.RLock()
+	defer r.rulesLock.RUnlock()
+
+	for _, other := range r.rules {
+		if other != rule && (other.Index == rule.Index || other.AuditIndex == rule.Index) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *River) verifyRule(conn *client.Conn, rule *Rule, repair bool) (*VerifyResult, error) {
+	res := &VerifyResult{Schema: rule.Schema, Table: rule.Table, Index: rule.Index}
+	if rule.ConcatField != "" || rule.IsLink() || rule.IsAggregate() || rule.AuditOnly || len(rule.Sink) > 0 {
+		res.Skipped = true
+		return res, nil
+	}
+
+	// IDs of all rows, to find the extra documents
+	var ids map[string]struct{}
+	if r.ownsIndex(rule) && !rule.IgnoreDeletes() {
+		ids = make(map[string]struct{})
+	}
+
+	var last []interface{}
+	limit := r.snapshotChunkSize()
+	for {
+		if err := r.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		rs, err := conn.Execute(chunkQuery(rule, last, nil, limit))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		n := rs.RowNumber()
+		if n == 0 {
+			break
+		}
+
+		rows := make([][]interface{}, n)
+		for i, values := range rs.Values {
+			rows[i] = snapshotRow(rule.TableInfo, values)
+		}
+		if err = r.verifyChunk(conn, rule, rows, ids, repair, res); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if n < limit {
+			break
+		}
+		if last, err = pkValues(rule.TableInfo, rs.Values[n-1]); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if ids == nil {
+		return res, nil
+	}
+
+	var extra []string
+	err := r.es.ScrollIDs(rule.Index, func(id string) error {
+		if _, ok := ids[id]; ok {
+			return nil
+		}
+
+		res.Extra++
+		log.Warnf("verify %s.%s: extra document %s/%s", rule.Schema, rule.Table, rule.Index, id)
+		if repair {
+			extra = append(extra, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for len(extra) > 0 {
+		n := limit
+		if n > len(extra) {
+			n = len(extra)
+		}
+		deletes, err := r.extraDeletes(conn, rule, extra[:n])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = r.repair(deletes); err != nil {
+			return nil, errors.Trace(err)
+		}
+		res.Repaired += int64(len(deletes))
+		extra = extra[n:]
+	}
+
+	return res, nil
+}
+
+func (r *River) verifyChunk(conn *client.Conn, rule *Rule, rows [][]interface{}, ids map[string]struct{}, repair bool,
+	res *VerifyResult) error {
+	expected := make([]*elasticwrapper.BulkRequest, len(rows))
+	refs := make([]elasticwrapper.DocRef, len(rows))
+	for i, row := range rows {
+		req, err := r.newBulkRequest(rule, row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		r.makeInsertReqData(req, rule, row)
+
+		expected[i] = req
+		refs[i] = elasticwrapper.DocRef{Index: req.Index, Type: req.Type, ID: req.ID, Routing: req.Parent}
+		if ids != nil {
+			ids[req.ID] = struct{}{}
+		}
+	}
+
+	docs, err := r.es.MultiGet(refs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(docs) != len(rows) {
+		return errors.Errorf("get %d documents from %s, but %d returned", len(rows), rule.Index, len(docs))
+	}
+
+	var repairPKs [][]interface{}
+	for i, doc := range docs {
+		res.Rows++
+		if !doc.Found {
+			res.Missing++
+			log.Warnf("verify %s.%s: missing document %s/%s", rule.Schema, rule.Table, rule.Index, expected[i].ID)
+		} else {
+			fields, err := diffFields(expected[i].Data, doc.Source)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			res.Different++
+			log.Warnf("verify %s.%s: document %s/%s differs in %v", rule.Schema, rule.Table, rule.Index, expected[i].ID, fields)
+		}
+
+		pk, err := pkValues(rule.TableInfo, rows[i])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		repairPKs = append(repairPKs, pk)
+	}
+
+	if !repair || len(repairPKs) == 0 {
+		return nil
+	}
+
+	// the binlog may have changed or deleted the rows since the chunk was read
+	repairRows, err := r.readRows(conn, rule, repairPKs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(repairRows) == 0 {
+		return nil
+	}
+	reqs, err := r.makeRowsRequest(rule, &canal.RowsEvent{Table: rule.TableInfo, Action: canal.InsertAction, Rows: repairRows})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = r.repair(reqs); err != nil {
+		return errors.Trace(err)
+	}
+	res.Repaired += int64(len(repairRows))
+	return nil
+}
+
+// extraDeletes returns the deletes of the extra documents which still have no row. The PK of a
+// document is read from its fields, a document without them is kept.
+func (r *River) extraDeletes(conn *client.Conn, rule *Rule, ids []string) ([]*elasticwrapper.BulkRequest, error) {
+	refs := make([]elasticwrapper.DocRef, len(ids))
+	for i, id := range ids {
+		refs[i] = elasticwrapper.DocRef{Index: rule.Index, Type: rule.Type, ID: id}
+	}
+	docs, err := r.es.MultiGet(refs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var found []string
+	var pks [][]interface{}
+	for i, doc := range docs {
+		if !doc.Found {
+			// deleted since
+			continue
+		}
+		pk, ok := r.docPK(rule, doc.Source)
+		if !ok {
+			log.Warnf("verify %s.%s: extra document %s/%s has no PK fields, not deleted", rule.Schema, rule.Table, rule.Index, ids[i])
+			continue
+		}
+		found = append(found, ids[i])
+		pks = append(pks, pk)
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	// a row inserted after its chunk was read has a document now
+	rows, err := r.readRows(conn, rule, pks)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	synced := make(map[string]struct{}, len(rows))
+	for _, row := range rows {
+		req, err := r.newBulkRequest(rule, row)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		synced[req.ID] = struct{}{}
+	}
+
+	deletes := make([]*elasticwrapper.BulkRequest, 0, len(found))
+	for _, id := range found {
+		if _, ok := synced[id]; ok {
+			log.Infof("verify %s.%s: extra document %s/%s has a row now, not deleted", rule.Schema, rule.Table, rule.Index, id)
+			continue
+		}
+		deletes = append(deletes, &elasticwrapper.BulkRequest{
+			Action:   elasticwrapper.ActionDelete,
+			Index:    rule.Index,
+			Type:     rule.Type,
+			ID:       id,
+			HardCrud: true,
+		})
+	}
+	return deletes, nil
+}
+
+// docPK returns the PK of the row a document was synced from, false if a PK column isn't a field.
+func (r *River) docPK(rule *Rule, source map[string]interface{}) ([]interface{}, bool) {
+	pk := make([]interface{}, 0, len(rule.TableInfo.PKColumns))
+	for _, i := range rule.TableInfo.PKColumns {
+		column := rule.TableInfo.Columns[i].Name
+		field := column
+		if v, ok := rule.FieldMapping[column]; ok {
+			_, field, _ = r.getFieldParts(column, v)
+		}
+
+		value, ok := source[field]
+		switch v := value.(type) {
+		case float64:
+			if v == float64(int64(v)) {
+				value = int64(v)
+			}
+		case string:
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, false
+		}
+		pk = append(pk, value)
+	}
+	return pk, true
+}
+
+// readRows reads the rows of the PKs, the rows deleted since are missing.
+func (r *River) readRows(conn *client.Conn, rule *Rule, pks [][]interface{}) ([][]interface{}, error) {
+	rs, err := conn.Execute(rowsQuery(rule, pks))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rows := make([][]interface{}, len(rs.Values))
+	for i, values := range rs.Values {
+		rows[i] = snapshotRow(rule.TableInfo, values)
+	}
+	return rows, nil
+}
+
+// rowsQuery returns the query reading the rows of the PKs.
+func rowsQuery(rule *Rule, pks [][]interface{}) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("SELECT ")
+	for i, c := range rule.TableInfo.Columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(quoteName(c.Name))
+	}
+	buf.WriteString(" FROM ")
+	buf.WriteString(quoteTable(rule))
+
+	buf.WriteString(" WHERE (")
+	for i, pk := range rule.TableInfo.PKColumns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(quoteName(rule.TableInfo.Columns[pk].Name))
+	}
+	buf.WriteString(") IN (")
+	for i, values := range pks {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString("(")
+		for j, v := range values {
+			if j > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(quoteValue(v))
+		}
+		buf.WriteString(")")
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
+
+// repair hands the requests to the sync loop, they are coalesced and written with the binlog changes.
+func (r *River) repair(reqs []*elasticwrapper.BulkRequest) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+	select {
+	case r.syncCh <- reqs:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// diffFields returns the sorted names of the expected fields which differ in the document source.
+// Fields of the document which are not expected are ignored, other rules may write them.
+func diffFields(expected map[string]interface{}, source map[string]interface{}) ([]string, error) {
+	// compare the JSON values, like they are sent to Elasticsearch
+	data, err := json.Marshal(expected)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var want map[string]interface{}
+	if err = json.Unmarshal(data, &want); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var fields []string
+	for k, v := range want {
+		if !reflect.DeepEqual(v, source[k]) {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
@@ -0,0 +1,76 @@
+package river
+
+import (
+	. "github.com/pingcap/check"
+)
+
+type verifyTestSuite struct{}
+
+var _ = Suite(&verifyTestSuite{})
+
+func (s *verifyTestSuite) TestDiffFields(c *C) {
+	expected := map[string]interface{}{
+		"id":    int64(1),
+		"title": "first",
+		"tags":  []string{"a", "b"},
+		"price": float64(1.5),
+	}
+	source := map[string]interface{}{
+		"id":    float64(1),
+		"title": "first",
+		"tags":  []interface{}{"a", "b"},
+		"price": float64(1.5),
+		// written by another rule
+		"count": float64(3),
+	}
+
+	fields, err := diffFields(expected, source)
+	c.Assert(err, IsNil)
+	c.Assert(fields, HasLen, 0)
+
+	source["title"] = "second"
+	delete(source, "tags")
+	fields, err = diffFields(expected, source)
+	c.Assert(err, IsNil)
+	c.Assert(fields, DeepEquals, []string{"tags", "title"})
+}
+
+func (s *verifyTestSuite) TestOwnsIndex(c *C) {
+	r := &River{rules: map[string]*Rule{}}
+	a := newDefaultRule("test", "a")
+	b := newDefaultRule("test", "b")
+	r.rules[ruleKey("test", "a")] = a
+	r.rules[ruleKey("test", "b")] = b
+
+	c.Assert(r.ownsIndex(a), IsTrue)
+
+	b.Index = "a"
+	c.Assert(r.ownsIndex(a), IsFalse)
+}
+
+func (s *verifyTestSuite) testRule(c *C) *Rule {
+	return newTestRule(c, "t", []string{"a int(11)", "b varchar(256)", "c varchar(256)"}, func(rule *Rule) {
+		rule.TableInfo.PKColumns = []int{0, 1}
+		rule.FieldMapping = map[string]string{"b": "name"}
+	})
+}
+
+func (s *verifyTestSuite) TestRowsQuery(c *C) {
+	rule := s.testRule(c)
+
+	c.Assert(rowsQuery(rule, [][]interface{}{{int64(1), "x"}, {int64(2), "it's"}}), Equals,
+		"SELECT `a`, `b`, `c` FROM `test`.`t` WHERE (`a`, `b`) IN ((1, 'x'), (2, 'it\\'s'))")
+}
+
+func (s *verifyTestSuite) TestDocPK(c *C) {
+	rule := s.testRule(c)
+	r := &River{}
+
+	// the values of the document are JSON, the mapped field has the PK column
+	pk, ok := r.docPK(rule, map[string]interface{}{"a": float64(7), "name": "x", "c": "y"})
+	c.Assert(ok, IsTrue)
+	c.Assert(pk, DeepEquals, []interface{}{int64(7), "x"})
+
+	_, ok = r.docPK(rule, map[string]interface{}{"a": float64(7), "b": "x"})
+	c.Assert(ok, IsFalse)
+}
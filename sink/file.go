@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+// File appends the bulk lines of the requests to a NDJSON file, which can be sent to
+// the Elasticsearch bulk API as is.
+type File struct {
+	sync.Mutex
+
+	f   *os.File
+	w   *bufio.Writer
+	ack func(reqs []*elasticwrapper.BulkRequest, err error)
+}
+
+// NewFile opens the file for appending, - is stdout.
+func NewFile(path string) (*File, error) {
+	f := os.Stdout
+	if path != "-" {
+		var err error
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return &File{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (s *File) Write(reqs []*elasticwrapper.BulkRequest) error {
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.write(reqs)
+	if s.ack != nil {
+		s.ack(reqs, err)
+	}
+	return errors.Trace(err)
+}
+
+func (s *File) write(reqs []*elasticwrapper.BulkRequest) error {
+	for _, req := range reqs {
+		lines, err := req.Lines()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, line := range lines {
+			if _, err = io.WriteString(s.w, line+"\n"); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return errors.Trace(s.w.Flush())
+}
+
+func (s *File) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.w.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	if s.f == os.Stdout {
+		return nil
+	}
+	return errors.Trace(s.f.Sync())
+}
+
+func (s *File) SetAckHandler(fn func(reqs []*elasticwrapper.BulkRequest, err error)) {
+	s.ack = fn
+}
+
+func (s *File) Close() error {
+	if err := s.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	if s.f == os.Stdout {
+		return nil
+	}
+	return errors.Trace(s.f.Close())
+}
@@ -0,0 +1,27 @@
+// Package sink has the destinations the river writes the requests built from the rows to.
+package sink
+
+import (
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+// Sink types
+const (
+	TypeElasticsearch = "elasticsearch"
+	TypeFile          = "file"
+	TypeWebhook       = "webhook"
+)
+
+// Sink consumes the requests the river builds from the binlog and snapshot rows.
+type Sink interface {
+	// Write sends or queues the requests, in order.
+	Write(reqs []*elasticwrapper.BulkRequest) error
+	// Flush sends all queued requests and waits for them.
+	Flush() error
+	// SetAckHandler sets the function called with the requests once they are sent,
+	// err is set if sending them failed.
+	SetAckHandler(fn func(reqs []*elasticwrapper.BulkRequest, err error))
+	Close() error
+}
+
+var _ Sink = (*elasticwrapper.Client)(nil)
@@ -0,0 +1,96 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	. "github.com/pingcap/check"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type sinkTestSuite struct{}
+
+var _ = Suite(&sinkTestSuite{})
+
+func testRequests() []*elasticwrapper.BulkRequest {
+	return []*elasticwrapper.BulkRequest{
+		{Action: elasticwrapper.ActionIndex, Index: "river", Type: "river", ID: "1", HardCrud: true,
+			Data: map[string]interface{}{"title": "first"}},
+		{Action: elasticwrapper.ActionUpdate, Index: "river", Type: "river", ID: "2",
+			Data: map[string]interface{}{"title": "second"}, DeleteFields: map[string]interface{}{"content": true}},
+	}
+}
+
+func (s *sinkTestSuite) TestFile(c *C) {
+	dir, err := ioutil.TempDir("", "sink")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	f, err := NewFile(path.Join(dir, "river.ndjson"))
+	c.Assert(err, IsNil)
+
+	var acked int
+	f.SetAckHandler(func(reqs []*elasticwrapper.BulkRequest, err error) {
+		c.Assert(err, IsNil)
+		acked += len(reqs)
+	})
+
+	c.Assert(f.Write(testRequests()), IsNil)
+	c.Assert(f.Close(), IsNil)
+	c.Assert(acked, Equals, 2)
+
+	data, err := ioutil.ReadFile(path.Join(dir, "river.ndjson"))
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	// index and the update removing the deleted field
+	c.Assert(lines, HasLen, 4)
+	c.Assert(strings.HasPrefix(lines[0], `{"index":`), IsTrue)
+	c.Assert(strings.Contains(lines[3], `"remove":["content"]`), IsTrue)
+}
+
+func (s *sinkTestSuite) TestWebhook(c *C) {
+	var events []*Event
+	var header string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header.Get("X-Token")
+		scanner := bufio.NewScanner(req.Body)
+		for scanner.Scan() {
+			e := new(Event)
+			c.Assert(json.Unmarshal(scanner.Bytes(), e), IsNil)
+			events = append(events, e)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	hook := NewWebhook(srv.URL, map[string]string{"X-Token": "secret"}, 0)
+
+	var failed int
+	hook.SetAckHandler(func(reqs []*elasticwrapper.BulkRequest, err error) {
+		if err != nil {
+			failed += len(reqs)
+		}
+	})
+
+	c.Assert(hook.Write(testRequests()), IsNil)
+	c.Assert(header, Equals, "secret")
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].Action, Equals, elasticwrapper.ActionIndex)
+	c.Assert(events[1].DeleteFields, DeepEquals, []string{"content"})
+
+	status = http.StatusInternalServerError
+	c.Assert(hook.Write(testRequests()), NotNil)
+	c.Assert(failed, Equals, 2)
+}
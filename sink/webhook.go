@@ -0,0 +1,114 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/jrots/go-mysql-elasticsearch/elasticwrapper"
+)
+
+// Event is the JSON line a webhook gets for every request. For a delete which only
+// removes the synced fields from the document, Data has these fields.
+type Event struct {
+	Action       string                 `json:"action"`
+	Index        string                 `json:"index"`
+	Type         string                 `json:"type,omitempty"`
+	ID           string                 `json:"id"`
+	Parent       string                 `json:"parent,omitempty"`
+	Data         map[string]interface{} `json:"data,omitempty"`
+	DeleteFields []string               `json:"delete_fields,omitempty"`
+}
+
+func newEvent(req *elasticwrapper.BulkRequest) *Event {
+	e := &Event{
+		Action: req.Action,
+		Index:  req.Index,
+		Type:   req.Type,
+		ID:     req.ID,
+		Parent: req.Parent,
+		Data:   req.Data,
+	}
+	for k := range req.DeleteFields {
+		e.DeleteFields = append(e.DeleteFields, k)
+	}
+	sort.Strings(e.DeleteFields)
+	return e
+}
+
+// Webhook posts every batch of requests as NDJSON events to an URL.
+// A write fails if the URL doesn't answer with 2xx.
+type Webhook struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	ack     func(reqs []*elasticwrapper.BulkRequest, err error)
+}
+
+func NewWebhook(url string, headers map[string]string, timeout time.Duration) *Webhook {
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &Webhook{
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *Webhook) Write(reqs []*elasticwrapper.BulkRequest) error {
+	err := s.post(reqs)
+	if s.ack != nil {
+		s.ack(reqs, err)
+	}
+	return errors.Trace(err)
+}
+
+func (s *Webhook) post(reqs []*elasticwrapper.BulkRequest) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, req := range reqs {
+		if err := enc.Encode(newEvent(req)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	req, err := http.NewRequest("POST", s.url, &buf)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// Flush does nothing, every write is posted right away.
+func (s *Webhook) Flush() error {
+	return nil
+}
+
+func (s *Webhook) SetAckHandler(fn func(reqs []*elasticwrapper.BulkRequest, err error)) {
+	s.ack = fn
+}
+
+func (s *Webhook) Close() error {
+	return nil
+}
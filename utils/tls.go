@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+)
+
+// NewTLSConfig returns a TLS config trusting the PEM CA bundle, or the system roots if caCert is empty,
+// with the client certificate if certFile and keyFile are set.
+func NewTLSConfig(caCert string, certFile string, keyFile string, skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: skipVerify}
+
+	if len(caCert) > 0 {
+		data, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no PEM certificate in %s", caCert)
+		}
+	}
+
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		if len(certFile) == 0 || len(keyFile) == 0 {
+			return nil, errors.Errorf("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}